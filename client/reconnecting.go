@@ -0,0 +1,278 @@
+package client
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jomstead/go-rudp/clock"
+)
+
+const (
+	KeepaliveInterval = time.Second     // default time without sending before a ReconnectingClient sends a keepalive
+	LostTimeout       = 5 * time.Second // default time without hearing from the server before the connection is lost
+	RedialAttempts    = 10              // default number of redials before a ReconnectingClient gives up
+)
+
+var (
+	ErrBuffered        = errors.New("reconnecting, the payload is sent once the connection is back, see OnFlush")
+	ErrNotConnected    = errors.New("not connected")
+	ErrReconnectFailed = errors.New("gave up reconnecting")
+)
+
+// State is the connection state of a ReconnectingClient
+type State uint8
+
+const (
+	StateConnecting   State = iota + 1 // Connect is dialing the server for the first time
+	StateConnected                     // the connection is up
+	StateReconnecting                  // the connection was lost, redialing with backoff
+	StateFailed                        // gave up, Connect starts over
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// Event reports a change of a ReconnectingClient's state
+type Event struct {
+	State   State
+	Attempt int   // redials so far, 0 for the first dial
+	Resumed bool  // StateConnected only, the old connection was resumed with sequence numbers and unverified packets intact
+	Err     error // why the connection was lost or the last redial failed, nil when connected
+}
+
+// ReconnectingClient wraps an RUDPClient and redials the server when the connection is lost.  ReadFromUDP sends
+// keepalives while the client has nothing to send, and counts the connection as lost when the server doesn't
+// answer for the lost timeout or the socket reports the server unreachable.  It then redials with jittered
+// exponential backoff, resuming the connection if the server gave the client a ticket (see server.SetTimeout)
+// and connecting anew otherwise.  Write may be called from other goroutines while one goroutine is in ReadFromUDP,
+// connected or reconnecting.
+type ReconnectingClient struct {
+	*RUDPClient
+	mu           sync.Mutex
+	state        State
+	keepalive    time.Duration
+	timeout      time.Duration
+	backoff      time.Duration
+	max_backoff  time.Duration
+	attempts     int
+	buffer_limit int
+	buffer       [][]byte  // reliable payloads written while reconnecting
+	last_sent    time.Time // when the last packet was sent to the server
+	closed       bool
+	on_state     func(Event)
+	on_flush     func(payload []byte, seq uint32)
+}
+
+// NewReconnectingClient wraps c, configure c (codecs, encryption, tokens) before calling Connect on the wrapper
+func NewReconnectingClient(c *RUDPClient) *ReconnectingClient {
+	return &ReconnectingClient{
+		RUDPClient:  c,
+		keepalive:   KeepaliveInterval,
+		timeout:     LostTimeout,
+		backoff:     ReconnectBackoff,
+		max_backoff: ReconnectMaxBackoff,
+		attempts:    RedialAttempts,
+	}
+}
+
+// SetTimeout sets how long the client waits without sending before it sends a keepalive and how long without
+// hearing from the server before the connection counts as lost.  Keep keepalive well below the server's timeout.
+func (r *ReconnectingClient) SetTimeout(keepalive time.Duration, timeout time.Duration) {
+	r.keepalive = keepalive
+	r.timeout = timeout
+}
+
+// SetBackoff sets the wait after the first failed redial, doubled after each failure up to max, and the number of
+// redials before giving up, 0 never gives up.  Each wait is randomized between half and all of it so clients
+// that lost the same server don't redial in lockstep.
+func (r *ReconnectingClient) SetBackoff(initial time.Duration, max time.Duration, attempts int) {
+	r.backoff = initial
+	r.max_backoff = max
+	r.attempts = attempts
+}
+
+// BufferReliable keeps up to limit reliable payloads written while reconnecting and sends them once the connection
+// is back, 0 (the default) makes Write return ErrNotConnected instead
+func (r *ReconnectingClient) BufferReliable(limit int) {
+	r.buffer_limit = limit
+}
+
+// OnState sets a function called on every state change, from the goroutine calling Connect or ReadFromUDP
+func (r *ReconnectingClient) OnState(f func(Event)) {
+	r.on_state = f
+}
+
+// OnFlush sets a function called for every buffered payload sent after reconnecting, with its sequence number
+func (r *ReconnectingClient) OnFlush(f func(payload []byte, seq uint32)) {
+	r.on_flush = f
+}
+
+// State returns the current connection state
+func (r *ReconnectingClient) State() State {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+
+// Connect dials the server, retrying with backoff like a reconnect
+func (r *ReconnectingClient) Connect() error {
+	r.setState(Event{State: StateConnecting})
+	err := r.RUDPClient.Connect()
+	if err == nil {
+		r.connected(Event{State: StateConnected})
+		return nil
+	}
+	return r.reconnect(err)
+}
+
+// Write sends the payload like RUDPClient.Write.  While reconnecting reliable payloads are buffered (ErrBuffered,
+// see BufferReliable) and anything else is refused with ErrNotConnected.
+func (r *ReconnectingClient) Write(payload *[]byte, reliable bool) (int, uint32, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state != StateConnected {
+		if !reliable || r.state == StateFailed || len(r.buffer) >= r.buffer_limit {
+			return 0, 0, ErrNotConnected
+		}
+		r.buffer = append(r.buffer, append([]byte(nil), *payload...))
+		return len(*payload), 0, ErrBuffered
+	}
+	r.last_sent = r.now()
+	return r.RUDPClient.Write(payload, reliable)
+}
+
+// ReadFromUDP reads the next packet like RUDPClient.ReadFromUDP, keeping the connection alive and reconnecting
+// when it is lost.  It returns an error wrapping ErrReconnectFailed when it gives up.
+func (r *ReconnectingClient) ReadFromUDP(buffer []byte) (n int, verified []uint32, addr *net.UDPAddr, err error) {
+	for {
+		if r.State() == StateFailed {
+			return 0, []uint32{}, nil, ErrReconnectFailed
+		}
+		r.conn.SetReadDeadline(r.now().Add(r.keepalive))
+		n, verified, addr, err = r.RUDPClient.ReadFromUDP(buffer)
+		if err == nil {
+			return n, verified, addr, nil
+		}
+		r.mu.Lock()
+		closed := r.closed
+		r.mu.Unlock()
+		var netErr net.Error
+		if closed || !errors.As(err, &netErr) {
+			return n, verified, addr, err
+		}
+		now := r.now()
+		if netErr.Timeout() && now.Sub(r.LastReceived()) < r.timeout {
+			r.mu.Lock()
+			if now.Sub(r.last_sent) >= r.keepalive {
+				r.last_sent = now
+				r.Keepalive()
+			}
+			r.mu.Unlock()
+			continue
+		}
+		// the server stopped answering or is unreachable
+		if err := r.reconnect(err); err != nil {
+			return 0, []uint32{}, nil, err
+		}
+	}
+}
+
+// Close closes the connection, the client doesn't reconnect afterwards
+func (r *ReconnectingClient) Close() {
+	r.mu.Lock()
+	r.closed = true
+	r.buffer = nil
+	r.mu.Unlock()
+	r.RUDPClient.Close()
+}
+
+// reconnect redials the server after the connection was lost because of cause
+func (r *ReconnectingClient) reconnect(cause error) error {
+	backoff := r.backoff
+	for attempt := 1; r.attempts == 0 || attempt <= r.attempts; attempt++ {
+		r.setState(Event{State: StateReconnecting, Attempt: attempt, Err: cause})
+		// wait between half and all of the backoff
+		clock.Or(r.clock).Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+		if backoff *= 2; backoff > r.max_backoff {
+			backoff = r.max_backoff
+		}
+		resumed, err := r.redial()
+		if err == nil {
+			r.connected(Event{State: StateConnected, Attempt: attempt, Resumed: resumed})
+			return nil
+		}
+		cause = err
+		r.mu.Lock()
+		closed := r.closed
+		r.mu.Unlock()
+		if closed {
+			return err
+		}
+	}
+	r.mu.Lock()
+	r.buffer = nil
+	r.mu.Unlock()
+	r.setState(Event{State: StateFailed, Attempt: r.attempts, Err: cause})
+	return errors.Join(ErrReconnectFailed, cause)
+}
+
+// redial moves the client to a new socket from its dialer, in case the old network is gone, and resumes the
+// connection if it can, otherwise it connects anew
+func (r *ReconnectingClient) redial() (bool, error) {
+	err := r.newSocket()
+	if err != nil {
+		return false, err
+	}
+	if r.ticket != nil {
+		if err = r.Resume(); !errors.Is(err, ErrResumeFailed) {
+			return err == nil, err
+		}
+	}
+	return false, r.RUDPClient.Connect()
+}
+
+// connected sends the payloads buffered while reconnecting and reports event
+func (r *ReconnectingClient) connected(event Event) {
+	r.mu.Lock()
+	buffer := r.buffer
+	r.buffer = nil
+	r.state = StateConnected
+	r.last_sent = r.now()
+	seqs := make([]uint32, len(buffer))
+	for i := range buffer {
+		_, seqs[i], _ = r.RUDPClient.Write(&buffer[i], true)
+	}
+	r.mu.Unlock()
+	if r.on_state != nil {
+		r.on_state(event)
+	}
+	if r.on_flush != nil {
+		for i, payload := range buffer {
+			r.on_flush(payload, seqs[i])
+		}
+	}
+}
+
+// setState changes the state and reports event
+func (r *ReconnectingClient) setState(event Event) {
+	r.mu.Lock()
+	r.state = event.State
+	r.mu.Unlock()
+	if r.on_state != nil {
+		r.on_state(event)
+	}
+}
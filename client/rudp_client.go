@@ -1,107 +1,854 @@
 package client
 
 import (
+	"bytes"
+	"crypto/ecdh"
 	"encoding/binary"
 	"errors"
 	"log"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/jomstead/go-rudp/clock"
+	"github.com/jomstead/go-rudp/compress"
 	"github.com/jomstead/go-rudp/packet"
+	"github.com/jomstead/go-rudp/secure"
+	"github.com/jomstead/go-rudp/stats"
+	"github.com/jomstead/go-rudp/transport"
 )
 
-type RUDPClient struct {
-	conn        *net.UDPConn
-	address     *net.UDPAddr //host:port
-	seq         uint32
-	isConnected bool
-	remote_seq  uint32
-	remote_acks packet.Ack
-	temp        []byte   // temp is used to read in a packet from the remote source and processed for reliable UDP, it is then copied to a new buffer without the RUDP bytes for processing outside the api
-	unverified  []uint32 // keeps a list of unverified sequence numbers
+const (
+	ConnectAttempts     = 5                      // default number of connect requests sent before giving up, see SetConnectRetry
+	ConnectTimeout      = 200 * time.Millisecond // default time to wait for the server to accept each connect request
+	ReconnectBackoff    = 100 * time.Millisecond // wait after the first failed resume in Reconnect, doubled after each failure
+	ReconnectMaxBackoff = 2 * time.Second        // longest wait between resumes in Reconnect
+	ReconnectTimeout    = 10 * time.Second       // how long Reconnect keeps trying, keep it below the server's grace period
+	ReceiveBufferSize   = 1024                   // default size of the receive buffer, larger packets are cut off
+	UnverifiedCapacity  = 16                     // default initial capacity of the list of unverified reliable packets
+)
+
+var (
+	ErrConnectTimeout         = errors.New("server did not accept the connection")
+	ErrEncryptionRequired     = errors.New("server only accepts encrypted connections")
+	ErrEncryptionNotSupported = errors.New("server does not support encryption")
+	ErrRejected               = errors.New("server rejected the connection")
+	ErrServerFull             = errors.New("server is full")
+	ErrNoTicket               = errors.New("no resume ticket, the server has no grace period, isn't encrypted or the client never connected")
+	ErrResumeFailed           = errors.New("server no longer has the connection, connect again")
+)
 
+// ServerFullError is returned when the server has no free connections.  If the server queues clients Position
+// is the client's place in the queue, keep calling Connect (at least every few seconds) to keep it.
+type ServerFullError struct {
+	Position int // place in the queue, 0 if the server doesn't queue clients
+}
+
+func (e *ServerFullError) Error() string {
+	if e.Position == 0 {
+		return ErrServerFull.Error()
+	}
+	return ErrServerFull.Error() + ", queue position " + strconv.Itoa(e.Position)
 }
 
+func (e *ServerFullError) Is(target error) bool {
+	return target == ErrServerFull
+}
+
+type RUDPClient struct {
+	mu               sync.Mutex // serializes Write, Keepalive, Close and the packets read by ReadFromUDP
+	conn             net.PacketConn
+	udp              *net.UDPConn                   // conn if it is a UDP socket connected to the server, read and written directly
+	dial             func() (net.PacketConn, error) // opens a new socket to the server for Reconnect, nil keeps conn
+	address          *net.UDPAddr                   //host:port
+	seq              uint32
+	isConnected      atomic.Bool // the client is open, read from any goroutine
+	remote_seq       uint32
+	remote_acks      packet.Ack
+	temp             []byte           // temp is used to read in a packet from the remote source and processed for reliable UDP, it is then copied to a new buffer without the RUDP bytes for processing outside the api
+	unverified       []uint32         // keeps a list of unverified sequence numbers
+	newest_ack       uint32           // newest sequence number the server acknowledged, ^uint32(0) before the first ack
+	codecs           []compress.Codec // codecs offered to the server during Connect, in order of preference
+	codec            compress.Codec   // codec agreed with the server, nil for no compression
+	scratch          []byte           // buffer for compressing and decompressing payloads
+	raw_bytes        uint64           // payload bytes passed to Write
+	sent_bytes       uint64           // payload bytes sent after compression
+	encrypted        bool             // perform a key exchange in Connect
+	pinned           *ecdh.PublicKey  // the server static key expected during the key exchange, nil accepts any key
+	server_key       *ecdh.PublicKey  // the server static key presented during the key exchange
+	session          *secure.Session  // keys for encrypting packets, nil until an encrypted Connect succeeds
+	plain            []byte           // buffer for decrypting payloads
+	token            []byte           // connect token from the matchmaker presented in Connect
+	malformed        uint64           // malformed packets received
+	checksums        bool             // ask the server for checksummed packets in Connect
+	checksum         bool             // packets carry a checksum, agreed with the server in Connect
+	corrupted        uint64           // packets dropped because their checksum didn't match
+	ack_repeats      int              // number of packets that still carry the acknowledgements, see packet.AckRepeats
+	id               uint64           // connection id assigned by the server in Connect, 0 until then
+	ticket           []byte           // resume ticket from the server, nil if the server has no grace period or isn't encrypted
+	last             time.Time        // when the last authentic packet was received from the server
+	rtt              time.Duration    // time from the last connect request to the accept
+	connect_attempts int              // connect requests sent before Connect gives up
+	connect_timeout  time.Duration    // time to wait for the server to accept each connect request
+	logger           *log.Logger      // logs connection events, nil logs nothing
+	report_malformed bool             // return malformed packets from ReadFromUDP as errors instead of dropping them
+	clock            clock.Clock      // time source, clock.Real if nil
+	stats            *stats.Recorder  // statistics of the connection, see Stats
+}
+
+// Close tells the server the client is going away and closes the connection
 func (conn *RUDPClient) Close() {
+	if conn.conn != nil {
+		if conn.isConnected.Swap(false) {
+			conn.mu.Lock()
+			conn.send(conn.control(packet.TypeDisconnect))
+			conn.mu.Unlock()
+		}
+		conn.conn.Close()
+	}
+	conn.isConnected.Store(false)
+}
+
+// IsConnected reports whether the client is open, it can be called from any goroutine
+func (conn *RUDPClient) IsConnected() bool {
+	return conn.isConnected.Load()
+}
+
+// Initialize sets the client up to talk to the server at a over c, a UDP socket or any net.PacketConn with IP:port
+// addresses (see package transport).  Packets from other addresses are ignored unless c is a connected UDP socket,
+// which only receives from the server anyway.
+func (conn *RUDPClient) Initialize(c net.PacketConn, a *net.UDPAddr) {
+	conn.isConnected.Store(true)                            // is the client 'connected'
+	conn.address = a                                        // address of the remote server
+	conn.setConn(c)                                         // connection to the remote server
+	conn.dial = udpDialer(c, a)                             // new sockets for Reconnect
+	conn.seq = ^uint32(0)                                   //seq number
+	conn.remote_seq = ^uint32(0)                            // remote seq number
+	conn.newest_ack = ^uint32(0)                            // no ack from the server yet
+	conn.unverified = make([]uint32, 0, UnverifiedCapacity) // queue of outbound reliable packets
+	conn.temp = make([]byte, ReceiveBufferSize)             // buffer used for receiving packets
+	conn.remote_acks = packet.Ack{Data: 0}
+	conn.connect_attempts = ConnectAttempts
+	conn.connect_timeout = ConnectTimeout
+	conn.stats = &stats.Recorder{}
+}
+
+// SetBufferSizes sets the size of the receive buffer, the largest packet the client can receive including its
+// header, and the initial capacity of the list of unverified reliable packets
+func (conn *RUDPClient) SetBufferSizes(receive int, unverified int) {
+	conn.temp = make([]byte, receive)
+	conn.unverified = append(make([]uint32, 0, unverified), conn.unverified...)
+}
+
+// SetConnectRetry sets how many connect requests Connect sends and how long it waits for an answer to each
+func (conn *RUDPClient) SetConnectRetry(attempts int, timeout time.Duration) {
+	conn.connect_attempts = attempts
+	conn.connect_timeout = timeout
+}
+
+// SetLogger logs connection events (connects, rejects, resumes, path challenges) to l, nil logs nothing
+func (conn *RUDPClient) SetLogger(l *log.Logger) {
+	conn.logger = l
+}
+
+// logf logs a connection event if a logger is set
+func (conn *RUDPClient) logf(format string, v ...any) {
+	if conn.logger != nil {
+		conn.logger.Printf(format, v...)
+	}
+}
+
+// SetCodecs sets the compression codecs offered to the server when connecting, in order of preference
+func (conn *RUDPClient) SetCodecs(codecs ...compress.Codec) {
+	conn.codecs = codecs
+}
+
+// EnableEncryption makes Connect perform a key exchange with the server, all packets are encrypted and
+// authenticated afterwards.  pinned is the server's static public key and Connect fails if the server presents
+// any other key.  A nil pinned key accepts whatever key the server presents, check ServerKey after connecting.
+func (conn *RUDPClient) EnableEncryption(pinned *ecdh.PublicKey) {
+	conn.encrypted = true
+	conn.pinned = pinned
+}
+
+// Migrate moves the connection to a new socket, e.g. after switching networks, and closes the old one.  The server
+// follows the client to its new address once the client answers the server's path challenge, which ReadFromUDP
+// does, so keep reading.  Only clients that Connect with encryption have a connection id the server follows, an
+// unencrypted client has to Connect again from its new socket.
+func (conn *RUDPClient) Migrate(c net.PacketConn) {
 	if conn.conn != nil {
 		conn.conn.Close()
 	}
-	conn.isConnected = false
+	conn.setConn(c)
+}
+
+// SetDialer sets the function Reconnect and ReconnectingClient call for a new socket to the server, in case the
+// old network is gone.  Clients initialized on a connected UDP socket dial a new one like it by default, clients on
+// other sockets and transports keep their socket unless a dialer is set.  nil keeps the socket.
+func (conn *RUDPClient) SetDialer(dial func() (net.PacketConn, error)) {
+	conn.dial = dial
+}
+
+// udpDialer returns a dialer for UDP sockets connected to a if c is one, nil otherwise
+func udpDialer(c net.PacketConn, a *net.UDPAddr) func() (net.PacketConn, error) {
+	if udp, ok := c.(*net.UDPConn); !ok || udp.RemoteAddr() == nil {
+		return nil
+	}
+	return func() (net.PacketConn, error) {
+		return net.DialUDP("udp", nil, a)
+	}
+}
+
+// newSocket moves the client to a socket from its dialer, it keeps its socket without a dialer
+func (conn *RUDPClient) newSocket() error {
+	if conn.dial == nil {
+		return nil
+	}
+	c, err := conn.dial()
+	if err != nil {
+		return err
+	}
+	conn.Migrate(c)
+	return nil
+}
+
+// setConn switches to c, connected UDP sockets are used directly
+func (conn *RUDPClient) setConn(c net.PacketConn) {
+	conn.conn = c
+	conn.udp = nil
+	if udp, ok := c.(*net.UDPConn); ok && udp.RemoteAddr() != nil {
+		conn.udp = udp
+	}
+}
+
+// send sends a control packet to the server
+func (conn *RUDPClient) send(data []byte) (int, error) {
+	n, err := conn.write(data)
+	if err == nil {
+		conn.stats.Sent(len(data), false, 0, conn.now())
+	}
+	return n, err
+}
+
+// write sends data to the server
+func (conn *RUDPClient) write(data []byte) (int, error) {
+	if conn.udp != nil {
+		return conn.udp.Write(data)
+	}
+	return conn.conn.WriteTo(data, conn.address)
+}
+
+// receive reads the next packet from the server into b, packets from other addresses are ignored
+func (conn *RUDPClient) receive(b []byte) (int, *net.UDPAddr, error) {
+	if conn.udp != nil {
+		return conn.udp.ReadFromUDP(b)
+	}
+	server := conn.address.AddrPort()
+	for {
+		n, from, err := conn.conn.ReadFrom(b)
+		if err != nil {
+			return n, nil, err
+		}
+		addr, ok := transport.AddrPort(from)
+		if ok && addr.Addr().Unmap() == server.Addr().Unmap() && addr.Port() == server.Port() {
+			return n, net.UDPAddrFromAddrPort(addr), nil
+		}
+	}
+}
+
+// EnableChecksums makes Connect ask the server to add a CRC32C to every packet so corrupted packets are dropped.
+// Encrypted connections don't need it, the server only agrees to checksums on unencrypted connections.
+func (conn *RUDPClient) EnableChecksums() {
+	conn.checksums = true
+}
+
+// CorruptedPackets returns the number of packets dropped because their checksum didn't match
+func (conn *RUDPClient) CorruptedPackets() uint64 {
+	return conn.corrupted
+}
+
+// HandshakeRTT returns the time the server took to accept the last connect request in Connect or Resume
+func (conn *RUDPClient) HandshakeRTT() time.Duration {
+	return conn.rtt
+}
+
+// ServerKey returns the static public key the server presented during an encrypted Connect
+func (conn *RUDPClient) ServerKey() *ecdh.PublicKey {
+	return conn.server_key
+}
+
+// SetConnectToken sets the connect token from the matchmaker, it is presented to the server during Connect
+func (conn *RUDPClient) SetConnectToken(token []byte) {
+	conn.token = token
+}
+
+// ReplayedPackets returns the number of packets rejected because their packet number had already been received
+func (conn *RUDPClient) ReplayedPackets() uint64 {
+	if conn.session == nil {
+		return 0
+	}
+	return conn.session.Replayed()
+}
+
+// Connect performs the connection setup with the server, agreeing on a compression codec and exchanging keys
+// if encryption is enabled.  Connecting is optional for unencrypted connections, packets can be sent and received
+// without it but will not be compressed.
+func (conn *RUDPClient) Connect() error {
+	return conn.connect(false)
+}
+
+// Resume takes the connection back with the ticket from the last Connect or Resume, keeping sequence numbers,
+// acknowledgements and unverified reliable packets on both sides.  It returns ErrResumeFailed if the server no
+// longer has the connection.
+func (conn *RUDPClient) Resume() error {
+	if conn.ticket == nil {
+		return ErrNoTicket
+	}
+	return conn.connect(true)
+}
+
+// Reconnect resumes the connection after it was lost, from a new socket in case the old network is gone (see
+// SetDialer).  Failed
+// attempts are retried with exponential backoff for up to ReconnectTimeout.  It returns nil once the connection is
+// resumed, ErrResumeFailed if the server no longer has it (Connect again to start over), or the last error when it
+// gives up.
+func (conn *RUDPClient) Reconnect() error {
+	if conn.ticket == nil {
+		return ErrNoTicket
+	}
+	backoff := ReconnectBackoff
+	deadline := conn.now().Add(ReconnectTimeout)
+	for {
+		err := conn.newSocket()
+		if err == nil {
+			err = conn.Resume()
+		}
+		var netErr *net.OpError
+		if err == nil || !(errors.Is(err, ErrConnectTimeout) || errors.As(err, &netErr)) {
+			return err
+		}
+		if conn.now().Add(backoff).After(deadline) {
+			return err
+		}
+		clock.Or(conn.clock).Sleep(backoff)
+		if backoff *= 2; backoff > ReconnectMaxBackoff {
+			backoff = ReconnectMaxBackoff
+		}
+	}
+}
+
+// SetClock sets the time source for connect timeouts, Reconnect and LastReceived, nil is the system clock.  Read
+// deadlines are set on the connection in the clock's time, so a fake clock needs a transport that follows it (see
+// transport.Hub.SetClock).
+func (conn *RUDPClient) SetClock(c clock.Clock) {
+	conn.clock = c
+}
+
+// now returns the time of the client's clock
+func (conn *RUDPClient) now() time.Time {
+	return clock.Or(conn.clock).Now()
+}
+
+// LastReceived returns when the last authentic packet was received from the server, including answers to Keepalive
+func (conn *RUDPClient) LastReceived() time.Time {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.last
+}
+
+// Keepalive sends a packet without a payload.  Send one when nothing else has been sent for a while so the server
+// (see server.SetTimeout) and any NAT in between keep the connection open.  The server answers it, so a client
+// that hears nothing back (see LastReceived) has lost the connection.
+func (conn *RUDPClient) Keepalive() error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	_, err := conn.send(conn.control(packet.TypeKeepalive))
+	return err
+}
+
+// connect performs the connection setup, resuming the last connection if resume is true
+func (conn *RUDPClient) connect(resume bool) error {
+	connect := packet.Connect{Token: conn.token}
+	if conn.checksums {
+		connect.Options |= packet.OptionChecksum
+	}
+	for _, c := range conn.codecs {
+		connect.Codecs = append(connect.Codecs, c.ID())
+	}
+	var ephemeral *ecdh.PrivateKey
+	if conn.encrypted {
+		var err error
+		if ephemeral, err = secure.GenerateKey(); err != nil {
+			return err
+		}
+		connect.Key = ephemeral.PublicKey().Bytes()
+	}
+	if !resume {
+		// a new connection starts over
+		conn.mu.Lock()
+		conn.reset()
+		conn.mu.Unlock()
+	}
+	if resume {
+		connect.Resume = binary.BigEndian.AppendUint64(nil, conn.id)
+		connect.Resume = append(connect.Resume, secure.ResumeProof(conn.ticket, connect.Key)...)
+	}
+	request := connect.Marshal()
+	defer conn.conn.SetReadDeadline(time.Time{})
+	// remember why an accept was refused so a spoofed accept can't end the connect early
+	refused := ErrConnectTimeout
+	var sent time.Time
+	for attempt := 0; attempt < conn.connect_attempts; attempt++ {
+		if attempt > 0 {
+			conn.stats.Resent()
+		}
+		if _, err := conn.send(request); err != nil {
+			return err
+		}
+		sent = conn.now()
+		conn.conn.SetReadDeadline(conn.now().Add(conn.connect_timeout))
+		for {
+			n, _, err := conn.receive(conn.temp)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					// resend the connect request
+					break
+				}
+				return err
+			}
+			conn.stats.Received(n, false, conn.now())
+			header, err := packet.ParseHeader(conn.temp[:n])
+			if errors.Is(err, packet.ErrBadVersion) {
+				// the server speaks another version of the protocol
+				return err
+			}
+			if err != nil || !header.Control() {
+				// ignore anything else until the server answers
+				continue
+			}
+			body := conn.temp[header.Size:n]
+			switch header.Type {
+			case packet.TypeReject:
+				err := rejection(body)
+				conn.logf("rudp: %v rejected the connection: %v", conn.address, err)
+				return err
+			case packet.TypeChallenge:
+				// prove we can receive at our address by echoing the cookie
+				connect.Cookie = append([]byte{}, body...)
+				request = connect.Marshal()
+				if _, err := conn.send(request); err != nil {
+					return err
+				}
+				sent = conn.now()
+				conn.conn.SetReadDeadline(conn.now().Add(conn.connect_timeout))
+			case packet.TypeAccept:
+				conn.mu.Lock()
+				err := conn.accept(conn.temp[:n], ephemeral)
+				conn.mu.Unlock()
+				if err != nil {
+					refused = err
+					continue
+				}
+				conn.rtt = conn.now().Sub(sent)
+				conn.stats.AddRTT(conn.rtt)
+				conn.logf("rudp: connected to %v as %x (resumed %v, rtt %v)", conn.address, conn.id, resume, conn.rtt)
+				return nil
+			}
+		}
+	}
+	conn.logf("rudp: %v did not accept the connection: %v", conn.address, refused)
+	return refused
 }
 
-func (conn RUDPClient) IsConnected() bool {
-	return conn.isConnected
+// rejection returns the error for the body of a reject packet [reason][queue position]
+func rejection(data []byte) error {
+	if len(data) < 1 {
+		return ErrRejected
+	}
+	switch data[0] {
+	case packet.RejectEncryptionRequired:
+		return ErrEncryptionRequired
+	case packet.RejectServerFull:
+		e := &ServerFullError{}
+		if len(data) >= 3 {
+			e.Position = int(binary.BigEndian.Uint16(data[1:3]))
+		}
+		return e
+	case packet.RejectBadVersion:
+		return packet.ErrBadVersion
+	case packet.RejectResume:
+		return ErrResumeFailed
+	}
+	return ErrRejected
 }
-func (conn *RUDPClient) Initialize(c *net.UDPConn, a *net.UDPAddr) {
-	conn.isConnected = true                 // is the client 'connected'
-	conn.address = a                        // address of the remote server
-	conn.conn = c                           // connection to the remote server
-	conn.seq = ^uint32(0)                   //seq number
-	conn.remote_seq = ^uint32(0)            // remote seq number
-	conn.unverified = make([]uint32, 0, 16) // queue of outbound reliable packets
-	conn.temp = make([]byte, 1024)          // buffer used for receiving packets
+
+// reset forgets the last connection, sequence numbers and acknowledgements start over
+func (conn *RUDPClient) reset() {
+	conn.seq = ^uint32(0)
+	conn.remote_seq = ^uint32(0)
 	conn.remote_acks = packet.Ack{Data: 0}
+	conn.unverified = conn.unverified[:0]
+	conn.newest_ack = ^uint32(0)
+	conn.ack_repeats = 0
+	conn.session = nil
+	conn.server_key = nil
+	conn.codec = nil
+	conn.checksum = false
+	conn.id = 0
+	conn.ticket = nil
+	conn.stats.Reset()
+}
+
+// accept completes the connection setup from the server's accept packet
+func (conn *RUDPClient) accept(data []byte, ephemeral *ecdh.PrivateKey) error {
+	start := packet.ControlHeaderSize + 2 + packet.ConnectionIDSize
+	if len(data) < start {
+		return ErrRejected
+	}
+	codec := compress.Find(conn.codecs, data[packet.ControlHeaderSize])
+	options := data[packet.ControlHeaderSize+1]
+	id := binary.BigEndian.Uint64(data[packet.ControlHeaderSize+2:])
+	ticket := data[start:]
+	if ephemeral != nil {
+		// [header][codec][options][connection id][server static key][server ephemeral key][sealed confirmation]
+		keys := start + 2*secure.KeySize
+		if len(data) < keys+secure.Overhead {
+			return ErrEncryptionNotSupported
+		}
+		static := data[start : start+secure.KeySize]
+		if conn.pinned != nil && !bytes.Equal(conn.pinned.Bytes(), static) {
+			return secure.ErrServerKeyMismatch
+		}
+		session, err := secure.ClientHandshake(ephemeral, static, data[start+secure.KeySize:keys])
+		if err != nil {
+			return err
+		}
+		// the server proves it holds the static key by sealing the accept with the derived keys, the plaintext is
+		// the resume ticket
+		if ticket, err = session.Open(nil, data[:keys], data[keys:]); err != nil {
+			return err
+		}
+		conn.server_key, _ = secure.ParsePublicKey(static)
+		conn.session = session
+	}
+	conn.codec = codec
+	conn.checksum = conn.checksums && options&packet.OptionChecksum != 0
+	conn.id = id
+	conn.last = conn.now()
+	conn.ticket = nil
+	if len(ticket) == secure.TicketSize {
+		conn.ticket = append([]byte(nil), ticket...)
+	}
+	if conn.remote_seq != ^uint32(0) {
+		// resumed, the server may have missed our last acknowledgements while we were gone
+		conn.ack_repeats = packet.AckRepeats
+	}
+	return nil
+}
+
+// CompressionRatio returns the size of the payloads sent after compression compared to before, 1 when nothing has been compressed
+func (conn *RUDPClient) CompressionRatio() float64 {
+	if conn.raw_bytes == 0 {
+		return 1
+	}
+	return float64(conn.sent_bytes) / float64(conn.raw_bytes)
 }
 
-/* Write sends a packet to the dialed connection */
+/* Write sends a packet to the dialed connection, it may be called while another goroutine is in ReadFromUDP */
 func (conn *RUDPClient) Write(payload *[]byte, reliable bool) (int, uint32, error) {
-	// Create the packet [Reliable][Seq][Remote_seq][remote_acks][Payload]
-	var data []byte
+	// Create the packet [header][Payload], the header includes the last received sequence number and the
+	// sequence history from the remote source until it has been repeated enough times
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
 	var seq uint32
-	index := 0
+	body, compressed := conn.compress(*payload)
+	header := packet.Header{Type: packet.TypeData}
+	if conn.ack_repeats > 0 {
+		header.Flags = packet.FlagAck
+		header.Ack, header.AckBits = conn.remote_seq, conn.remote_acks.Data
+		conn.ack_repeats--
+	}
 	if reliable {
-		data = make([]byte, 13, len(*payload)+13)
-		data[0] = 1
+		header.Flags |= packet.FlagReliable
 		// increase sequence number for reliable packets
 		conn.seq += 1
 		seq = conn.seq
-		binary.BigEndian.PutUint32(data[1:], conn.seq)
-		index = 5
-	} else {
-		data = make([]byte, 9, len(*payload)+9)
-		index = 1
-	}
-	// include the last received sequence number and the sequence history from the remote source
-	binary.BigEndian.PutUint32(data[index:], conn.remote_seq)
-	binary.BigEndian.PutUint32(data[index+4:], conn.remote_acks.Data)
-	index += 8
-	data = append(data, *payload...)
+		header.Seq = conn.seq
+	}
+	if compressed {
+		header.Flags |= packet.FlagCompressed
+	}
+	data, index := conn.packet(header, body)
 	if reliable {
 		// keep track of unverified packets
 		conn.unverified = append(conn.unverified, seq)
 	}
-	n, err := conn.conn.Write(data)
-	return n - index, seq, err
+	n, err := conn.write(data)
+	if err != nil {
+		return n - index, seq, err
+	}
+	conn.stats.Sent(len(data), reliable, seq, conn.now())
+	// report the number of payload bytes the user gave us, not the compressed or encrypted size
+	return len(*payload), seq, err
 }
 
-func (conn RUDPClient) ReadFromUDP(buffer []byte) (n int, verified []uint32, addr *net.UDPAddr, err error) {
+// Acknowledge sends the acknowledgements to the server in an ack packet without a payload, for when the server sends
+// reliable packets and the client has nothing to send back.  Data packets carry the acknowledgements in the next
+// packet.AckRepeats packets after a reliable packet arrives, an ack packet counts as one of them.  It sends nothing
+// when there is nothing left to acknowledge.  It may be called while another goroutine is in ReadFromUDP.
+func (conn *RUDPClient) Acknowledge() error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.ack_repeats == 0 {
+		return nil
+	}
+	conn.ack_repeats--
+	header := packet.Header{Type: packet.TypeAck, Flags: packet.FlagAck, Ack: conn.remote_seq, AckBits: conn.remote_acks.Data}
+	data, _ := conn.packet(header, nil)
+	if _, err := conn.write(data); err != nil {
+		return err
+	}
+	conn.stats.Sent(len(data), false, 0, conn.now())
+	return nil
+}
+
+// packet returns the packet with header and body, sealed and checksummed as agreed with the server, and the size
+// of its header
+func (conn *RUDPClient) packet(header packet.Header, body []byte) ([]byte, int) {
+	if conn.session != nil {
+		header.Flags |= packet.FlagEncrypted
+	}
+	if conn.checksum {
+		header.Flags |= packet.FlagChecksum
+	}
+	if conn.id != 0 {
+		header.Flags |= packet.FlagConnection
+		header.ConnID = conn.id
+	}
+	data := header.Append(make([]byte, 0, packet.MaxHeaderSize+len(body)+secure.Overhead+packet.ChecksumSize))
+	index := len(data)
+	if conn.session != nil {
+		data = conn.session.Seal(data, body)
+	} else {
+		data = append(data, body...)
+	}
+	if conn.checksum {
+		data = packet.AppendChecksum(data)
+	}
+	return data, index
+}
+
+// compress returns the payload compressed with the agreed codec, or the payload unchanged if compression
+// would not make it smaller
+func (conn *RUDPClient) compress(payload []byte) ([]byte, bool) {
+	conn.raw_bytes += uint64(len(payload))
+	if conn.codec != nil {
+		compressed, err := conn.codec.Compress(conn.scratch[:0], payload)
+		conn.scratch = compressed
+		if err == nil && len(compressed) < len(payload) {
+			conn.sent_bytes += uint64(len(compressed))
+			return compressed, true
+		}
+	}
+	conn.sent_bytes += uint64(len(payload))
+	return payload, false
+}
+
+// ReadFromUDP reads the payload of the next data packet into buffer.  Ack packets have no payload, they are
+// returned with n = 0 and the reliable packets they verified.  It may run in one goroutine while others call Write,
+// Keepalive and Close, but only one goroutine may read at a time.
+func (conn *RUDPClient) ReadFromUDP(buffer []byte) (n int, verified []uint32, addr *net.UDPAddr, err error) {
 	if buffer == nil {
 		return 0, []uint32{}, nil, errors.New("buffer cannot be nil")
 	}
-	n, addr, err = conn.conn.ReadFromUDP(conn.temp)
+	for {
+		n, addr, err = conn.receive(conn.temp)
+		if err != nil {
+			return n, []uint32{}, addr, err
+		}
+		// the socket read is outside the lock so Write isn't held up while nothing arrives
+		var done bool
+		conn.mu.Lock()
+		n, verified, done, err = conn.process(buffer, conn.temp[:n], addr)
+		conn.mu.Unlock()
+		if done {
+			return n, verified, addr, err
+		}
+	}
+}
+
+// process handles the packet in data from addr for ReadFromUDP, it reports done = false for packets that don't
+// return anything to the caller
+func (conn *RUDPClient) process(buffer []byte, data []byte, addr *net.UDPAddr) (n int, verified []uint32, done bool, err error) {
+	header, err := packet.ParseHeader(data)
+	conn.stats.Received(len(data), err == nil && header.Reliable(), conn.now())
+	if err == nil && header.Compressed() && conn.codec == nil {
+		err = packet.ErrBadFlag
+	}
+	if err == nil && !header.Control() && header.Checksummed() != conn.checksum {
+		err = packet.ErrBadFlag
+	}
 	if err != nil {
-		return n, []uint32{}, addr, err
-	}
-	if n > 5 && conn.temp[0] == 0 {
-		// unreliable packet
-		ack := binary.BigEndian.Uint32(conn.temp[1:5])
-		ack_bitfield := binary.BigEndian.Uint32(conn.temp[5:9])
-		verified = conn.processAck(ack, ack_bitfield)
-		copy(buffer, conn.temp[9:n])
-		return n - 9, verified, addr, err
-	}
-	if n > 8 && conn.temp[0] == 1 {
-		// reliable packet
-		seq := binary.BigEndian.Uint32(conn.temp[1:5])
-		conn.remote_seq = packet.UpdateAcknowledgements(seq, conn.remote_seq, &conn.remote_acks)
-		ack := binary.BigEndian.Uint32(conn.temp[5:9])
-		ack_bitfield := binary.BigEndian.Uint32(conn.temp[9:13])
-		verified = conn.processAck(ack, ack_bitfield)
-		x := copy(buffer, conn.temp[13:n])
-		log.Printf("Copied %d bytes", x)
-		return n - 13, verified, addr, err
-	}
-	// Not sure what this packet is....
-	return 0, []uint32{}, addr, errors.New("unexpected RUDP header data")
+		if conn.malformedPacket() {
+			return 0, nil, false, nil
+		}
+		return 0, []uint32{}, true, err
+	}
+	if header.Type == packet.TypeReject {
+		// the server didn't accept our packets, e.g. it is full
+		return 0, []uint32{}, true, rejection(data[header.Size:])
+	}
+	if header.Type == packet.TypePathChallenge {
+		// the server saw us at a new address, prove we receive there
+		conn.logf("rudp: answering a path challenge from %v", addr)
+		conn.send(conn.control(packet.TypePathResponse, data[header.Size:]...))
+		return 0, nil, false, nil
+	}
+	if header.Type == packet.TypeKeepalive {
+		// the server answered our keepalive
+		if _, err := conn.open(data, header); err == nil {
+			conn.last = conn.now()
+		}
+		return 0, nil, false, nil
+	}
+	if header.Control() {
+		// other control packets are handled by Connect, these are late duplicates
+		return 0, nil, false, nil
+	}
+	if header.Checksummed() {
+		// drop corrupted packets before they can touch the ack state
+		if data, err = packet.VerifyChecksum(data); err != nil {
+			conn.corrupted++
+			conn.stats.Malformed()
+			if !conn.report_malformed {
+				return 0, nil, false, nil
+			}
+			return 0, []uint32{}, true, err
+		}
+	}
+	payload, err := conn.open(data, header)
+	if err != nil {
+		return 0, []uint32{}, true, err
+	}
+	conn.last = conn.now()
+	if header.Type == packet.TypeAck {
+		// acks have no payload, only report the packets they verified
+		return 0, conn.acknowledge(header.Ack, header.AckBits), true, nil
+	}
+	if header.Reliable() && packet.IsDuplicate(header.Seq, conn.remote_seq, conn.remote_acks) {
+		// received before, it is still delivered
+		conn.stats.Duplicate()
+	}
+	n, err = conn.decompress(buffer, header, payload)
+	if err != nil {
+		if conn.malformedPacket() {
+			return 0, nil, false, nil
+		}
+		return 0, []uint32{}, true, err
+	}
+	// only acknowledge reliable packets once the payload has been delivered
+	if header.Reliable() {
+		conn.remote_seq = packet.UpdateAcknowledgements(header.Seq, conn.remote_seq, &conn.remote_acks)
+		// repeat the acknowledgement in the next packets, a duplicate means the remote missed it
+		conn.ack_repeats = packet.AckRepeats
+	}
+	verified = []uint32{}
+	if header.HasAck() {
+		verified = conn.acknowledge(header.Ack, header.AckBits)
+	}
+	return n, verified, true, nil
+}
+
+// ReportMalformed makes ReadFromUDP return an error for malformed packets (a packet.ParseHeader error, packet.ErrBadChecksum
+// or a decompression error) instead of dropping them
+func (conn *RUDPClient) ReportMalformed(report bool) {
+	conn.report_malformed = report
+}
+
+// Malformed returns the number of malformed packets received
+func (conn *RUDPClient) Malformed() uint64 {
+	return conn.malformed
+}
+
+// malformedPacket counts a malformed packet and returns true if it should be dropped silently
+func (conn *RUDPClient) malformedPacket() bool {
+	conn.malformed++
+	conn.stats.Malformed()
+	return !conn.report_malformed
+}
+
+// control returns a packet of type t with body, sealed if the connection is encrypted
+func (conn *RUDPClient) control(t packet.Type, body ...byte) []byte {
+	header := packet.Header{Type: t}
+	if conn.id != 0 {
+		header.Flags |= packet.FlagConnection
+		header.ConnID = conn.id
+	}
+	if conn.session == nil {
+		return append(header.Append(nil), body...)
+	}
+	header.Flags |= packet.FlagEncrypted
+	return conn.session.Seal(header.Append(nil), body)
+}
+
+// open authenticates the header and decrypts the payload of the packet in data if the connection is encrypted
+func (conn *RUDPClient) open(data []byte, h packet.Header) ([]byte, error) {
+	header, payload := data[:h.Size], data[h.Size:]
+	encrypted := h.Encrypted()
+	if conn.session == nil {
+		if encrypted {
+			return nil, errors.New("received an encrypted packet without a session")
+		}
+		return payload, nil
+	}
+	if !encrypted {
+		return nil, errors.New("received an unencrypted packet on an encrypted connection")
+	}
+	plain, err := conn.session.Open(conn.plain[:0], header, payload)
+	conn.plain = plain
+	return plain, err
+}
+
+// decompress copies the payload into buffer, decompressing it if the packet was compressed
+func (conn *RUDPClient) decompress(buffer []byte, header packet.Header, payload []byte) (int, error) {
+	if header.Compressed() {
+		decompressed, err := conn.codec.Decompress(conn.scratch[:0], payload)
+		conn.scratch = decompressed
+		if err != nil {
+			return 0, err
+		}
+		payload = decompressed
+	}
+	copy(buffer, payload)
+	return len(payload), nil
+}
+
+// acknowledge processes the acknowledgements from the server and returns the reliable packets they verified.  It
+// counts the packets that fell out of the ack window as lost, they stay unverified.
+func (conn *RUDPClient) acknowledge(seq uint32, bitwise uint32) []uint32 {
+	verified := conn.processAck(seq, bitwise)
+	now := conn.now()
+	for _, v := range verified {
+		conn.stats.Acked(v, now)
+	}
+	for i := packet.LeftWindow(conn.unverified, conn.newest_ack, seq); i > 0; i-- {
+		conn.stats.Lost()
+	}
+	if conn.newest_ack == ^uint32(0) || int32(seq-conn.newest_ack) > 0 {
+		conn.newest_ack = seq
+	}
+	return verified
+}
+
+// Stats returns the statistics of the connection, they start over with each Connect
+func (conn *RUDPClient) Stats() stats.Stats {
+	if conn.stats == nil {
+		return stats.Stats{}
+	}
+	return conn.stats.Stats(conn.now())
 }
 
 // ProcessAck takes the acknowledgements from the remote resource and removes packets from the local
@@ -1,10 +1,19 @@
 package client
 
 import (
+	"bytes"
+	"compress/flate"
+	"errors"
 	"net"
 	"testing"
+	"time"
 
+	"github.com/jomstead/go-rudp/clock/clocktest"
+	"github.com/jomstead/go-rudp/compress"
+	"github.com/jomstead/go-rudp/packet"
+	"github.com/jomstead/go-rudp/secure"
 	"github.com/jomstead/go-rudp/server"
+	"github.com/jomstead/go-rudp/transport"
 )
 
 func TestRUDP_ClientReliablePacketsRemovedFromQueue(t *testing.T) {
@@ -19,16 +28,15 @@ func TestRUDP_ClientReliablePacketsRemovedFromQueue(t *testing.T) {
 }
 
 func TestRUDP_ClientReliablePacketsRetransmissionTest(t *testing.T) {
-	// setup the server
-	address := "127.0.0.1:8000"
-	s, _ := net.ResolveUDPAddr("udp4", address)
-	c, _ := net.ListenUDP("udp4", s)
+	t.Parallel()
+	// setup the server and client on an in-memory transport
+	c, cc := transport.Pipe()
+	s := c.LocalAddr().(*net.UDPAddr)
 	server := server.RUDPServer{}
 	server.Initialize(c, s)
 	defer server.Close()
 
 	// setup the client
-	cc, _ := net.DialUDP("udp4", nil, s)
 	client := RUDPClient{}
 	client.Initialize(cc, s)
 
@@ -49,16 +57,15 @@ func TestRUDP_ClientReliablePacketsRetransmissionTest(t *testing.T) {
 }
 
 func TestRUDP_ClientPacketTest(t *testing.T) {
-	// setup the server
-	address := "127.0.0.1:8000"
-	s, _ := net.ResolveUDPAddr("udp4", address)
-	server_conn, _ := net.ListenUDP("udp4", s)
+	t.Parallel()
+	// setup the server and client on an in-memory transport
+	server_conn, cc := transport.Pipe()
+	s := server_conn.LocalAddr().(*net.UDPAddr)
 	server := server.RUDPServer{}
 	server.Initialize(server_conn, s)
 	defer server.Close()
 
 	// setup the client
-	cc, _ := net.DialUDP("udp4", nil, s)
 	client := RUDPClient{}
 	client.Initialize(cc, s)
 	defer client.Close()
@@ -106,15 +113,17 @@ func TestRUDP_ClientPacketTest(t *testing.T) {
 		t.Error("ReadFromUDP reported incorrect number of bytes received from client when receiving reliable packet")
 	}
 
-	// send a packet with an invalid byte[0]
-	server_conn.WriteToUDPAddrPort([]byte{2, 0, 0, 0, 0, 0, 0, 0, 1}, *client_addr)
+	// send a packet with an invalid flag
+	client.ReportMalformed(true)
+	server_conn.WriteTo(packet.Header{Type: packet.TypeData, Flags: 1 << 7}.Append(nil), net.UDPAddrFromAddrPort(*client_addr))
 	temp = make([]byte, 1024)
 	n, _, _, err = client.ReadFromUDP(temp)
-	if err == nil {
-		t.Error("Didn't throw error for invalid packet header byte[0]")
+	client.ReportMalformed(false)
+	if !errors.Is(err, packet.ErrBadFlag) {
+		t.Error("Didn't throw error for invalid packet header flag")
 	}
 	if n != 0 {
-		t.Error("When we receive an invalid header byte[0] the packet size should be reported as 0")
+		t.Error("When we receive an invalid header flag the packet size should be reported as 0")
 	}
 
 	// Test client read with nil buffer
@@ -145,3 +154,348 @@ func TestRUDP_ClientPacketTest(t *testing.T) {
 	}
 
 }
+
+func TestRUDP_ClientCompression(t *testing.T) {
+	t.Parallel()
+	// setup the server and client on an in-memory transport
+	server_conn, cc := transport.Pipe()
+	s := server_conn.LocalAddr().(*net.UDPAddr)
+	server := server.RUDPServer{}
+	server.Initialize(server_conn, s)
+	defer server.Close()
+	server_codec, _ := compress.NewDeflate(flate.BestCompression, nil)
+	server.SetCodecs(server_codec)
+
+	// setup the client offering deflate
+	client := RUDPClient{}
+	client.Initialize(cc, s)
+	defer client.Close()
+	client_codec, _ := compress.NewDeflate(flate.BestCompression, nil)
+	client.SetCodecs(client_codec)
+
+	// the server handles the connect request inside ReadFromUDP
+	done := make(chan []byte)
+	go func() {
+		temp := make([]byte, 1024)
+		n, _, _, err := server.ReadFromUDP(temp)
+		if err != nil {
+			t.Errorf("Server failed to read: %s", err)
+		}
+		done <- temp[:n]
+	}()
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if client.codec == nil || client.codec.ID() != compress.Deflate {
+		t.Fatal("Client and server did not agree on deflate")
+	}
+
+	payload := bytes.Repeat([]byte{1, 2, 3, 4}, 50)
+	n, _, err := client.Write(&payload, true)
+	if err != nil || n != len(payload) {
+		t.Errorf("Write reported %d bytes, expected %d", n, len(payload))
+	}
+	received := <-done
+	if !bytes.Equal(received, payload) {
+		t.Error("Server did not receive the decompressed payload")
+	}
+	if client.CompressionRatio() >= 1 {
+		t.Errorf("Expected a compression ratio below 1, received %f", client.CompressionRatio())
+	}
+
+	// payloads that don't shrink are sent uncompressed
+	small := []byte{9}
+	client.Write(&small, false)
+	temp := make([]byte, 1024)
+	n, _, client_addr, err := server.ReadFromUDP(temp)
+	if err != nil || n != 1 || temp[0] != 9 {
+		t.Error("Server did not receive the uncompressed payload")
+	}
+
+	// the server compresses with the same codec
+	server.WriteToUDP(&payload, *client_addr, false)
+	n, _, _, err = client.ReadFromUDP(temp)
+	if err != nil || !bytes.Equal(temp[:n], payload) {
+		t.Error("Client did not receive the decompressed payload")
+	}
+	if server.CompressionRatio() >= 1 {
+		t.Errorf("Expected a server compression ratio below 1, received %f", server.CompressionRatio())
+	}
+}
+
+func TestRUDP_ClientReplayRejected(t *testing.T) {
+	t.Parallel()
+	// setup an encrypted server on an in-memory transport
+	server_conn, cc := transport.Pipe()
+	s := server_conn.LocalAddr().(*net.UDPAddr)
+	server := server.RUDPServer{}
+	server.Initialize(server_conn, s)
+	defer server.Close()
+	key, _ := secure.GenerateKey()
+	server.SetKey(key)
+
+	client := RUDPClient{}
+	client.Initialize(cc, s)
+	defer client.Close()
+	client.EnableEncryption(server.PublicKey())
+
+	type read struct {
+		n   int
+		err error
+	}
+	reads := make(chan read)
+	go func() {
+		temp := make([]byte, 1024)
+		for i := 0; i < 2; i++ {
+			n, _, _, err := server.ReadFromUDP(temp)
+			reads <- read{n, err}
+		}
+	}()
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+
+	// capture an unreliable packet and send it twice
+	header := packet.Header{Type: packet.TypeData, Flags: packet.FlagEncrypted}.Append(nil)
+	data := client.session.Seal(header, []byte{1, 2, 3})
+	cc.WriteTo(data, s)
+	cc.WriteTo(data, s)
+	if r := <-reads; r.err != nil || r.n != 3 {
+		t.Error("Server rejected the original packet")
+	}
+	if r := <-reads; r.err != secure.ErrReplay {
+		t.Errorf("Expected the replayed packet to be rejected, received %v", r.err)
+	}
+	addr := cc.AddrPort()
+	if server.ReplayedPackets(addr) != 1 || server.Counters().ReplayedPackets != 1 {
+		t.Error("Replayed packet was not counted")
+	}
+}
+
+func TestRUDP_ClientVersionMismatch(t *testing.T) {
+	t.Parallel()
+	// a server speaking another version of the protocol
+	server_conn, cc := transport.Pipe()
+	defer server_conn.Close()
+	s := server_conn.LocalAddr().(*net.UDPAddr)
+	go func() {
+		temp := make([]byte, 1024)
+		_, addr, err := server_conn.ReadFrom(temp)
+		if err == nil {
+			server_conn.WriteTo([]byte{0x52, 0x55, packet.Version + 1, uint8(packet.TypeReject), 0, 0}, addr)
+		}
+	}()
+
+	client := RUDPClient{}
+	client.Initialize(cc, s)
+	defer client.Close()
+	if err := client.Connect(); !errors.Is(err, packet.ErrBadVersion) {
+		t.Errorf("Expected a version error, received %v", err)
+	}
+}
+
+func TestRUDP_ClientAckRepeats(t *testing.T) {
+	t.Parallel()
+	// an endpoint plays the server so we can look at the headers
+	server_conn, cc := transport.Pipe()
+	defer server_conn.Close()
+	s := server_conn.LocalAddr().(*net.UDPAddr)
+	client := RUDPClient{}
+	client.Initialize(cc, s)
+	defer client.Close()
+
+	temp := make([]byte, 1024)
+	headers := func(count int) []packet.Header {
+		server_conn.SetReadDeadline(time.Now().Add(time.Second))
+		var received []packet.Header
+		for i := 0; i < count; i++ {
+			client.Write(&[]byte{1}, false)
+			n, _, err := server_conn.ReadFrom(temp)
+			if err != nil {
+				t.Fatalf("Failed to read the client's packet: %s", err)
+			}
+			h, _ := packet.ParseHeader(temp[:n])
+			received = append(received, h)
+		}
+		return received
+	}
+	// nothing to acknowledge yet
+	if h := headers(1)[0]; h.HasAck() || h.Size != packet.ControlHeaderSize {
+		t.Errorf("Expected a %d byte header without acknowledgements, received %+v", packet.ControlHeaderSize, h)
+	}
+
+	reliable := append(packet.Header{Type: packet.TypeData, Flags: packet.FlagReliable, Seq: 0}.Append(nil), 5)
+	for round := 0; round < 2; round++ {
+		// the second round is a duplicate, the client's acknowledgement must have been lost
+		server_conn.WriteTo(reliable, cc.LocalAddr())
+		if _, _, _, err := client.ReadFromUDP(temp); err != nil {
+			t.Fatalf("Failed to read the reliable packet: %s", err)
+		}
+		// the duplicate is still delivered, only counted
+		if d := client.Stats().Duplicates; d != uint64(round) {
+			t.Errorf("Round %d: %d duplicates counted", round, d)
+		}
+		for i, h := range headers(packet.AckRepeats + 1) {
+			if h.HasAck() != (i < packet.AckRepeats) {
+				t.Errorf("Round %d packet %d: acknowledgement present %t", round, i, h.HasAck())
+			}
+			if h.HasAck() && h.Ack != 0 {
+				t.Errorf("Round %d packet %d: acknowledged %d instead of 0", round, i, h.Ack)
+			}
+		}
+	}
+}
+
+func TestRUDP_ClientAcknowledge(t *testing.T) {
+	t.Parallel()
+	// an endpoint plays the server so we can look at the ack packets
+	server_conn, cc := transport.Pipe()
+	defer server_conn.Close()
+	s := server_conn.LocalAddr().(*net.UDPAddr)
+	client := RUDPClient{}
+	client.Initialize(cc, s)
+	defer client.Close()
+
+	temp := make([]byte, 1024)
+	for seq := uint32(0); seq < 2; seq++ {
+		server_conn.WriteTo(append(packet.Header{Type: packet.TypeData, Flags: packet.FlagReliable, Seq: seq}.Append(nil), 1), cc.LocalAddr())
+		if _, _, _, err := client.ReadFromUDP(temp); err != nil {
+			t.Fatalf("Failed to read reliable packet %d: %s", seq, err)
+		}
+	}
+	server_conn.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < packet.AckRepeats; i++ {
+		if err := client.Acknowledge(); err != nil {
+			t.Fatalf("Acknowledge failed: %s", err)
+		}
+		n, _, err := server_conn.ReadFrom(temp)
+		if err != nil {
+			t.Fatalf("Failed to read ack packet %d: %s", i, err)
+		}
+		h, err := packet.ParseHeader(temp[:n])
+		if err != nil || h.Type != packet.TypeAck || h.Ack != 1 || h.AckBits&1 == 0 {
+			t.Errorf("Ack packet %d has header %+v, error %v", i, h, err)
+		}
+	}
+	// the acknowledgements have been repeated enough
+	client.Acknowledge()
+	server_conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, _, err := server_conn.ReadFrom(temp); err == nil {
+		t.Errorf("Acknowledge sent %v with nothing left to acknowledge", temp[:n])
+	}
+}
+
+func TestRUDP_ClientConnectRetryClock(t *testing.T) {
+	t.Parallel()
+	fake := clocktest.NewFake(time.Time{})
+	hub := transport.NewHub()
+	hub.SetClock(fake)
+	server_conn, _ := hub.ListenPacket("10.0.0.1:9000")
+	defer server_conn.Close()
+	cc, _ := hub.ListenPacket("10.0.0.2:0")
+	client := RUDPClient{}
+	client.Initialize(cc, server_conn.LocalAddr().(*net.UDPAddr))
+	client.SetClock(fake)
+	client.SetConnectRetry(3, time.Second)
+	defer client.Close()
+
+	done := make(chan error)
+	go func() {
+		done <- client.Connect()
+	}()
+	// the server never answers, the client resends its request each time the clock passes the connect timeout
+	buffer := make([]byte, 1024)
+	for attempt := 1; attempt <= 3; attempt++ {
+		server_conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := server_conn.ReadFrom(buffer); err != nil {
+			t.Fatalf("connect request %d wasn't sent: %v", attempt, err)
+		}
+		fake.BlockUntil(1)
+		select {
+		case err := <-done:
+			t.Fatalf("Connect returned %v before its timeout", err)
+		default:
+		}
+		fake.Advance(time.Second)
+	}
+	if err := <-done; !errors.Is(err, ErrConnectTimeout) {
+		t.Errorf("expected ErrConnectTimeout, got %v", err)
+	}
+}
+
+func TestRUDP_ClientStats(t *testing.T) {
+	t.Parallel()
+	// an endpoint plays the server so we can acknowledge by hand
+	server_conn, cc := transport.Pipe()
+	defer server_conn.Close()
+	client := RUDPClient{}
+	client.Initialize(cc, server_conn.LocalAddr().(*net.UDPAddr))
+	defer client.Close()
+
+	for i := 0; i < 40; i++ {
+		client.Write(&[]byte{1, 2, 3}, true)
+	}
+	client.Write(&[]byte{1}, false)
+	// the server only acknowledges the last packet, the first 7 are too old to be acknowledged anymore
+	ack := packet.Header{Type: packet.TypeAck, Flags: packet.FlagAck, Ack: 39}.Append(nil)
+	server_conn.WriteTo(ack, cc.LocalAddr())
+	_, verified, _, err := client.ReadFromUDP(make([]byte, 1024))
+	if err != nil || len(verified) != 1 || verified[0] != 39 {
+		t.Fatalf("ReadFromUDP verified %v, %v", verified, err)
+	}
+	stats := client.Stats()
+	if stats.ReliableSent != 40 || stats.UnreliableSent != 1 || stats.Acked != 1 || stats.Lost != 7 {
+		t.Errorf("Stats returned %+v", stats)
+	}
+	if stats.UnreliableReceived != 1 || stats.UnreliableBytesReceived != uint64(len(ack)) {
+		t.Errorf("received %d packets of %d bytes, expected the %d byte ack", stats.UnreliableReceived, stats.UnreliableBytesReceived, len(ack))
+	}
+	if stats.LossRate <= 0 || stats.RTT <= 0 {
+		t.Errorf("loss rate %v and RTT %v", stats.LossRate, stats.RTT)
+	}
+	// the lost packets stay unverified and the same ack again doesn't count them twice
+	server_conn.WriteTo(ack, cc.LocalAddr())
+	if _, _, _, err := client.ReadFromUDP(make([]byte, 1024)); err != nil {
+		t.Fatalf("Failed to read the repeated ack: %s", err)
+	}
+	if lost := client.Stats().Lost; lost != 7 || len(client.unverified) != 39 {
+		t.Errorf("%d lost and %d unverified after the repeated ack, expected 7 and 39", lost, len(client.unverified))
+	}
+}
+
+func TestRUDP_ClientConcurrentWriteRead(t *testing.T) {
+	t.Parallel()
+	// an endpoint plays the server, sending reliable packets that acknowledge the client's
+	server_conn, cc := transport.Pipe()
+	defer server_conn.Close()
+	client := RUDPClient{}
+	client.Initialize(cc, server_conn.LocalAddr().(*net.UDPAddr))
+	defer client.Close()
+
+	const count = 100
+	read := make(chan int)
+	go func() {
+		delivered := 0
+		buffer := make([]byte, 1024)
+		for delivered < count {
+			if _, _, _, err := client.ReadFromUDP(buffer); err != nil {
+				break
+			}
+			delivered++
+		}
+		read <- delivered
+	}()
+	// Write shares the sequence numbers and acknowledgements with the reader
+	for i := 0; i < count; i++ {
+		client.Write(&[]byte{1}, true)
+		client.Keepalive()
+		data := packet.Header{Type: packet.TypeData, Flags: packet.FlagReliable | packet.FlagAck, Seq: uint32(i), Ack: uint32(i)}.Append(nil)
+		server_conn.WriteTo(append(data, 2), cc.LocalAddr())
+	}
+	if delivered := <-read; delivered != count {
+		t.Errorf("%d of %d packets delivered", delivered, count)
+	}
+	if acked := client.Stats().Acked; acked != count {
+		t.Errorf("%d packets acknowledged, expected %d", acked, count)
+	}
+}
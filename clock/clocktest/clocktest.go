@@ -0,0 +1,156 @@
+// Package clocktest has a manual clock for tests.  Time stands still until the test advances it, so resends,
+// keepalives and timeouts can be tested precisely and without sleeping.  Run clients and servers on a
+// transport.Hub using the same clock, the deadlines of real sockets follow the system clock.
+package clocktest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jomstead/go-rudp/clock"
+)
+
+// Fake is a clock.Clock that only moves when Advance or Set is called
+type Fake struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*timer      // pending timers
+	added  chan struct{} // closed and replaced when a timer is added, wakes BlockUntil
+}
+
+// NewFake returns a clock that stands at start, or at 1 January 2000 UTC if start is zero
+func NewFake(start time.Time) *Fake {
+	if start.IsZero() {
+		start = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return &Fake{now: start, added: make(chan struct{})}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// NewTimer returns a timer that fires once the clock has been advanced by d
+func (f *Fake) NewTimer(d time.Duration) clock.Timer {
+	t := &timer{fake: f, c: make(chan time.Time, 1)}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.schedule(t, d)
+	return t
+}
+
+// Sleep blocks until the clock has been advanced by d
+func (f *Fake) Sleep(d time.Duration) {
+	<-f.NewTimer(d).C()
+}
+
+// Advance moves the clock forward by d and fires the timers that expire, in order
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.set(f.now.Add(d))
+}
+
+// Set moves the clock to t and fires the timers that expire, in order.  It can't go back in time.
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if t.After(f.now) {
+		f.set(t)
+	}
+}
+
+// Timers returns the number of timers that haven't fired or been stopped, including those of sleeping goroutines
+// and of reads waiting for a deadline
+func (f *Fake) Timers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+// BlockUntil waits until at least n timers are pending, e.g. until a goroutine is blocked in Sleep or a read
+// with a deadline, so advancing the clock afterwards doesn't race with it
+func (f *Fake) BlockUntil(n int) {
+	for {
+		f.mu.Lock()
+		if len(f.timers) >= n {
+			f.mu.Unlock()
+			return
+		}
+		added := f.added
+		f.mu.Unlock()
+		<-added
+	}
+}
+
+// set moves the clock to t firing expired timers, f.mu must be held
+func (f *Fake) set(t time.Time) {
+	for len(f.timers) > 0 && !f.timers[0].at.After(t) {
+		next := f.timers[0]
+		f.timers = f.timers[1:]
+		f.now = next.at
+		next.fire()
+	}
+	f.now = t
+}
+
+// schedule adds t to fire after d, f.mu must be held
+func (f *Fake) schedule(t *timer, d time.Duration) {
+	t.at = f.now.Add(d)
+	if d <= 0 {
+		t.fire()
+		return
+	}
+	i := sort.Search(len(f.timers), func(i int) bool { return f.timers[i].at.After(t.at) })
+	f.timers = append(f.timers, nil)
+	copy(f.timers[i+1:], f.timers[i:])
+	f.timers[i] = t
+	close(f.added)
+	f.added = make(chan struct{})
+}
+
+// remove takes t off the pending timers, it returns false if t wasn't pending.  f.mu must be held.
+func (f *Fake) remove(t *timer) bool {
+	for i, pending := range f.timers {
+		if pending == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type timer struct {
+	fake *Fake
+	at   time.Time
+	c    chan time.Time
+}
+
+func (t *timer) C() <-chan time.Time {
+	return t.c
+}
+
+// fire sends the expiry time, it is dropped if the last one wasn't received like with time.Timer
+func (t *timer) fire() {
+	select {
+	case t.c <- t.at:
+	default:
+	}
+}
+
+func (t *timer) Stop() bool {
+	t.fake.mu.Lock()
+	defer t.fake.mu.Unlock()
+	return t.fake.remove(t)
+}
+
+func (t *timer) Reset(d time.Duration) bool {
+	t.fake.mu.Lock()
+	defer t.fake.mu.Unlock()
+	pending := t.fake.remove(t)
+	t.fake.schedule(t, d)
+	return pending
+}
@@ -0,0 +1,64 @@
+package clocktest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRUDP_FakeClock(t *testing.T) {
+	start := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFake(start)
+	late := clock.NewTimer(2 * time.Second)
+	early := clock.NewTimer(time.Second)
+	stopped := clock.NewTimer(time.Second)
+	if !stopped.Stop() || stopped.Stop() {
+		t.Error("Stop should report whether the timer was pending")
+	}
+	if clock.Timers() != 2 {
+		t.Errorf("%d timers pending, expected 2", clock.Timers())
+	}
+
+	clock.Advance(1500 * time.Millisecond)
+	select {
+	case at := <-early.C():
+		if !at.Equal(start.Add(time.Second)) {
+			t.Errorf("timer fired at %v, expected %v", at, start.Add(time.Second))
+		}
+	default:
+		t.Error("timer didn't fire when the clock passed it")
+	}
+	select {
+	case <-late.C():
+		t.Error("timer fired early")
+	default:
+	}
+	if now := clock.Now(); !now.Equal(start.Add(1500 * time.Millisecond)) {
+		t.Errorf("clock is at %v after advancing 1.5s from %v", now, start)
+	}
+	if late.Reset(time.Second) != true {
+		t.Error("Reset of a pending timer should return true")
+	}
+	clock.Set(start.Add(2 * time.Second)) // the reset timer is due at 2.5s
+	select {
+	case <-late.C():
+		t.Error("reset timer fired at its old time")
+	default:
+	}
+
+	// Sleep returns once another goroutine advances the clock
+	done := make(chan struct{})
+	go func() {
+		clock.Sleep(time.Minute)
+		close(done)
+	}()
+	clock.BlockUntil(2)
+	clock.Advance(time.Minute)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Sleep didn't return after the clock was advanced")
+	}
+	if clock.Timers() != 0 {
+		t.Errorf("%d timers pending after all fired", clock.Timers())
+	}
+}
@@ -0,0 +1,113 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+)
+
+/*
+*	Compress - per packet payload compression
+*	The client sends the ids of the codecs it supports in its connect request and the server picks the first
+*	one it also supports.  Packets are only sent compressed when compression makes them smaller, the
+*	compressed flag in the RUDP header tells the receiver which packets to decompress.
+ */
+
+const (
+	None    uint8 = 0 // no compression, reserved
+	Deflate uint8 = 1
+)
+
+// MaxSize is the largest payload a codec will decompress, anything larger can't have come from a UDP datagram
+const MaxSize = 65535
+
+var ErrTooLarge = errors.New("decompressed payload is larger than the maximum UDP payload")
+
+type Codec interface {
+	// ID identifies the codec during connection setup, both sides must use the same id for the same codec and dictionary
+	ID() uint8
+	// Compress appends the compressed src to dst
+	Compress(dst []byte, src []byte) ([]byte, error)
+	// Decompress appends the decompressed src to dst
+	Decompress(dst []byte, src []byte) ([]byte, error)
+}
+
+// Find returns the codec in codecs with the id, or nil
+func Find(codecs []Codec, id uint8) Codec {
+	for _, c := range codecs {
+		if c.ID() == id {
+			return c
+		}
+	}
+	return nil
+}
+
+type DeflateCodec struct {
+	id     uint8
+	dict   []byte
+	mu     sync.Mutex
+	writer *flate.Writer
+	reader io.ReadCloser
+	out    bytes.Buffer
+	in     bytes.Reader
+}
+
+// NewDeflate creates a DEFLATE codec with the compression level (see compress/flate) and an optional
+// preset dictionary shared by both sides.  Game payloads are small so a dictionary of typical payload
+// bytes makes a large difference.
+func NewDeflate(level int, dict []byte) (*DeflateCodec, error) {
+	c := &DeflateCodec{id: Deflate, dict: dict}
+	w, err := flate.NewWriterDict(&c.out, level, dict)
+	if err != nil {
+		return nil, err
+	}
+	c.writer = w
+	c.reader = flate.NewReaderDict(&c.in, dict)
+	return c, nil
+}
+
+// WithID returns the codec using a different id, for running several dictionaries side by side
+func (c *DeflateCodec) WithID(id uint8) *DeflateCodec {
+	c.id = id
+	return c
+}
+
+func (c *DeflateCodec) ID() uint8 {
+	return c.id
+}
+
+func (c *DeflateCodec) Compress(dst []byte, src []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.out.Reset()
+	c.writer.Reset(&c.out)
+	if _, err := c.writer.Write(src); err != nil {
+		return dst, err
+	}
+	if err := c.writer.Close(); err != nil {
+		return dst, err
+	}
+	return append(dst, c.out.Bytes()...), nil
+}
+
+func (c *DeflateCodec) Decompress(dst []byte, src []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.in.Reset(src)
+	if err := c.reader.(flate.Resetter).Reset(&c.in, c.dict); err != nil {
+		return dst, err
+	}
+	start := len(dst)
+	buf := bytes.NewBuffer(dst)
+	// read one byte past the limit to detect payloads that are too large
+	n, err := buf.ReadFrom(io.LimitReader(c.reader, MaxSize+1))
+	if err != nil {
+		return dst, err
+	}
+	if n > MaxSize {
+		return dst, ErrTooLarge
+	}
+	return buf.Bytes()[:start+int(n)], nil
+}
@@ -0,0 +1,71 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+)
+
+func TestRUDP_DeflateRoundTrip(t *testing.T) {
+	c, err := NewDeflate(flate.BestCompression, nil)
+	if err != nil {
+		t.Fatal("Failed to create deflate codec")
+	}
+	payload := bytes.Repeat([]byte("position:1,2,3;"), 20)
+	compressed, err := c.Compress(nil, payload)
+	if err != nil {
+		t.Error("Failed to compress")
+	}
+	if len(compressed) >= len(payload) {
+		t.Errorf("Repetitive payload did not compress: %d >= %d", len(compressed), len(payload))
+	}
+	// the codec is reused for every packet
+	for i := 0; i < 3; i++ {
+		out, err := c.Decompress([]byte{9}, compressed)
+		if err != nil {
+			t.Fatalf("Failed to decompress: %s", err)
+		}
+		if out[0] != 9 || !bytes.Equal(out[1:], payload) {
+			t.Error("Decompressed payload does not match")
+		}
+	}
+	if _, err := c.Decompress(nil, []byte{0xff, 0xff, 0xff}); err == nil {
+		t.Error("Expected an error for corrupt data")
+	}
+}
+
+func TestRUDP_DeflateDictionary(t *testing.T) {
+	dict := []byte("player_position player_velocity player_health")
+	plain, _ := NewDeflate(flate.BestCompression, nil)
+	shared, _ := NewDeflate(flate.BestCompression, dict)
+	payload := []byte("player_velocity player_health")
+
+	without, _ := plain.Compress(nil, payload)
+	with, _ := shared.Compress(nil, payload)
+	if len(with) >= len(without) {
+		t.Errorf("Dictionary did not improve compression: %d >= %d", len(with), len(without))
+	}
+	other, _ := NewDeflate(flate.BestCompression, dict)
+	out, err := other.Decompress(nil, with)
+	if err != nil || !bytes.Equal(out, payload) {
+		t.Error("Failed to decompress with the shared dictionary")
+	}
+}
+
+func TestRUDP_DeflateTooLarge(t *testing.T) {
+	c, _ := NewDeflate(flate.BestCompression, nil)
+	compressed, _ := c.Compress(nil, make([]byte, MaxSize+10))
+	if _, err := c.Decompress(nil, compressed); err != ErrTooLarge {
+		t.Error("Expected payload too large error")
+	}
+}
+
+func TestRUDP_Find(t *testing.T) {
+	a, _ := NewDeflate(flate.BestSpeed, nil)
+	b, _ := NewDeflate(flate.BestSpeed, []byte("dict"))
+	b.WithID(7)
+	codecs := []Codec{a, b}
+	if Find(codecs, 7) != b || Find(codecs, Deflate) != a || Find(codecs, 3) != nil {
+		t.Error("Find returned the wrong codec")
+	}
+}
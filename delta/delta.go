@@ -0,0 +1,275 @@
+package delta
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+*	Delta - delta compression of snapshots against baselines the remote has acknowledged
+*	Payload Structure  [Kind][Snapshot id][Baseline id][Body]
+*		Kind - 0 for a full snapshot, 1 for a delta against a baseline
+*		Snapshot id - sequential id of the snapshot (uint32)
+*		Baseline id - id of the snapshot the delta was encoded against, only present for deltas (uint32)
+*		Body - the full snapshot, or [new length][skip][literal length][literal bytes]... for deltas
+*
+*	The encoder remembers the last N snapshots it sent and which reliable packet carried each one.
+*	Passing the verified list from ReadFromUDP to Ack marks those snapshots as received by the remote,
+*	the newest of them is then used as the baseline for the next snapshot.
+ */
+
+const (
+	KindFull  uint8 = 0
+	KindDelta uint8 = 1
+)
+
+var (
+	ErrShortPayload    = errors.New("delta payload is shorter than its header")
+	ErrUnknownKind     = errors.New("unknown delta payload kind")
+	ErrMissingBaseline = errors.New("delta baseline snapshot is not in the history")
+	ErrCorrupt         = errors.New("delta body is corrupt")
+)
+
+type entry struct {
+	id    uint32
+	seq   uint32 // sequence number of the reliable packet that carried this snapshot
+	sent  bool
+	acked bool
+	data  []byte
+}
+
+type Encoder struct {
+	history  []entry // ring buffer of the last sent snapshots
+	next     int     // next position in the ring buffer
+	next_id  uint32
+	baseline *entry // newest snapshot acknowledged by the remote
+}
+
+// NewEncoder creates an encoder that remembers the last size sent snapshots
+func NewEncoder(size int) *Encoder {
+	if size < 1 {
+		size = 1
+	}
+	return &Encoder{
+		history: make([]entry, 0, size),
+	}
+}
+
+// Encode returns the payload for the next snapshot and the id assigned to it.  The snapshot is encoded
+// as a delta against the newest acknowledged snapshot, or in full if none has been acknowledged.
+func (e *Encoder) Encode(snapshot []byte) ([]byte, uint32) {
+	id := e.next_id
+	e.next_id++
+
+	var payload []byte
+	if e.baseline != nil {
+		payload = make([]byte, 9, len(snapshot)/2+16)
+		payload[0] = KindDelta
+		binary.BigEndian.PutUint32(payload[1:], id)
+		binary.BigEndian.PutUint32(payload[5:], e.baseline.id)
+		payload = appendDelta(payload, e.baseline.data, snapshot)
+	}
+	if e.baseline == nil || len(payload) >= len(snapshot)+5 {
+		// nothing to delta against, or the delta is no smaller than the full snapshot
+		payload = make([]byte, 5, len(snapshot)+5)
+		payload[0] = KindFull
+		binary.BigEndian.PutUint32(payload[1:], id)
+		payload = append(payload, snapshot...)
+	}
+
+	// remember the snapshot so it can be used as a baseline once acknowledged
+	data := make([]byte, len(snapshot))
+	copy(data, snapshot)
+	s := entry{id: id, data: data}
+	if len(e.history) < cap(e.history) {
+		e.history = append(e.history, s)
+	} else {
+		if e.baseline == &e.history[e.next] {
+			// a decoder of the same size drops the baseline now too, send full snapshots until a newer one is
+			// acknowledged
+			e.baseline = nil
+		}
+		e.history[e.next] = s
+	}
+	e.next = (e.next + 1) % cap(e.history)
+	return payload, id
+}
+
+// Sent records the sequence number of the reliable packet the snapshot id was sent in
+func (e *Encoder) Sent(id uint32, seq uint32) {
+	for i := range e.history {
+		if e.history[i].id == id {
+			e.history[i].seq = seq
+			e.history[i].sent = true
+			return
+		}
+	}
+}
+
+// Ack takes the verified sequence numbers returned by ReadFromUDP and updates the baseline
+func (e *Encoder) Ack(verified []uint32) {
+	for _, seq := range verified {
+		for i := range e.history {
+			s := &e.history[i]
+			if !s.sent || s.acked || s.seq != seq {
+				continue
+			}
+			s.acked = true
+			if e.baseline == nil || newer(s.id, e.baseline.id) {
+				e.baseline = s
+			}
+		}
+	}
+}
+
+// Baseline returns the id of the snapshot new snapshots are encoded against
+func (e *Encoder) Baseline() (id uint32, ok bool) {
+	if e.baseline == nil {
+		return 0, false
+	}
+	return e.baseline.id, true
+}
+
+type Decoder struct {
+	history []entry // ring buffer of the last received snapshots
+	next    int
+}
+
+// NewDecoder creates a decoder that remembers the last size received snapshots, size should match the encoder
+func NewDecoder(size int) *Decoder {
+	if size < 1 {
+		size = 1
+	}
+	return &Decoder{
+		history: make([]entry, 0, size),
+	}
+}
+
+// Decode rebuilds the snapshot from a payload created by Encode and returns it with its id
+func (d *Decoder) Decode(payload []byte) ([]byte, uint32, error) {
+	if len(payload) < 5 {
+		return nil, 0, ErrShortPayload
+	}
+	id := binary.BigEndian.Uint32(payload[1:5])
+	var snapshot []byte
+	switch payload[0] {
+	case KindFull:
+		snapshot = make([]byte, len(payload)-5)
+		copy(snapshot, payload[5:])
+	case KindDelta:
+		if len(payload) < 9 {
+			return nil, 0, ErrShortPayload
+		}
+		base := d.find(binary.BigEndian.Uint32(payload[5:9]))
+		if base == nil {
+			return nil, 0, ErrMissingBaseline
+		}
+		var err error
+		snapshot, err = applyDelta(base.data, payload[9:])
+		if err != nil {
+			return nil, 0, err
+		}
+	default:
+		return nil, 0, ErrUnknownKind
+	}
+
+	if d.find(id) == nil {
+		s := entry{id: id, data: snapshot}
+		if len(d.history) < cap(d.history) {
+			d.history = append(d.history, s)
+		} else {
+			d.history[d.next] = s
+		}
+		d.next = (d.next + 1) % cap(d.history)
+	}
+	return snapshot, id, nil
+}
+
+func (d *Decoder) find(id uint32) *entry {
+	for i := range d.history {
+		if d.history[i].id == id {
+			return &d.history[i]
+		}
+	}
+	return nil
+}
+
+// appendDelta appends the byte level difference between base and snapshot to payload.
+// The delta is a list of [skip][literal length][literal bytes] runs, skipped bytes are copied from the base.
+func appendDelta(payload []byte, base []byte, snapshot []byte) []byte {
+	payload = binary.AppendUvarint(payload, uint64(len(snapshot)))
+	i := 0
+	for i < len(snapshot) {
+		// count the bytes that are unchanged
+		start := i
+		for i < len(snapshot) && i < len(base) && snapshot[i] == base[i] {
+			i++
+		}
+		skip := i - start
+		if i == len(snapshot) {
+			// the rest of the snapshot is unchanged
+			break
+		}
+		// count the bytes that have changed, short unchanged runs are cheaper to include as literals
+		start = i
+		for i < len(snapshot) {
+			if i < len(base) && snapshot[i] == base[i] {
+				same := 0
+				for i+same < len(snapshot) && i+same < len(base) && snapshot[i+same] == base[i+same] && same < 3 {
+					same++
+				}
+				if same >= 3 || i+same == len(snapshot) {
+					break
+				}
+				i += same
+				continue
+			}
+			i++
+		}
+		payload = binary.AppendUvarint(payload, uint64(skip))
+		payload = binary.AppendUvarint(payload, uint64(i-start))
+		payload = append(payload, snapshot[start:i]...)
+	}
+	return payload
+}
+
+// applyDelta rebuilds a snapshot from the base and a delta body created by appendDelta
+func applyDelta(base []byte, body []byte) ([]byte, error) {
+	length, n := binary.Uvarint(body)
+	if n <= 0 || length > uint64(len(base)+len(body)*1024) {
+		return nil, ErrCorrupt
+	}
+	body = body[n:]
+	snapshot := make([]byte, length)
+	i := 0
+	for len(body) > 0 {
+		skip, n := binary.Uvarint(body)
+		if n <= 0 || skip > uint64(len(snapshot)-i) || i+int(skip) > len(base) {
+			return nil, ErrCorrupt
+		}
+		body = body[n:]
+		copy(snapshot[i:], base[i:i+int(skip)])
+		i += int(skip)
+		literal, n := binary.Uvarint(body)
+		if n <= 0 || literal > uint64(len(body)-n) || literal > uint64(len(snapshot)-i) {
+			return nil, ErrCorrupt
+		}
+		body = body[n:]
+		copy(snapshot[i:], body[:literal])
+		i += int(literal)
+		body = body[literal:]
+	}
+	// anything left after the last run is unchanged
+	if i < len(snapshot) {
+		if len(snapshot) > len(base) {
+			return nil, ErrCorrupt
+		}
+		copy(snapshot[i:], base[i:])
+	}
+	return snapshot, nil
+}
+
+// newer returns true if id a was assigned after id b, allowing for wrap around
+func newer(a uint32, b uint32) bool {
+	return int32(a-b) > 0
+}
@@ -0,0 +1,131 @@
+package delta
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRUDP_DeltaFullUntilAcked(t *testing.T) {
+	e := NewEncoder(8)
+	d := NewDecoder(8)
+	snapshot := bytes.Repeat([]byte{1, 2, 3, 4}, 32)
+
+	payload, id := e.Encode(snapshot)
+	if payload[0] != KindFull {
+		t.Error("Expected a full snapshot when nothing has been acknowledged")
+	}
+	e.Sent(id, 10)
+	decoded, decoded_id, err := d.Decode(payload)
+	if err != nil || decoded_id != id || !bytes.Equal(decoded, snapshot) {
+		t.Error("Full snapshot did not decode")
+	}
+
+	// the remote acks the packet, the next snapshot should be a delta
+	e.Ack([]uint32{10})
+	if base, ok := e.Baseline(); !ok || base != id {
+		t.Error("Acked snapshot was not used as the baseline")
+	}
+	changed := make([]byte, len(snapshot))
+	copy(changed, snapshot)
+	changed[5] = 99
+	changed[100] = 42
+	payload, _ = e.Encode(changed)
+	if payload[0] != KindDelta {
+		t.Fatal("Expected a delta snapshot after an ack")
+	}
+	if len(payload) >= len(changed) {
+		t.Errorf("Delta is not smaller than the snapshot: %d >= %d", len(payload), len(changed))
+	}
+	decoded, _, err = d.Decode(payload)
+	if err != nil {
+		t.Errorf("Failed to decode delta: %s", err)
+	}
+	if !bytes.Equal(decoded, changed) {
+		t.Error("Delta did not decode to the original snapshot")
+	}
+}
+
+func TestRUDP_DeltaNewestAckedBaseline(t *testing.T) {
+	e := NewEncoder(8)
+	for i := uint32(0); i < 4; i++ {
+		_, id := e.Encode([]byte{uint8(i)})
+		e.Sent(id, i+100)
+	}
+	// acks can arrive in any order, the newest acked snapshot is the baseline
+	e.Ack([]uint32{102, 100})
+	if base, _ := e.Baseline(); base != 2 {
+		t.Errorf("Expected baseline 2, received %d", base)
+	}
+	e.Ack([]uint32{101})
+	if base, _ := e.Baseline(); base != 2 {
+		t.Errorf("Older ack replaced the baseline, received %d", base)
+	}
+}
+
+func TestRUDP_DeltaLengthChanges(t *testing.T) {
+	e := NewEncoder(4)
+	d := NewDecoder(4)
+	snapshots := [][]byte{
+		bytes.Repeat([]byte{7}, 64),
+		append(bytes.Repeat([]byte{7}, 64), 1, 2, 3),
+		bytes.Repeat([]byte{7}, 10),
+		{},
+		bytes.Repeat([]byte{8}, 70),
+	}
+	for i, snapshot := range snapshots {
+		payload, id := e.Encode(snapshot)
+		e.Sent(id, uint32(i))
+		decoded, _, err := d.Decode(payload)
+		if err != nil {
+			t.Fatalf("Snapshot %d failed to decode: %s", i, err)
+		}
+		if !bytes.Equal(decoded, snapshot) {
+			t.Errorf("Snapshot %d decoded incorrectly", i)
+		}
+		e.Ack([]uint32{uint32(i)})
+	}
+}
+
+func TestRUDP_DeltaBaselineEvicted(t *testing.T) {
+	e := NewEncoder(2)
+	d := NewDecoder(2)
+	snapshot := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 8)
+	payload, id := e.Encode(snapshot)
+	d.Decode(payload)
+	e.Sent(id, 0)
+	e.Ack([]uint32{0})
+	// acks stall while the baseline leaves the history, the decoder drops it at the same time
+	for i := 0; i < 3; i++ {
+		snapshot[0] = uint8(i)
+		payload, _ = e.Encode(snapshot)
+		decoded, _, err := d.Decode(payload)
+		if err != nil {
+			t.Fatalf("Failed to decode snapshot %d: %s", i, err)
+		}
+		if !bytes.Equal(decoded, snapshot) {
+			t.Fatalf("Snapshot %d decoded wrong", i)
+		}
+	}
+	if payload[0] != KindFull {
+		t.Error("Expected a full snapshot once the baseline was evicted")
+	}
+	if _, ok := e.Baseline(); ok {
+		t.Error("Expected no baseline once it was evicted")
+	}
+	// a decoder that has dropped the baseline reports it
+	e = NewEncoder(2)
+	_, id = e.Encode(snapshot)
+	e.Sent(id, 0)
+	e.Ack([]uint32{0})
+	payload, _ = e.Encode(snapshot)
+	d = NewDecoder(2)
+	if _, _, err := d.Decode(payload); err != ErrMissingBaseline {
+		t.Error("Expected a missing baseline error")
+	}
+	if _, _, err := d.Decode([]byte{9, 0, 0, 0, 0}); err != ErrUnknownKind {
+		t.Error("Expected an unknown kind error")
+	}
+	if _, _, err := d.Decode([]byte{1, 0}); err != ErrShortPayload {
+		t.Error("Expected a short payload error")
+	}
+}
@@ -0,0 +1,214 @@
+package rudp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jomstead/go-rudp/client"
+	"github.com/jomstead/go-rudp/clock"
+)
+
+// DialStagger is how long DialHappyEyeballs waits for a candidate before it also tries the next one
+const DialStagger = 250 * time.Millisecond
+
+// DialSettle is how long DialHappyEyeballs waits, once a candidate connected, for the ones still connecting so their
+// handshake RTTs are reported too
+const DialSettle = 100 * time.Millisecond
+
+var ErrOtherCandidate = errors.New("another address completed the handshake first")
+
+// Candidate is an address tried by DialHappyEyeballs
+type Candidate struct {
+	Addr *net.UDPAddr
+	RTT  time.Duration // time the server took to accept the connect request, 0 if the candidate didn't connect in time
+	Err  error         // why the candidate wasn't chosen, nil for the chosen address
+}
+
+// DialHappyEyeballs connects to the first of several addresses that completes the handshake.  hosts are hostnames
+// or IP addresses, hostnames are resolved to all their addresses.  IPv6 and IPv4 candidates are tried alternately,
+// IPv6 first, and each candidate gets DialStagger (less if it fails) before the next one starts in parallel, so a
+// broken address family only costs the stagger.  options configure every candidate like Dial's, the stagger is
+// timed with the Clock option.  setup configures each candidate's client (codecs, encryption, connect token) before
+// it connects, it may be nil.
+//
+// It returns the connected client and every candidate in the order they were tried, with the handshake RTT of each
+// one that connected.  Once a candidate completes the others get DialSettle to finish, those that connect are
+// reported with their RTT and closed, and those still connecting after it are abandoned.  Both get
+// ErrOtherCandidate.
+func DialHappyEyeballs(network string, hosts []string, port uint16, setup func(*client.RUDPClient), options ...Option) (*client.RUDPClient, []Candidate, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, nil, errors.New("only udp, udp4, and udp6 network types accepted")
+	}
+	config, err := dialConfig(options)
+	if err != nil {
+		return nil, nil, err
+	}
+	candidates, err := resolveCandidates(network, hosts, port)
+	if err != nil {
+		return nil, nil, err
+	}
+	type result struct {
+		index  int
+		client *client.RUDPClient
+		err    error
+	}
+	results := make(chan result, len(candidates))
+	start := func(i int) {
+		addr := candidates[i].Addr
+		c, err := config.dialSocket(network, addr)
+		if err != nil {
+			results <- result{i, nil, err}
+			return
+		}
+		rudpclient := &client.RUDPClient{}
+		rudpclient.Initialize(c, addr)
+		rudpclient.SetDialer(func() (net.PacketConn, error) {
+			return config.dialSocket(network, addr)
+		})
+		config.configureClient(rudpclient)
+		if setup != nil {
+			setup(rudpclient)
+		}
+		go func() {
+			results <- result{i, rudpclient, rudpclient.Connect()}
+		}()
+	}
+	next, pending := 0, 0
+	timers := clock.Or(config.clock)
+	var stagger clock.Timer
+	var staggered <-chan time.Time
+	startNext := func() {
+		start(next)
+		next++
+		pending++
+		if stagger != nil {
+			stagger.Stop()
+		}
+		stagger, staggered = nil, nil
+		if next < len(candidates) {
+			stagger = timers.NewTimer(DialStagger)
+			staggered = stagger.C()
+		}
+	}
+	defer func() {
+		if stagger != nil {
+			stagger.Stop()
+		}
+	}()
+	startNext()
+	var errs []error
+	for pending > 0 {
+		select {
+		case <-staggered:
+			startNext()
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				candidates[r.index].RTT = r.client.HandshakeRTT()
+				// give the others a moment to report their RTT
+				settle := timers.NewTimer(DialSettle)
+			settling:
+				for pending > 0 {
+					select {
+					case <-settle.C():
+						break settling
+					case late := <-results:
+						pending--
+						if late.err == nil {
+							// connected too late to be chosen, only its RTT is kept
+							candidates[late.index].RTT = late.client.HandshakeRTT()
+						} else {
+							candidates[late.index].Err = late.err
+						}
+						if late.client != nil {
+							late.client.Close()
+						}
+					}
+				}
+				settle.Stop()
+				for i := 0; i < next; i++ {
+					if i != r.index && candidates[i].Err == nil {
+						candidates[i].Err = ErrOtherCandidate
+					}
+				}
+				// close the abandoned candidates once they give up, disconnecting any that connect late
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.client != nil {
+							r.client.Close()
+						}
+					}
+				}(pending)
+				return r.client, candidates[:next], nil
+			}
+			candidates[r.index].Err = r.err
+			errs = append(errs, fmt.Errorf("%s: %w", candidates[r.index].Addr, r.err))
+			if r.client != nil {
+				r.client.Close()
+			}
+			if next < len(candidates) {
+				// don't wait for the stagger after a failure
+				startNext()
+			}
+		}
+	}
+	return nil, candidates, fmt.Errorf("no address completed the handshake: %w", errors.Join(errs...))
+}
+
+// resolveCandidates resolves hosts to the addresses of network, alternating between IPv6 and IPv4.  Hosts that
+// don't resolve are skipped.
+func resolveCandidates(network string, hosts []string, port uint16) ([]Candidate, error) {
+	var v6, v4 []*net.UDPAddr
+	seen := map[string]bool{}
+	var lookupErr error
+	for _, host := range hosts {
+		ips := []net.IP{net.ParseIP(host)}
+		if ips[0] == nil {
+			var err error
+			if ips, err = net.LookupIP(host); err != nil {
+				// the other hosts may still resolve
+				lookupErr = err
+				continue
+			}
+		}
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil {
+				// ParseIP returns IPv4 addresses in their 16 byte form
+				ip = ip4
+			}
+			addr := &net.UDPAddr{IP: ip, Port: int(port)}
+			if seen[addr.String()] {
+				continue
+			}
+			seen[addr.String()] = true
+			if ip.To4() != nil {
+				if network != "udp6" {
+					v4 = append(v4, addr)
+				}
+			} else if network != "udp4" {
+				v6 = append(v6, addr)
+			}
+		}
+	}
+	var candidates []Candidate
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			candidates = append(candidates, Candidate{Addr: v6[i]})
+		}
+		if i < len(v4) {
+			candidates = append(candidates, Candidate{Addr: v4[i]})
+		}
+	}
+	if len(candidates) == 0 && lookupErr != nil {
+		return nil, lookupErr
+	}
+	if len(candidates) == 0 {
+		return nil, errors.New("no " + network + " addresses for port " + strconv.Itoa(int(port)))
+	}
+	return candidates, nil
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package rudp
+
+import (
+	"errors"
+	"net"
+)
+
+// setDSCP is not supported on this platform
+func setDSCP(conn *net.UDPConn, dscp int) error {
+	return errors.New("DSCP is not supported on this platform")
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package rudp
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDSCP sets the code point in the traffic class of the packets sent from conn
+func setDSCP(conn *net.UDPConn, dscp int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	ipv4 := conn.LocalAddr().(*net.UDPAddr).IP.To4() != nil
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		// the code point is the upper 6 bits of the IPv4 TOS and IPv6 traffic class bytes
+		if ipv4 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, dscp<<2)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, dscp<<2)
+			// IPv4 packets from a dual-stack socket, not every system supports it
+			syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, dscp<<2)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,326 @@
+// Package metrics exports the statistics of a server in the Prometheus text exposition format.  An Exporter serves
+// the server's aggregate statistics, the statistics of its busiest connections and histograms of the measured
+// round trip times, the connect resends of each connection and the packet sizes.  The busiest connections are
+// labeled by their rank rather than their address, so the number of series stays bounded while clients come and
+// go, and their totals are gauges since the client at a rank changes.  Exporter.Peers maps the ranks to addresses.
+// It only uses the standard library, so the core packages don't depend on a metrics client.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jomstead/go-rudp/clock"
+	"github.com/jomstead/go-rudp/server"
+	"github.com/jomstead/go-rudp/stats"
+)
+
+// DefaultMaxPeers is how many connections get metrics of their own unless SetMaxPeers changes it
+const DefaultMaxPeers = 20
+
+// ContentType is the content type of the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	RTTBuckets     = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5} // seconds
+	ResendBuckets  = []float64{0, 1, 2, 4, 8, 16}                                      // connect resends per connection
+	PacketBuckets  = []float64{32, 64, 128, 256, 512, 1024, 1500}                      // bytes on the wire
+	reliableLabels = [2]string{`{reliability="unreliable"}`, `{reliability="reliable"}`}
+)
+
+// Exporter is an http.Handler serving the metrics of a server, it is safe to use from several goroutines
+type Exporter struct {
+	server    *server.RUDPServer
+	mu        sync.Mutex
+	peers     map[*stats.Recorder]netip.AddrPort // connected clients by their statistics
+	max_peers int
+	rtt       histogram
+	resends   histogram
+	sent      histogram
+	received  histogram
+	clock     clock.Clock // time source of the connections' rates, the system clock if nil
+}
+
+// New returns an exporter for s and sets it as the observer of s (see server.RUDPServer.SetObserver).  Call it
+// from the goroutine that calls ReadFromUDP, before clients connect: connections made earlier have no metrics of
+// their own.
+func New(s *server.RUDPServer) *Exporter {
+	e := &Exporter{
+		server:    s,
+		peers:     make(map[*stats.Recorder]netip.AddrPort),
+		max_peers: DefaultMaxPeers,
+		rtt:       newHistogram(RTTBuckets),
+		resends:   newHistogram(ResendBuckets),
+		sent:      newHistogram(PacketBuckets),
+		received:  newHistogram(PacketBuckets),
+	}
+	s.SetObserver(e)
+	return e
+}
+
+// SetMaxPeers sets how many connections get metrics of their own, 0 for none.  The connections that sent and
+// received the most bytes are picked, so the number of series stays bounded however many clients connect.  The
+// others still count towards the aggregate metrics.
+func (e *Exporter) SetMaxPeers(max int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.max_peers = max
+}
+
+// SetClock sets the time source of the connections' rates, nil is the system clock.  Use the server's clock.
+func (e *Exporter) SetClock(c clock.Clock) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.clock = c
+}
+
+// Connected implements server.Observer
+func (e *Exporter) Connected(addr netip.AddrPort, r *stats.Recorder) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.peers[r] = addr
+}
+
+// Disconnected implements server.Observer, it adds the connect requests and accepts the connection resent to their
+// histogram.  The library doesn't resend data packets, so these are the only resends there are.
+func (e *Exporter) Disconnected(r *stats.Recorder) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.peers[r]; ok {
+		delete(e.peers, r)
+		e.resends.observe(float64(r.Stats(clock.Or(e.clock).Now()).Resends))
+	}
+}
+
+// Packet implements server.Observer
+func (e *Exporter) Packet(size int, sent bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if sent {
+		e.sent.observe(float64(size))
+	} else {
+		e.received.observe(float64(size))
+	}
+}
+
+// RTT implements server.Observer
+func (e *Exporter) RTT(rtt time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rtt.observe(rtt.Seconds())
+}
+
+// peer is a connection with metrics of its own
+type peer struct {
+	addr  netip.AddrPort
+	stats stats.Stats
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	w.Write(e.Append(nil))
+}
+
+// Peers returns the addresses of the connections with metrics of their own, the busiest first, so the client
+// labeled rank="n" is at index n-1.  The metrics don't carry the addresses, that would add series for every client
+// that ever connected.  Ranks follow the traffic, so they can change between a scrape and this call.
+func (e *Exporter) Peers() []netip.AddrPort {
+	e.mu.Lock()
+	recorders := make(map[*stats.Recorder]netip.AddrPort, len(e.peers))
+	for r, addr := range e.peers {
+		recorders[r] = addr
+	}
+	max_peers, now := e.max_peers, clock.Or(e.clock).Now()
+	e.mu.Unlock()
+
+	peers, _ := ranked(recorders, now, max_peers)
+	addrs := make([]netip.AddrPort, len(peers))
+	for i, p := range peers {
+		addrs[i] = p.addr
+	}
+	return addrs
+}
+
+// Append appends the metrics in the Prometheus text exposition format to b
+func (e *Exporter) Append(b []byte) []byte {
+	e.mu.Lock()
+	recorders := make(map[*stats.Recorder]netip.AddrPort, len(e.peers))
+	for r, addr := range e.peers {
+		recorders[r] = addr
+	}
+	max_peers, now := e.max_peers, clock.Or(e.clock).Now()
+	rtt, resends, sent, received := e.rtt.copy(), e.resends.copy(), e.sent.copy(), e.received.copy()
+	e.mu.Unlock()
+
+	peers, omitted := ranked(recorders, now, max_peers)
+
+	w := writer{bytes.NewBuffer(b)}
+	total := e.server.TotalStats()
+	w.metric("rudp_connections", "gauge", "Connected clients.", "", float64(len(recorders)))
+	w.metric("rudp_peers_omitted", "gauge", "Connected clients without metrics of their own, see SetMaxPeers.", "", float64(omitted))
+	w.split("rudp_packets_sent_total", "Packets sent.", total.UnreliableSent, total.ReliableSent)
+	w.split("rudp_bytes_sent_total", "Bytes sent, including headers.", total.UnreliableBytesSent, total.ReliableBytesSent)
+	w.split("rudp_packets_received_total", "Packets received.", total.UnreliableReceived, total.ReliableReceived)
+	w.split("rudp_bytes_received_total", "Bytes received, including headers.", total.UnreliableBytesReceived, total.ReliableBytesReceived)
+	w.metric("rudp_resends_total", "counter", "Connect requests and accepts sent again.", "", float64(total.Resends))
+	w.metric("rudp_acked_total", "counter", "Reliable packets acknowledged.", "", float64(total.Acked))
+	w.metric("rudp_lost_total", "counter", "Reliable packets that fell out of the ack window.", "", float64(total.Lost))
+	w.metric("rudp_duplicates_total", "counter", "Reliable packets received again and dropped.", "", float64(total.Duplicates))
+	w.metric("rudp_malformed_total", "counter", "Malformed and corrupted packets received.", "", float64(total.Malformed))
+	w.metric("rudp_smoothed_rtt_seconds", "gauge", "Smoothed round trip time.", "", total.RTT.Seconds())
+	w.metric("rudp_rtt_variance_seconds", "gauge", "Mean deviation of the round trip time.", "", total.RTTVariance.Seconds())
+	w.metric("rudp_loss_rate", "gauge", "Recent fraction of reliable packets lost.", "", total.LossRate)
+	w.metric("rudp_send_rate_bytes", "gauge", "Bytes sent per second.", "", total.SendRate)
+	w.metric("rudp_receive_rate_bytes", "gauge", "Bytes received per second.", "", total.ReceiveRate)
+
+	w.peers("rudp_peer_bytes_sent", "gauge", "Bytes sent to a client.", peers, func(s stats.Stats) float64 {
+		return float64(s.ReliableBytesSent + s.UnreliableBytesSent)
+	})
+	w.peers("rudp_peer_bytes_received", "gauge", "Bytes received from a client.", peers, func(s stats.Stats) float64 {
+		return float64(s.ReliableBytesReceived + s.UnreliableBytesReceived)
+	})
+	w.peers("rudp_peer_lost", "gauge", "Reliable packets to a client that fell out of the ack window.", peers, func(s stats.Stats) float64 {
+		return float64(s.Lost)
+	})
+	w.peers("rudp_peer_smoothed_rtt_seconds", "gauge", "Smoothed round trip time to a client.", peers, func(s stats.Stats) float64 {
+		return s.RTT.Seconds()
+	})
+	w.peers("rudp_peer_loss_rate", "gauge", "Recent fraction of reliable packets to a client lost.", peers, func(s stats.Stats) float64 {
+		return s.LossRate
+	})
+	w.peers("rudp_peer_send_rate_bytes", "gauge", "Bytes sent to a client per second.", peers, func(s stats.Stats) float64 {
+		return s.SendRate
+	})
+	w.peers("rudp_peer_receive_rate_bytes", "gauge", "Bytes received from a client per second.", peers, func(s stats.Stats) float64 {
+		return s.ReceiveRate
+	})
+
+	w.header("rudp_rtt_seconds", "histogram", "Round trip times measured by acknowledgements.")
+	w.histogram("rudp_rtt_seconds", "", rtt)
+	w.header("rudp_connection_connect_resends", "histogram", "Connect requests and accepts resent by the connections that ended.")
+	w.histogram("rudp_connection_connect_resends", "", resends)
+	w.header("rudp_packet_size_bytes", "histogram", "Sizes of the packets sent and received, including headers.")
+	w.histogram("rudp_packet_size_bytes", `direction="sent"`, sent)
+	w.histogram("rudp_packet_size_bytes", `direction="received"`, received)
+	return w.Bytes()
+}
+
+// histogram counts observations in cumulative buckets
+type histogram struct {
+	bounds []float64 // upper bounds of the buckets, +Inf is implied
+	counts []uint64  // observations in each bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) histogram {
+	return histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.count++
+	h.sum += v
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.counts[i]++
+	}
+}
+
+func (h *histogram) copy() histogram {
+	c := *h
+	c.counts = append([]uint64(nil), h.counts...)
+	return c
+}
+
+// writer writes metrics in the text exposition format
+type writer struct {
+	*bytes.Buffer
+}
+
+func (w writer) header(name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one value, labels are formatted without braces, e.g. rank="1"
+func (w writer) sample(name string, labels string, value float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+// metric writes a metric with one value
+func (w writer) metric(name string, kind string, help string, labels string, value float64) {
+	w.header(name, kind, help)
+	w.sample(name, labels, value)
+}
+
+// split writes a counter with a value for unreliable and one for reliable packets
+func (w writer) split(name string, help string, unreliable uint64, reliable uint64) {
+	w.header(name, "counter", help)
+	for i, v := range [2]uint64{unreliable, reliable} {
+		w.WriteString(name + reliableLabels[i] + " " + strconv.FormatUint(v, 10) + "\n")
+	}
+}
+
+// ranked returns the max busiest connections by bytes sent and received, and how many others there are.  The
+// recorders have locks of their own, don't hold the exporter's.
+func ranked(recorders map[*stats.Recorder]netip.AddrPort, now time.Time, max int) (peers []peer, omitted int) {
+	peers = make([]peer, 0, len(recorders))
+	for r, addr := range recorders {
+		peers = append(peers, peer{addr, r.Stats(now)})
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		a, b := peers[i].stats, peers[j].stats
+		ta := a.ReliableBytesSent + a.UnreliableBytesSent + a.ReliableBytesReceived + a.UnreliableBytesReceived
+		tb := b.ReliableBytesSent + b.UnreliableBytesSent + b.ReliableBytesReceived + b.UnreliableBytesReceived
+		if ta != tb {
+			return ta > tb
+		}
+		return peers[i].addr.String() < peers[j].addr.String()
+	})
+	if max < 0 {
+		max = 0
+	}
+	if len(peers) > max {
+		omitted = len(peers) - max
+		peers = peers[:max]
+	}
+	return peers, omitted
+}
+
+// peers writes a metric with a value for each peer, labeled by its rank
+func (w writer) peers(name string, kind string, help string, peers []peer, value func(stats.Stats) float64) {
+	w.header(name, kind, help)
+	for i, p := range peers {
+		w.sample(name, rank(i), value(p.stats))
+	}
+}
+
+// rank returns the label of the peer at index i, the busiest is rank="1"
+func rank(i int) string {
+	return `rank="` + strconv.Itoa(i+1) + `"`
+}
+
+// histogram writes the buckets, sum and count of h
+func (w writer) histogram(name string, labels string, h histogram) {
+	prefix := labels
+	if prefix != "" {
+		prefix += ","
+	}
+	cumulative := uint64(0)
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		w.sample(name+"_bucket", prefix+`le="`+strconv.FormatFloat(bound, 'g', -1, 64)+`"`, float64(cumulative))
+	}
+	w.sample(name+"_bucket", prefix+`le="+Inf"`, float64(h.count))
+	w.sample(name+"_sum", labels, h.sum)
+	w.sample(name+"_count", labels, float64(h.count))
+}
@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jomstead/go-rudp/client"
+	"github.com/jomstead/go-rudp/clock/clocktest"
+	"github.com/jomstead/go-rudp/server"
+	"github.com/jomstead/go-rudp/transport"
+)
+
+// scrape returns the lines served by e
+func scrape(t *testing.T, e *Exporter) []string {
+	recorder := httptest.NewRecorder()
+	e.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if content := recorder.Header().Get("Content-Type"); content != ContentType {
+		t.Errorf("Content-Type %q", content)
+	}
+	return strings.Split(recorder.Body.String(), "\n")
+}
+
+// has reports whether lines contains line
+func has(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRUDP_Metrics(t *testing.T) {
+	t.Parallel()
+	fake := clocktest.NewFake(time.Time{})
+	hub := transport.NewHub()
+	hub.SetClock(fake)
+	c, _ := hub.ListenPacket("10.0.0.1:9000")
+	s := server.RUDPServer{}
+	s.Initialize(c, nil)
+	s.SetClock(fake)
+	defer s.Close()
+	exporter := New(&s)
+	exporter.SetClock(fake)
+	exporter.SetMaxPeers(1)
+
+	// two clients, the second sends more
+	var clients [2]*client.RUDPClient
+	var addrs [2]netip.AddrPort
+	for i := range clients {
+		cc, _ := hub.ListenPacket("10.0.0.2:0")
+		addrs[i] = cc.AddrPort()
+		clients[i] = &client.RUDPClient{}
+		clients[i].Initialize(cc, c.LocalAddr().(*net.UDPAddr))
+		clients[i].SetClock(fake)
+		defer clients[i].Close()
+		connected := make(chan error)
+		go func(rc *client.RUDPClient) {
+			err := rc.Connect()
+			rc.Write(&[]byte{1}, false)
+			connected <- err
+		}(clients[i])
+		if _, _, _, err := s.ReadFromUDP(make([]byte, 1024)); err != nil {
+			t.Fatalf("Failed to read the first packet: %s", err)
+		}
+		if err := <-connected; err != nil {
+			t.Fatalf("Failed to connect: %s", err)
+		}
+	}
+
+	// a reliable packet to the second client acknowledged 40ms later
+	temp := make([]byte, 1024)
+	s.WriteToUDP(&[]byte{2, 2, 2, 2}, addrs[1], true)
+	fake.Advance(40 * time.Millisecond)
+	if _, _, _, err := clients[1].ReadFromUDP(temp); err != nil {
+		t.Fatalf("Failed to read the reliable packet: %s", err)
+	}
+	clients[1].Write(&[]byte{3}, false)
+	if _, verified, _, err := s.ReadFromUDP(temp); err != nil || len(verified) != 1 {
+		t.Fatalf("Expected the reliable packet to be verified, got %v, %v", verified, err)
+	}
+
+	lines := scrape(t, exporter)
+	total := s.TotalStats()
+	for _, line := range []string{
+		"# TYPE rudp_packets_sent_total counter",
+		"rudp_connections 2",
+		"rudp_peers_omitted 1",
+		`rudp_packets_sent_total{reliability="reliable"} 1`,
+		`rudp_packets_received_total{reliability="unreliable"} ` + strconv.FormatUint(total.UnreliableReceived, 10),
+		"rudp_acked_total 1",
+		"rudp_smoothed_rtt_seconds 0.04",
+		"# TYPE rudp_peer_bytes_sent gauge",
+		`rudp_peer_smoothed_rtt_seconds{rank="1"} 0.04`,
+		"# TYPE rudp_rtt_seconds histogram",
+		`rudp_rtt_seconds_bucket{le="0.025"} 0`,
+		`rudp_rtt_seconds_bucket{le="0.05"} 1`,
+		`rudp_rtt_seconds_bucket{le="+Inf"} 1`,
+		"rudp_rtt_seconds_sum 0.04",
+		"rudp_rtt_seconds_count 1",
+		`rudp_packet_size_bytes_count{direction="received"} ` + strconv.FormatUint(total.UnreliableReceived, 10),
+		"rudp_connection_connect_resends_count 0",
+	} {
+		if !has(lines, line) {
+			t.Errorf("missing %q", line)
+		}
+	}
+	for _, line := range lines {
+		// peers are only known by rank, the address would add series for every client
+		if strings.HasPrefix(line, "rudp_peer_") && (!strings.Contains(line, `rank="1"`) || strings.Contains(line, addrs[1].Addr().String())) {
+			t.Errorf("%q is not about the busiest client by rank", line)
+		}
+	}
+	if peers := exporter.Peers(); len(peers) != 1 || peers[0] != addrs[1] {
+		t.Errorf("Expected rank 1 to be %v, got %v", addrs[1], peers)
+	}
+
+	// disconnected clients leave their connect resends in the histogram
+	s.Disconnect(addrs[1])
+	lines = scrape(t, exporter)
+	for _, line := range []string{"rudp_connections 1", "rudp_peers_omitted 0", `rudp_connection_connect_resends_bucket{le="0"} 1`, "rudp_connection_connect_resends_count 1"} {
+		if !has(lines, line) {
+			t.Errorf("missing %q after the disconnect", line)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package rudp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/jomstead/go-rudp/client"
+	"github.com/jomstead/go-rudp/clock"
+	"github.com/jomstead/go-rudp/packet"
+	"github.com/jomstead/go-rudp/secure"
+	"github.com/jomstead/go-rudp/server"
+)
+
+var ErrInvalidConfig = errors.New("invalid rudp configuration")
+
+// maxPacketSize is the largest UDP payload
+const maxPacketSize = 65507
+
+// minReceiveBuffer is the smallest receive buffer that fits the largest header with a checksum and encryption
+const minReceiveBuffer = packet.MaxHeaderSize + packet.ChecksumSize + secure.Overhead
+
+// Option configures the server or client created by Listen, ListenConfig.Listen, ListenPacket, Dial or DialPacket.  The ack window (32
+// reliable packets) is part of the wire format and can't be configured.  Resend policies and channel definitions
+// are not implemented: the library only resends connect requests (see ConnectRetry) and leaves resending
+// unverified reliable payloads to the application, and packets have no channel field, adding one would change the
+// wire format.
+type Option func(*config)
+
+type config struct {
+	receive_buffer   int
+	unverified       int
+	socket_read      int
+	socket_write     int
+	dscp             int
+	connect_attempts int
+	connect_timeout  time.Duration
+	connect_retry    bool // ConnectRetry was given, it only applies to clients
+	timeout          time.Duration
+	grace            time.Duration
+	report_malformed bool
+	logger           *log.Logger
+	clock            clock.Clock
+	dial             func(network string, addr *net.UDPAddr) (net.PacketConn, error) // opens client sockets, net.DialUDP if nil
+}
+
+// ReceiveBuffer sets the size of the receive buffer, the largest packet that can be received including its header
+// (default 1024 bytes)
+func ReceiveBuffer(size int) Option {
+	return func(c *config) { c.receive_buffer = size }
+}
+
+// UnverifiedCapacity sets the initial capacity of the list of unverified reliable packets kept per connection
+// (default 16), it grows as needed
+func UnverifiedCapacity(capacity int) Option {
+	return func(c *config) { c.unverified = capacity }
+}
+
+// SocketBuffers sets the kernel's receive and send buffer sizes (SO_RCVBUF and SO_SNDBUF) of every socket, 0 keeps
+// the system default
+func SocketBuffers(receive int, send int) Option {
+	return func(c *config) { c.socket_read, c.socket_write = receive, send }
+}
+
+// DSCP marks outgoing packets with a differentiated services code point (0 to 63, e.g. 46 for expedited
+// forwarding), 0 leaves them unmarked
+func DSCP(codepoint int) Option {
+	return func(c *config) { c.dscp = codepoint }
+}
+
+// ConnectRetry sets how many connect requests a client sends and how long it waits for an answer to each
+// (default 5 and 200ms), clients only
+func ConnectRetry(attempts int, timeout time.Duration) Option {
+	return func(c *config) {
+		c.connect_attempts, c.connect_timeout = attempts, timeout
+		c.connect_retry = true
+	}
+}
+
+// Timeout disconnects clients that are silent for longer than timeout and keeps their state for grace longer so
+// they can resume, servers only, see server.SetTimeout
+func Timeout(timeout time.Duration, grace time.Duration) Option {
+	return func(c *config) { c.timeout, c.grace = timeout, grace }
+}
+
+// ReportMalformed makes ReadFromUDP return malformed and unknown packets as errors instead of dropping them
+func ReportMalformed() Option {
+	return func(c *config) { c.report_malformed = true }
+}
+
+// Logger logs connection events to l
+func Logger(l *log.Logger) Option {
+	return func(c *config) { c.logger = l }
+}
+
+// Clock sets the time source of the server or client, see package clocktest for a manual clock to test with
+func Clock(c clock.Clock) Option {
+	return func(cfg *config) { cfg.clock = c }
+}
+
+// PacketDialer makes Dial and DialHappyEyeballs open the client's sockets with dial instead of net.DialUDP, e.g. on
+// an in-memory transport (see package transport), clients only.  Socket options need dial to return a *net.UDPConn.
+func PacketDialer(dial func(network string, addr *net.UDPAddr) (net.PacketConn, error)) Option {
+	return func(cfg *config) { cfg.dial = dial }
+}
+
+// newConfig applies options to the defaults and validates the result
+func newConfig(options []Option) (config, error) {
+	c := config{
+		receive_buffer:   server.ReceiveBufferSize,
+		unverified:       server.UnverifiedCapacity,
+		connect_attempts: client.ConnectAttempts,
+		connect_timeout:  client.ConnectTimeout,
+	}
+	for _, option := range options {
+		option(&c)
+	}
+	invalid := func(format string, v ...any) error {
+		return fmt.Errorf("%w: "+format, append([]any{ErrInvalidConfig}, v...)...)
+	}
+	switch {
+	case c.receive_buffer < minReceiveBuffer:
+		return c, invalid("receive buffer of %d bytes can't hold the largest header with a checksum or encryption (%d bytes)", c.receive_buffer, minReceiveBuffer)
+	case c.receive_buffer > maxPacketSize:
+		return c, invalid("receive buffer of %d bytes is larger than the largest UDP packet (%d bytes)", c.receive_buffer, maxPacketSize)
+	case c.unverified < 0:
+		return c, invalid("negative unverified capacity %d", c.unverified)
+	case c.socket_read < 0 || c.socket_write < 0:
+		return c, invalid("negative socket buffer size %d/%d", c.socket_read, c.socket_write)
+	case c.dscp < 0 || c.dscp > 63:
+		return c, invalid("DSCP %d is not between 0 and 63", c.dscp)
+	case c.connect_attempts < 1:
+		return c, invalid("a client needs at least 1 connect attempt, got %d", c.connect_attempts)
+	case c.connect_timeout <= 0:
+		return c, invalid("connect timeout %v is not positive", c.connect_timeout)
+	case c.timeout < 0 || c.grace < 0:
+		return c, invalid("negative timeout %v or grace period %v", c.timeout, c.grace)
+	case c.grace > 0 && c.timeout == 0:
+		return c, invalid("a grace period of %v needs a timeout, clients are never timed out without one", c.grace)
+	}
+	return c, nil
+}
+
+// listenConfig returns the configuration for a server
+func listenConfig(options []Option) (config, error) {
+	c, err := newConfig(options)
+	if err == nil && c.connect_retry {
+		err = fmt.Errorf("%w: ConnectRetry only applies to clients", ErrInvalidConfig)
+	}
+	if err == nil && c.dial != nil {
+		err = fmt.Errorf("%w: PacketDialer only applies to clients", ErrInvalidConfig)
+	}
+	return c, err
+}
+
+// dialConfig returns the configuration for a client
+func dialConfig(options []Option) (config, error) {
+	c, err := newConfig(options)
+	if err == nil && (c.timeout != 0 || c.grace != 0) {
+		err = fmt.Errorf("%w: Timeout only applies to servers, see client.NewReconnectingClient", ErrInvalidConfig)
+	}
+	return c, err
+}
+
+// setSocketOptions applies the socket options to a newly bound socket, they need a UDP socket
+func (c config) setSocketOptions(pc net.PacketConn) error {
+	conn, ok := pc.(*net.UDPConn)
+	if !ok {
+		if c.socket_read > 0 || c.socket_write > 0 || c.dscp > 0 {
+			return fmt.Errorf("%w: socket options need a *net.UDPConn, got %T", ErrInvalidConfig, pc)
+		}
+		return nil
+	}
+	if c.socket_read > 0 {
+		if err := conn.SetReadBuffer(c.socket_read); err != nil {
+			return err
+		}
+	}
+	if c.socket_write > 0 {
+		if err := conn.SetWriteBuffer(c.socket_write); err != nil {
+			return err
+		}
+	}
+	if c.dscp > 0 {
+		return setDSCP(conn, c.dscp)
+	}
+	return nil
+}
+
+// dialSocket opens a client socket to addr and applies the socket options
+func (c config) dialSocket(network string, addr *net.UDPAddr) (net.PacketConn, error) {
+	dial := c.dial
+	if dial == nil {
+		dial = func(network string, addr *net.UDPAddr) (net.PacketConn, error) {
+			return net.DialUDP(network, nil, addr)
+		}
+	}
+	conn, err := dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.setSocketOptions(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// configureServer applies the configuration to a server
+func (c config) configureServer(s *server.RUDPServer) {
+	s.SetBufferSizes(c.receive_buffer, c.unverified)
+	s.SetTimeout(c.timeout, c.grace)
+	s.ReportMalformed(c.report_malformed)
+	s.SetLogger(c.logger)
+	s.SetClock(c.clock)
+}
+
+// configureClient applies the configuration to a client
+func (c config) configureClient(rc *client.RUDPClient) {
+	rc.SetBufferSizes(c.receive_buffer, c.unverified)
+	rc.SetConnectRetry(c.connect_attempts, c.connect_timeout)
+	rc.ReportMalformed(c.report_malformed)
+	rc.SetLogger(c.logger)
+	rc.SetClock(c.clock)
+}
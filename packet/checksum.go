@@ -0,0 +1,31 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// ChecksumSize is the size of the CRC32C at the end of a checksummed packet
+const ChecksumSize = 4
+
+var ErrBadChecksum = errors.New("packet checksum does not match, the packet was corrupted")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// AppendChecksum appends the CRC32C of data (header and payload) to data
+func AppendChecksum(data []byte) []byte {
+	return binary.BigEndian.AppendUint32(data, crc32.Checksum(data, castagnoli))
+}
+
+// VerifyChecksum checks the CRC32C at the end of data and returns the packet without it
+func VerifyChecksum(data []byte) ([]byte, error) {
+	if len(data) < ChecksumSize {
+		return nil, ErrShortPacket
+	}
+	end := len(data) - ChecksumSize
+	if crc32.Checksum(data[:end], castagnoli) != binary.BigEndian.Uint32(data[end:]) {
+		return nil, ErrBadChecksum
+	}
+	return data[:end], nil
+}
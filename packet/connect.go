@@ -0,0 +1,89 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/jomstead/go-rudp/secure"
+)
+
+// MinConnectSize is the smallest connect request a client sends, requests are padded so that the server's
+// challenge is never larger than the request that caused it
+const MinConnectSize = 32
+
+// MinEncryptedConnectSize is the smallest connect request with a key, large enough for the encrypted accept
+// [header][codec][options][connection id][server static key][server ephemeral key][sealed resume ticket]
+const MinEncryptedConnectSize = ControlHeaderSize + 2 + ConnectionIDSize + 2*secure.KeySize + secure.TicketSize + secure.Overhead
+
+var ErrMalformedConnect = errors.New("malformed connect request")
+
+// Connect is the body of a connect request
+// [codec count][codec ids...][key size][client public key][token size (uint16)][connect token][cookie size][cookie][options][resume size][resume][padding]
+type Connect struct {
+	Codecs  []uint8 // compression codecs the client supports, in order of preference
+	Key     []byte  // client ephemeral public key, empty for unencrypted connections
+	Token   []byte  // connect token from the matchmaker, empty if the server doesn't require one
+	Cookie  []byte  // cookie from the server's challenge, empty until the server sends one
+	Options uint8   // connection options the client asks for, see OptionChecksum
+	Resume  []byte  // [connection id (uint64)][proof], empty unless the client is resuming its connection, see secure.ResumeProof
+}
+
+// Marshal returns the complete connect packet
+func (c Connect) Marshal() []byte {
+	data := make([]byte, 0, MinEncryptedConnectSize+len(c.Codecs)+len(c.Key)+len(c.Token)+len(c.Cookie)+len(c.Resume))
+	data = Header{Type: TypeConnect}.Append(data)
+	data = append(data, uint8(len(c.Codecs)))
+	data = append(data, c.Codecs...)
+	data = append(data, uint8(len(c.Key)))
+	data = append(data, c.Key...)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(c.Token)))
+	data = append(data, c.Token...)
+	data = append(data, uint8(len(c.Cookie)))
+	data = append(data, c.Cookie...)
+	data = append(data, c.Options, uint8(len(c.Resume)))
+	data = append(data, c.Resume...)
+	size := MinConnectSize
+	if len(c.Key) > 0 {
+		size = MinEncryptedConnectSize
+	}
+	for len(data) < size {
+		data = append(data, 0)
+	}
+	return data
+}
+
+// ParseConnect parses the body of a connect packet, the returned slices point into data
+func ParseConnect(data []byte) (Connect, error) {
+	var c Connect
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return c, ErrMalformedConnect
+	}
+	c.Codecs = data[1 : 1+int(data[0])]
+	data = data[1+int(data[0]):]
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return c, ErrMalformedConnect
+	}
+	c.Key = data[1 : 1+int(data[0])]
+	data = data[1+int(data[0]):]
+	if len(data) < 2 || len(data)-2 < int(binary.BigEndian.Uint16(data)) {
+		return c, ErrMalformedConnect
+	}
+	c.Token = data[2 : 2+int(binary.BigEndian.Uint16(data))]
+	data = data[2+len(c.Token):]
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return c, ErrMalformedConnect
+	}
+	c.Cookie = data[1 : 1+int(data[0])]
+	data = data[1+len(c.Cookie):]
+	if len(data) < 1 {
+		return c, ErrMalformedConnect
+	}
+	c.Options = data[0]
+	data = data[1:]
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return c, ErrMalformedConnect
+	}
+	c.Resume = data[1 : 1+int(data[0])]
+	// anything left is padding
+	return c, nil
+}
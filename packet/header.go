@@ -0,0 +1,208 @@
+package packet
+
+/*
+ * Every packet starts with
+ * [protocol id (uint16)][version][type][flags][connection id (uint64, FlagConnection only)]
+ *
+ * clients send the connection id the server assigned them in every packet after connecting, so the server can
+ * follow them when their address changes
+ *
+ * data and ack packets continue with
+ * [sequence (uvarint, reliable only)][remote ack (uvarint)][missing ack bits (uvarint)][payload][checksum (uint32, optional)]
+ *
+ * the remote ack and bits are only present with FlagAck, senders leave them out when they have nothing new to
+ * acknowledge.  The bits are sent inverted, a set bit is a packet that hasn't arrived.  Usually every packet
+ * arrived and the uvarint is a single byte.
+ *
+ * all other packet types continue with their body, see the Type constants
+ */
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	ProtocolID uint16 = 0x5255 // "RU", tells RUDP packets apart from stray UDP traffic hitting the port
+	Version    uint8  = 2      // wire format version, peers with different versions can't talk to each other
+)
+
+// Type is the packet type, byte 3 of every packet
+type Type uint8
+
+const (
+	TypeData          Type = iota + 1 // user payload, returned by ReadFromUDP
+	TypeAck                           // acknowledgements without a payload, always has FlagAck, sent by Acknowledge on the client and server
+	TypeConnect                       // client -> server, see Connect
+	TypeAccept                        // server -> client [codec id][options][connection id (uint64)][server static key][server ephemeral key][resume ticket] (keys encrypted only, the ticket is sealed on encrypted connections)
+	TypeReject                        // server -> client [reason][queue position (uint16, server full only)]
+	TypeChallenge                     // server -> client [cookie], the client resends its connect request with the cookie
+	TypeDisconnect                    // client -> server, the client is going away (sealed on encrypted connections)
+	TypeKeepalive                     // no body, keeps the connection and any NAT mapping open (sealed on encrypted connections)
+	TypePathChallenge                 // server -> client [challenge (uint64)], sent to a client's new address before following it
+	TypePathResponse                  // client -> server [challenge (uint64)], proves the client receives at its new address
+)
+
+const (
+	ControlHeaderSize = 5  // [protocol id][version][type][flags]
+	ConnectionIDSize  = 8  // [connection id]
+	MaxHeaderSize     = 28 // [protocol id][version][type][flags][connection id][sequence][remote ack][remote bitfield], 5 bytes per uvarint
+)
+
+// AckRepeats is the number of packets that carry an acknowledgement after it changes, so it arrives even if some
+// of those packets are lost.  Receiving a reliable packet again means the remote missed our acknowledgement and
+// starts the repeats over.
+const AckRepeats = 3
+
+var (
+	ErrShortPacket     = errors.New("packet is shorter than its header")
+	ErrBadFlag         = errors.New("packet header has an unknown or invalid flag")
+	ErrUnknownProtocol = errors.New("packet is not an RUDP packet")
+	ErrBadVersion      = errors.New("packet has an unsupported protocol version")
+	ErrUnknownType     = errors.New("packet has an unknown type")
+	ErrBadField        = errors.New("packet header has a field that is too large")
+)
+
+// knownFlags are the flags a data packet can have
+const knownFlags = FlagReliable | FlagCompressed | FlagEncrypted | FlagChecksum | FlagAck | FlagConnection
+
+// controlFlags are the flags a control packet can have
+const controlFlags = FlagEncrypted | FlagConnection
+
+// Header is the header of a packet
+type Header struct {
+	Type    Type
+	Flags   uint8
+	ConnID  uint64 // connection id assigned by the server, with FlagConnection only
+	Seq     uint32 // sequence number, reliable packets only
+	Ack     uint32 // last reliable sequence number received from the remote, with FlagAck only
+	AckBits uint32 // acknowledgements for the 32 reliable packets before Ack, with FlagAck only
+	Size    int    // size of the header in bytes, the payload starts here
+}
+
+func (h Header) Reliable() bool {
+	return h.Flags&FlagReliable != 0
+}
+
+func (h Header) Compressed() bool {
+	return h.Flags&FlagCompressed != 0
+}
+
+func (h Header) Encrypted() bool {
+	return h.Flags&FlagEncrypted != 0
+}
+
+func (h Header) Checksummed() bool {
+	return h.Flags&FlagChecksum != 0
+}
+
+// HasAck returns true if the packet carries acknowledgements
+func (h Header) HasAck() bool {
+	return h.Flags&FlagAck != 0
+}
+
+// HasConnectionID returns true if the packet carries a connection id
+func (h Header) HasConnectionID() bool {
+	return h.Flags&FlagConnection != 0
+}
+
+// Control returns true for packets that are handled by the library and don't carry acknowledgements
+func (h Header) Control() bool {
+	return h.Type != TypeData && h.Type != TypeAck
+}
+
+// Append appends the encoded header to data.  Size is ignored, it follows from the type and flags.
+func (h Header) Append(data []byte) []byte {
+	data = binary.BigEndian.AppendUint16(data, ProtocolID)
+	data = append(data, Version, uint8(h.Type), h.Flags)
+	if h.HasConnectionID() {
+		data = binary.BigEndian.AppendUint64(data, h.ConnID)
+	}
+	if h.Control() {
+		return data
+	}
+	if h.Reliable() {
+		data = binary.AppendUvarint(data, uint64(h.Seq))
+	}
+	if h.HasAck() {
+		data = binary.AppendUvarint(data, uint64(h.Ack))
+		data = binary.AppendUvarint(data, uint64(^h.AckBits))
+	}
+	return data
+}
+
+// ParseHeader parses and validates the header of a received packet
+func ParseHeader(data []byte) (Header, error) {
+	if len(data) < 2 {
+		return Header{}, ErrShortPacket
+	}
+	if binary.BigEndian.Uint16(data) != ProtocolID {
+		return Header{}, ErrUnknownProtocol
+	}
+	if len(data) < 3 {
+		return Header{}, ErrShortPacket
+	}
+	if data[2] != Version {
+		return Header{}, fmt.Errorf("%w %d, expected version %d", ErrBadVersion, data[2], Version)
+	}
+	if len(data) < ControlHeaderSize {
+		return Header{}, ErrShortPacket
+	}
+	h := Header{Type: Type(data[3]), Flags: data[4]}
+	if h.Type < TypeData || h.Type > TypePathResponse {
+		return Header{}, ErrUnknownType
+	}
+	switch {
+	case h.Flags&^knownFlags != 0:
+		return Header{}, ErrBadFlag
+	case h.Control() && h.Flags&^controlFlags != 0:
+		// control packets are never acknowledged, compressed or checksummed
+		return Header{}, ErrBadFlag
+	case h.Type == TypeAck && (h.Flags&(FlagReliable|FlagCompressed) != 0 || !h.HasAck()):
+		// acks have no payload to deliver reliably or compress, only acknowledgements
+		return Header{}, ErrBadFlag
+	}
+	h.Size = ControlHeaderSize
+	if h.HasConnectionID() {
+		if len(data) < h.Size+ConnectionIDSize {
+			return Header{}, ErrShortPacket
+		}
+		h.ConnID = binary.BigEndian.Uint64(data[h.Size:])
+		h.Size += ConnectionIDSize
+	}
+	if !h.Control() {
+		var err error
+		if h.Reliable() {
+			if h.Seq, err = uvarint32(data, &h.Size); err != nil {
+				return Header{}, err
+			}
+		}
+		if h.HasAck() {
+			if h.Ack, err = uvarint32(data, &h.Size); err != nil {
+				return Header{}, err
+			}
+			if h.AckBits, err = uvarint32(data, &h.Size); err != nil {
+				return Header{}, err
+			}
+			h.AckBits = ^h.AckBits
+		}
+	}
+	if h.Checksummed() && len(data) < h.Size+ChecksumSize {
+		return Header{}, ErrShortPacket
+	}
+	return h, nil
+}
+
+// uvarint32 reads the uvarint at data[*index] and moves index past it
+func uvarint32(data []byte, index *int) (uint32, error) {
+	v, n := binary.Uvarint(data[*index:])
+	switch {
+	case n == 0:
+		return 0, ErrShortPacket
+	case n < 0 || v > 0xffffffff:
+		return 0, ErrBadField
+	}
+	*index += n
+	return uint32(v), nil
+}
@@ -0,0 +1,172 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestRUDP_ParseHeader(t *testing.T) {
+	data := func(h Header, extra ...byte) []byte {
+		return append(h.Append(nil), extra...)
+	}
+	reliable := data(Header{Type: TypeData, Flags: FlagReliable | FlagAck, Seq: 300, Ack: 1, AckBits: 0xffffffff})
+	tests := []struct {
+		name string
+		data []byte
+		size int
+		err  error
+	}{
+		{"empty", []byte{}, 0, ErrShortPacket},
+		{"one byte", []byte{0x52}, 0, ErrShortPacket},
+		{"stray udp", []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13}, 0, ErrUnknownProtocol},
+		{"protocol id only", []byte{0x52, 0x55}, 0, ErrShortPacket},
+		{"other version", []byte{0x52, 0x55, Version + 1, uint8(TypeData), 0}, 0, ErrBadVersion},
+		{"no type", []byte{0x52, 0x55, Version}, 0, ErrShortPacket},
+		{"unknown type", []byte{0x52, 0x55, Version, 0, 0}, 0, ErrUnknownType},
+		{"type after path response", []byte{0x52, 0x55, Version, uint8(TypePathResponse) + 1, 0}, 0, ErrUnknownType},
+		{"no flags", []byte{0x52, 0x55, Version, uint8(TypeData)}, 0, ErrShortPacket},
+		{"unreliable", data(Header{Type: TypeData}), ControlHeaderSize, nil},
+		{"unreliable with ack", data(Header{Type: TypeData, Flags: FlagAck, Ack: 1, AckBits: 0xffffffff}), ControlHeaderSize + 2, nil},
+		{"ack with missing packets", data(Header{Type: TypeData, Flags: FlagAck, Ack: 1, AckBits: 0xfffffffe}), ControlHeaderSize + 2, nil},
+		{"ack with nothing before it", data(Header{Type: TypeData, Flags: FlagAck, Ack: 1}), ControlHeaderSize + 1 + 5, nil},
+		{"short reliable", reliable[:len(reliable)-1], 0, ErrShortPacket},
+		{"reliable", reliable, ControlHeaderSize + 2 + 1 + 1, nil},
+		{"no sequence", data(Header{Type: TypeData, Flags: FlagReliable})[:ControlHeaderSize], 0, ErrShortPacket},
+		{"sequence too large", []byte{0x52, 0x55, Version, uint8(TypeData), FlagReliable, 0xff, 0xff, 0xff, 0xff, 0x7f}, 0, ErrBadField},
+		{"compressed encrypted", data(Header{Type: TypeData, Flags: FlagCompressed | FlagEncrypted}, 1), ControlHeaderSize, nil},
+		{"unknown flag", data(Header{Type: TypeData, Flags: 1 << 6}), 0, ErrBadFlag},
+		{"connection id", data(Header{Type: TypeData, Flags: FlagConnection, ConnID: 1}), ControlHeaderSize + ConnectionIDSize, nil},
+		{"short connection id", data(Header{Type: TypeData, Flags: FlagConnection})[:ControlHeaderSize+ConnectionIDSize-1], 0, ErrShortPacket},
+		{"control with connection id", data(Header{Type: TypePathResponse, Flags: FlagConnection | FlagEncrypted}), ControlHeaderSize + ConnectionIDSize, nil},
+		{"checksummed", data(Header{Type: TypeData, Flags: FlagChecksum}, 0, 0, 0, 0), ControlHeaderSize, nil},
+		{"checksummed without checksum", data(Header{Type: TypeData, Flags: FlagChecksum}, 0, 0, 0), 0, ErrShortPacket},
+		{"ack", data(Header{Type: TypeAck, Flags: FlagAck, AckBits: 0xffffffff}), ControlHeaderSize + 2, nil},
+		{"ack without acknowledgements", data(Header{Type: TypeAck}), 0, ErrBadFlag},
+		{"checksummed ack", data(Header{Type: TypeAck, Flags: FlagAck | FlagChecksum, AckBits: 0xffffffff}, 0, 0, 0, 0), ControlHeaderSize + 2, nil},
+		{"reliable ack", data(Header{Type: TypeAck, Flags: FlagAck | FlagReliable}), 0, ErrBadFlag},
+		{"control", data(Header{Type: TypeConnect}, 1), ControlHeaderSize, nil},
+		{"compressed control", data(Header{Type: TypeReject, Flags: FlagCompressed}), 0, ErrBadFlag},
+		{"checksummed control", data(Header{Type: TypeKeepalive, Flags: FlagChecksum}, 0, 0, 0, 0), 0, ErrBadFlag},
+		{"encrypted disconnect", data(Header{Type: TypeDisconnect, Flags: FlagEncrypted}), ControlHeaderSize, nil},
+	}
+	for _, test := range tests {
+		h, err := ParseHeader(test.data)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error %v, expected %v", test.name, err, test.err)
+			continue
+		}
+		if h.Size != test.size {
+			t.Errorf("%s: got header size %d, expected %d", test.name, h.Size, test.size)
+		}
+	}
+}
+
+func TestRUDP_HeaderRoundTrip(t *testing.T) {
+	for _, sent := range []Header{
+		{Type: TypeData, Flags: FlagReliable | FlagAck, Seq: 7, Ack: 5, AckBits: 3},
+		{Type: TypeData, Flags: FlagReliable | FlagAck, Seq: 0xffffffff, Ack: 0xfffffffe, AckBits: 0xffffffff},
+		{Type: TypeData, Flags: FlagReliable, Seq: 1 << 20},
+		{Type: TypeAck, Flags: FlagAck, Ack: 128, AckBits: 1 << 31},
+		{Type: TypeData, Flags: FlagConnection | FlagReliable | FlagAck, ConnID: 0xfedcba9876543210, Seq: 0xffffffff, Ack: 0xffffffff, AckBits: 0xffffffff},
+		{Type: TypeKeepalive, Flags: FlagConnection, ConnID: 1},
+	} {
+		data := sent.Append(nil)
+		if len(data) > MaxHeaderSize {
+			t.Errorf("header %+v is %d bytes, more than MaxHeaderSize", sent, len(data))
+		}
+		h, err := ParseHeader(append(data, 42))
+		if err != nil {
+			t.Fatalf("failed to parse header %+v: %v", sent, err)
+		}
+		h.Size = 0
+		if h != sent {
+			t.Errorf("header did not round trip, sent %+v received %+v", sent, h)
+		}
+	}
+}
+
+func TestRUDP_Checksum(t *testing.T) {
+	data := AppendChecksum(append(Header{Type: TypeData, Flags: FlagChecksum}.Append(nil), 1, 2, 3))
+	packet, err := VerifyChecksum(data)
+	if err != nil || len(packet) != len(data)-ChecksumSize {
+		t.Fatalf("failed to verify checksum: %v", err)
+	}
+	// flip every bit in turn, CRC32C catches all single bit errors
+	for i := 0; i < len(data)*8; i++ {
+		data[i/8] ^= 1 << (i % 8)
+		if _, err := VerifyChecksum(data); err != ErrBadChecksum {
+			t.Fatalf("bit %d flipped but the checksum matched", i)
+		}
+		data[i/8] ^= 1 << (i % 8)
+	}
+	if _, err := VerifyChecksum([]byte{1, 2, 3}); err != ErrShortPacket {
+		t.Error("expected a short packet")
+	}
+}
+
+// appendBaselineHeader appends the header of the original wire format, before protocol ids and packet types:
+// [reliable (uint8)][sequence (uint32, reliable only)][remote ack (uint32)][remote ack bits (uint32)].  Every
+// packet carried the acknowledgements.
+func appendBaselineHeader(data []byte, reliable bool, seq uint32, ack uint32, bits uint32) []byte {
+	if !reliable {
+		data = append(data, 0)
+	} else {
+		data = append(data, 1)
+		data = binary.BigEndian.AppendUint32(data, seq)
+	}
+	data = binary.BigEndian.AppendUint32(data, ack)
+	return binary.BigEndian.AppendUint32(data, bits)
+}
+
+// BenchmarkRUDP_HeaderSize compares the header of the original wire format with the compact header over a ten
+// minute session at 60 packets per second, the sender follows the AckRepeats rule like the client and server do
+func BenchmarkRUDP_HeaderSize(b *testing.B) {
+	const session = 60 * 60 * 10
+	every := func(n int) func(int) bool {
+		return func(i int) bool { return n > 0 && i%n == 0 }
+	}
+	scenarios := []struct {
+		name     string
+		reliable func(i int) bool // packet i is reliable
+		received func(i int) bool // a reliable packet arrived from the remote before packet i was sent
+	}{
+		{"unreliable snapshots", every(0), every(0)},
+		{"snapshots with events every 30th packet", every(30), every(30)},
+		{"reliable both ways", every(1), every(1)},
+	}
+	for _, scenario := range scenarios {
+		b.Run(scenario.name, func(b *testing.B) {
+			data := make([]byte, 0, MaxHeaderSize)
+			before, after := 0, 0
+			for n := 0; n < b.N; n++ {
+				seq, remote := uint32(0), ^uint32(0)
+				bits := Ack{}
+				repeats := 0
+				for i := 0; i < session; i++ {
+					if scenario.received(i) {
+						remote = UpdateAcknowledgements(remote+1, remote, &bits)
+						repeats = AckRepeats
+					}
+					h := Header{Type: TypeData}
+					if scenario.reliable(i) {
+						h.Flags |= FlagReliable
+						h.Seq = seq
+						seq++
+					}
+					if repeats > 0 {
+						h.Flags |= FlagAck
+						h.Ack, h.AckBits = remote, bits.Data
+						repeats--
+					}
+					data = h.Append(data[:0])
+					after += len(data)
+					data = appendBaselineHeader(data[:0], h.Reliable(), h.Seq, remote, bits.Data)
+					before += len(data)
+				}
+			}
+			b.ReportMetric(float64(before)/float64(b.N*session), "before-bytes/packet")
+			b.ReportMetric(float64(after)/float64(b.N*session), "after-bytes/packet")
+		})
+	}
+}
@@ -1,5 +1,28 @@
 package packet
 
+// Header flags, byte 4 of every packet
+const (
+	FlagReliable   uint8 = 1 << 0 // the packet has a sequence number and will be acknowledged
+	FlagCompressed uint8 = 1 << 1 // the payload was compressed with the codec agreed at connection setup
+	FlagEncrypted  uint8 = 1 << 2 // the payload is encrypted and the header authenticated with the session keys
+	FlagChecksum   uint8 = 1 << 3 // the packet ends with a CRC32C of the header and payload
+	FlagAck        uint8 = 1 << 4 // the header has the remote ack and bits
+	FlagConnection uint8 = 1 << 5 // the header has the connection id the server assigned the client
+)
+
+// Connection options, requested in the connect packet and confirmed in the accept packet
+const (
+	OptionChecksum uint8 = 1 << 0 // data and ack packets carry a checksum, see AppendChecksum
+)
+
+// Reasons the server rejects a connect request
+const (
+	RejectEncryptionRequired uint8 = 1 // the server only accepts encrypted connections
+	RejectServerFull         uint8 = 2 // the server has reached its maximum number of connections
+	RejectBadVersion         uint8 = 3 // the client uses another protocol version, sent with the server's version
+	RejectResume             uint8 = 4 // the connection the client tried to resume is gone or the proof was wrong
+)
+
 type Ack struct {
 	Data uint32
 }
@@ -53,6 +76,38 @@ func UpdateAcknowledgements(seq uint32, remote uint32, bitfield *Ack) uint32 {
 	return remote
 }
 
+// AckWindow is the number of reliable packets before the last one received that an ack covers, older packets
+// can't be acknowledged anymore
+const AckWindow = 32
+
+// IsDuplicate returns true if the reliable packet seq was already received, going by the last sequence number
+// received (remote) and the acknowledgements before it.  Packets older than the ack window are never duplicates.
+func IsDuplicate(seq uint32, remote uint32, bitfield Ack) bool {
+	if remote == ^uint32(0) {
+		// nothing received yet
+		return false
+	}
+	behind := int32(remote - seq)
+	return behind == 0 || (behind > 0 && behind <= AckWindow && bitfield.Has(uint32(behind)-1))
+}
+
+// LeftWindow returns how many of the unverified reliable packets an ack for seq moves out of the ack window, they
+// can't be acknowledged anymore.  newest is the newest ack received before, ^uint32(0) for none, packets it already
+// moved out aren't counted again.
+func LeftWindow(unverified []uint32, newest uint32, seq uint32) int {
+	if newest != ^uint32(0) && int32(seq-newest) <= 0 {
+		// an older ack arriving late moves nothing
+		return 0
+	}
+	count := 0
+	for _, u := range unverified {
+		if int32(seq-u) > AckWindow && (newest == ^uint32(0) || int32(newest-u) <= AckWindow) {
+			count++
+		}
+	}
+	return count
+}
+
 // Assumption: n >= 0
 func PowInts(x, n uint32) uint32 {
 	if n == 0 {
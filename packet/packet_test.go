@@ -103,3 +103,75 @@ func TestRUDP_PowInt(t *testing.T) {
 		t.Error("PowInts failed 2^7=128")
 	}
 }
+
+func TestRUDP_ConnectMarshal(t *testing.T) {
+	c := Connect{Codecs: []uint8{1, 2}, Key: make([]byte, 32), Token: []byte{9, 9, 9}, Cookie: []byte{7}, Options: OptionChecksum, Resume: []byte{1, 2}}
+	data := c.Marshal()
+	if h, err := ParseHeader(data); err != nil || h.Type != TypeConnect {
+		t.Error("Connect packet has the wrong header")
+	}
+	parsed, err := ParseConnect(data[ControlHeaderSize:])
+	if err != nil {
+		t.Fatalf("Failed to parse connect: %s", err)
+	}
+	if len(parsed.Codecs) != 2 || len(parsed.Key) != 32 || len(parsed.Token) != 3 || len(parsed.Cookie) != 1 || parsed.Options != OptionChecksum || len(parsed.Resume) != 2 {
+		t.Errorf("Connect did not round trip: %+v", parsed)
+	}
+
+	// small requests are padded
+	data = Connect{}.Marshal()
+	if len(data) != MinConnectSize {
+		t.Errorf("Expected connect request padded to %d bytes, received %d", MinConnectSize, len(data))
+	}
+	if _, err := ParseConnect(data[ControlHeaderSize:]); err != nil {
+		t.Error("Failed to parse padded connect")
+	}
+	// requests with a key are padded to fit the encrypted accept
+	if data = (Connect{Key: make([]byte, 32)}).Marshal(); len(data) != MinEncryptedConnectSize {
+		t.Errorf("Expected encrypted connect request padded to %d bytes, received %d", MinEncryptedConnectSize, len(data))
+	}
+	if _, err := ParseConnect([]byte{5, 1}); err != ErrMalformedConnect {
+		t.Error("Expected malformed connect")
+	}
+	if _, err := ParseConnect([]byte{0, 0, 0, 5, 1}); err != ErrMalformedConnect {
+		t.Error("Expected malformed connect for a short token")
+	}
+}
+
+func TestRUDP_IsDuplicate(t *testing.T) {
+	remote_seq := ^uint32(0)
+	bitfield := Ack{Data: 0}
+	if IsDuplicate(0, remote_seq, bitfield) {
+		t.Error("nothing received yet but packet 0 is a duplicate")
+	}
+	for _, seq := range []uint32{0, 1, 3, 20} {
+		remote_seq = UpdateAcknowledgements(seq, remote_seq, &bitfield)
+	}
+	tests := map[uint32]bool{20: true, 19: false, 3: true, 2: false, 0: true, 21: false}
+	for seq, duplicate := range tests {
+		if IsDuplicate(seq, remote_seq, bitfield) != duplicate {
+			t.Errorf("IsDuplicate(%d) = %v, expected %v", seq, !duplicate, duplicate)
+		}
+	}
+	// packets that fell out of the ack window can't be told apart
+	remote_seq = UpdateAcknowledgements(40, remote_seq, &bitfield)
+	if IsDuplicate(3, remote_seq, bitfield) {
+		t.Error("packet 3 is older than the ack window but reported as a duplicate")
+	}
+}
+
+func TestRUDP_LeftWindow(t *testing.T) {
+	unverified := []uint32{0, 1, 2, 30, 40}
+	if n := LeftWindow(unverified, ^uint32(0), 34); n != 2 {
+		t.Errorf("the first ack for 34 moved %d packets out of the window, expected 0 and 1", n)
+	}
+	if n := LeftWindow(unverified, 34, 34); n != 0 {
+		t.Errorf("the same ack again moved %d packets out of the window", n)
+	}
+	if n := LeftWindow(unverified, 34, 20); n != 0 {
+		t.Errorf("an older ack moved %d packets out of the window", n)
+	}
+	if n := LeftWindow(unverified, 34, 70); n != 2 {
+		t.Errorf("the ack for 70 moved %d packets out of the window, expected 2 and 30", n)
+	}
+}
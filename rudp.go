@@ -11,50 +11,143 @@ import (
 
 /*
 *	RUDP - Reliable UDP
-*	Packet Structure  [Reliable Flag][Sequence number][remote ack][remote bitwise][Payload]
-*		Reliable flag - 0 for unreliable, 1 for reliable
-*		Sequence number - if reliable then a unique sequencial number is added to each packet
-*		Remote Ack - the last received sequence number from the remote connection
-*		Remote bitwise - acks for the last 32 remote packets
-*		Payload - User provided payload
+*	Packet Structure  [Protocol id][Version][Type][Flags][Connection id][Sequence number][Remote ack][Remote ack bits][Payload][Checksum]
+*		Protocol id - 0x5255 ("RU"), tells RUDP packets apart from stray UDP traffic (uint16)
+*		Version - wire format version, peers with different versions can't talk to each other
+*		Type - data, ack or one of the control packets (connect, accept, reject, keepalive, ...)
+*		Flags - reliable, compressed, encrypted, checksum, ack and connection id flags
+*		Connection id - id the server assigned the client, only with the connection id flag (uint64)
+*		Sequence number - unique sequential number of the packet, only if reliable (uvarint)
+*		Remote ack - the last reliable sequence number received from the remote, only with the ack flag (uvarint)
+*		Remote ack bits - acks for the 32 reliable packets before the remote ack, inverted so a set bit is a missing packet, only with the ack flag (uvarint)
+*		Payload - user provided payload, compressed with the codec agreed on connect if the flag says so
+*		Checksum - CRC32C of the header and payload, only with the checksum flag (uint32)
+*	Control packets carry their own body after the flags and connection id, see package packet.  Encrypted packets
+*	have a packet number after the header and end with an authentication tag, see package secure.
  */
 
-func Listen(network string, host string, port uint16) (*server.RUDPServer, error) {
-	switch network {
+// ListenConfig configures a server listening on one or more addresses
+type ListenConfig struct {
+	Network   string   // "udp", "udp4" or "udp6"
+	Addresses []string // host:port addresses to bind, e.g. "0.0.0.0:8000" and "[::]:8000" for both address families
+	Options   []Option // buffer sizes, socket options, timeouts and logging, validated by Listen
+}
+
+// Listen binds a socket for every address and returns one server for all of them.  With the "udp" network IPv6
+// addresses are bound IPv6 only so an IPv4 address can be bound on the same port next to them.
+func (lc ListenConfig) Listen() (*server.RUDPServer, error) {
+	switch lc.Network {
 	case "udp", "udp4", "udp6":
 	default:
 		return nil, errors.New("only udp, udp4, and udp6 network types accepted")
 	}
-	address := host + ":" + strconv.Itoa(int(port))
-	s, err := net.ResolveUDPAddr(network, address)
+	if len(lc.Addresses) == 0 {
+		return nil, errors.New("no addresses to listen on")
+	}
+	config, err := listenConfig(lc.Options)
 	if err != nil {
 		return nil, err
 	}
-	c, err := net.ListenUDP(network, s)
+	rudpconn := server.RUDPServer{}
+	for i, address := range lc.Addresses {
+		s, err := net.ResolveUDPAddr(lc.Network, address)
+		if err != nil {
+			rudpconn.Close()
+			return nil, err
+		}
+		network := lc.Network
+		if network == "udp" && s.IP != nil {
+			network = "udp6"
+			if s.IP.To4() != nil {
+				network = "udp4"
+			}
+		}
+		c, err := net.ListenUDP(network, s)
+		if err != nil {
+			rudpconn.Close()
+			return nil, err
+		}
+		if err := config.setSocketOptions(c); err != nil {
+			c.Close()
+			rudpconn.Close()
+			return nil, err
+		}
+		if i == 0 {
+			rudpconn.Initialize(c, s)
+		} else {
+			rudpconn.AddSocket(c, s)
+		}
+	}
+	config.configureServer(&rudpconn)
+	return &rudpconn, nil
+}
+
+// Listen listens on a single address, see ListenConfig for several
+func Listen(network string, host string, port uint16, options ...Option) (*server.RUDPServer, error) {
+	address := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	return ListenConfig{Network: network, Addresses: []string{address}, Options: options}.Listen()
+}
+
+// ListenPacket runs a server on a socket the caller already has, e.g. one inherited from systemd or an in-memory
+// transport, see server.RUDPServer.Initialize
+func ListenPacket(c net.PacketConn, options ...Option) (*server.RUDPServer, error) {
+	config, err := listenConfig(options)
 	if err != nil {
 		return nil, err
 	}
+	if err := config.setSocketOptions(c); err != nil {
+		return nil, err
+	}
 	rudpconn := server.RUDPServer{}
-	rudpconn.Initialize(c, s)
+	rudpconn.Initialize(c, nil)
+	config.configureServer(&rudpconn)
 	return &rudpconn, nil
 }
 
-func Dial(network string, host string, port uint16) (*client.RUDPClient, error) {
+// DialPacket creates a client for the server at addr on a socket the caller already has, e.g. one shared with a
+// STUN client, see client.RUDPClient.Initialize.  The client keeps the socket when it reconnects unless it is a
+// connected UDP socket, see client.RUDPClient.SetDialer.
+func DialPacket(c net.PacketConn, addr *net.UDPAddr, options ...Option) (*client.RUDPClient, error) {
+	config, err := dialConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.setSocketOptions(c); err != nil {
+		return nil, err
+	}
+	rudpclient := client.RUDPClient{}
+	rudpclient.Initialize(c, addr)
+	config.configureClient(&rudpclient)
+	return &rudpclient, nil
+}
+
+// Dial creates a client for the server at host:port, call Connect on it to connect
+func Dial(network string, host string, port uint16, options ...Option) (*client.RUDPClient, error) {
 	switch network {
 	case "udp", "udp4", "udp6":
 	default:
 		return nil, errors.New("only udp, udp4, and udp6 network types accepted")
 	}
-	address := host + ":" + strconv.Itoa(int(port))
+	config, err := dialConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(int(port)))
 	s, err := net.ResolveUDPAddr(network, address)
 	if err != nil {
 		return nil, err
 	}
-	c, err := net.DialUDP(network, nil, s)
+	// Reconnect dials new sockets the same way
+	dial := func() (net.PacketConn, error) {
+		return config.dialSocket(network, s)
+	}
+	c, err := dial()
 	if err != nil {
 		return nil, err
 	}
 	rudpclient := client.RUDPClient{}
 	rudpclient.Initialize(c, s)
+	rudpclient.SetDialer(dial)
+	config.configureClient(&rudpclient)
 	return &rudpclient, nil
 }
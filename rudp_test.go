@@ -1,16 +1,34 @@
 package rudp
 
 import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/jomstead/go-rudp/client"
+	"github.com/jomstead/go-rudp/clock"
+	"github.com/jomstead/go-rudp/clock/clocktest"
+	"github.com/jomstead/go-rudp/server"
+	"github.com/jomstead/go-rudp/transport"
 )
 
 func TestRUDP_ServerListen(t *testing.T) {
-	socket, _ := Listen("udp4", "127.0.0.1", 8000)
+	t.Parallel()
+	// real sockets, this tests the functions that open them
+	// port 0 lets the system pick a free port, the tests run in parallel
+	socket, err := Listen("udp4", "127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
 	if !socket.IsConnected() {
-		t.Error("Expected socket to be listening on 127.0.0.1:8000")
+		t.Error("Expected socket to be listening on 127.0.0.1")
 	}
 	socket.Close()
-	socket, err := Listen("udp4", "127.0.0::", 8000)
+	socket, err = Listen("udp4", "127.0.0::", 0)
 	if err == nil {
 		t.Error("Expected bad server listen address")
 	}
@@ -20,12 +38,17 @@ func TestRUDP_ServerListen(t *testing.T) {
 }
 
 func TestRUDP_ClientDial(t *testing.T) {
-	socket, _ := Dial("udp4", "127.0.0.1", 8000)
+	t.Parallel()
+	// real sockets, this tests the functions that open them
+	socket, err := Dial("udp4", "127.0.0.1", 8000)
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
 	if !socket.IsConnected() {
 		t.Error("Expected client to connect")
 	}
 	socket.Close()
-	socket, err := Dial("udp4", "127.0.0::", 8000)
+	socket, err = Dial("udp4", "127.0.0::", 8000)
 	if err == nil {
 		t.Error("Expected bad server dial address")
 	}
@@ -40,3 +63,336 @@ func TestRUDP_ClientDial(t *testing.T) {
 		socket.Close()
 	}
 }
+
+func TestRUDP_DialHappyEyeballs(t *testing.T) {
+	t.Parallel()
+	// the server only listens on IPv4, the IPv6 candidate is tried first and fails
+	s, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+	c, _ := net.ListenUDP("udp4", s)
+	s = c.LocalAddr().(*net.UDPAddr)
+	rudpserver := server.RUDPServer{}
+	rudpserver.Initialize(c, s)
+	defer rudpserver.Close()
+	go func() {
+		// handle the connect requests, ReadFromUDP only returns data packets
+		for rudpserver.IsConnected() {
+			rudpserver.ReadFromUDP(make([]byte, 1024))
+		}
+	}()
+	setups := 0
+	rudpclient, candidates, err := DialHappyEyeballs("udp", []string{"127.0.0.1", "::1", "127.0.0.1"}, uint16(s.Port), func(c *client.RUDPClient) {
+		setups++
+	})
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	defer rudpclient.Close()
+	if len(candidates) != 2 || setups > 2 {
+		t.Fatalf("Expected 2 candidates, got %v", candidates)
+	}
+	if !candidates[0].Addr.IP.Equal(net.IPv6loopback) || !candidates[1].Addr.IP.Equal(s.IP) {
+		t.Errorf("Expected the IPv6 candidate first, got %v then %v", candidates[0].Addr, candidates[1].Addr)
+	}
+	if candidates[0].Err == nil || candidates[0].RTT != 0 {
+		t.Errorf("Expected the IPv6 candidate to fail, got RTT %v and error %v", candidates[0].RTT, candidates[0].Err)
+	}
+	if candidates[1].Err != nil || candidates[1].RTT <= 0 || candidates[1].RTT != rudpclient.HandshakeRTT() {
+		t.Errorf("Expected the IPv4 candidate to connect, got RTT %v and error %v", candidates[1].RTT, candidates[1].Err)
+	}
+
+	// no candidate for the network
+	if _, _, err := DialHappyEyeballs("udp6", []string{"127.0.0.1"}, uint16(s.Port), nil); err == nil {
+		t.Error("Expected an error without IPv6 candidates")
+	}
+
+}
+
+func TestRUDP_DialHappyEyeballsStagger(t *testing.T) {
+	t.Parallel()
+	// a silent IPv6 endpoint holds its candidate up, the IPv4 candidate starts once the clock passes the stagger
+	fake := clocktest.NewFake(time.Time{})
+	hub := transport.NewHub()
+	hub.SetClock(fake)
+	silent, _ := hub.ListenPacket("[fd00::1]:9000")
+	defer silent.Close()
+	c, _ := hub.ListenPacket("10.0.0.1:9000")
+	rudpserver := server.RUDPServer{}
+	rudpserver.Initialize(c, nil)
+	defer rudpserver.Close()
+	go func() {
+		// handle the connect requests, ReadFromUDP only returns data packets
+		for rudpserver.IsConnected() {
+			rudpserver.ReadFromUDP(make([]byte, 1024))
+		}
+	}()
+	dialed := make(chan *net.UDPAddr, 2)
+	dial := PacketDialer(func(network string, addr *net.UDPAddr) (net.PacketConn, error) {
+		dialed <- addr
+		if addr.IP.To4() == nil {
+			return hub.ListenPacket("[fd00::2]:0")
+		}
+		return hub.ListenPacket("10.0.0.2:0")
+	})
+	type result struct {
+		client     *client.RUDPClient
+		candidates []Candidate
+		err        error
+	}
+	done := make(chan result)
+	settling := settleClock{fake, make(chan struct{}, 1)}
+	go func() {
+		rudpclient, candidates, err := DialHappyEyeballs("udp", []string{"fd00::1", "10.0.0.1"}, 9000, nil, dial, Clock(settling), ConnectRetry(1, time.Second))
+		done <- result{rudpclient, candidates, err}
+	}()
+
+	if addr := <-dialed; addr.IP.To4() != nil {
+		t.Fatalf("Expected the IPv6 candidate first, dialed %v", addr)
+	}
+	// the IPv6 candidate's connect timeout and the stagger
+	fake.BlockUntil(2)
+	fake.Advance(DialStagger - time.Millisecond)
+	select {
+	case addr := <-dialed:
+		t.Fatalf("Dialed %v before the stagger", addr)
+	default:
+	}
+	fake.Advance(time.Millisecond)
+	if addr := <-dialed; addr.IP.To4() == nil {
+		t.Fatalf("Expected the IPv4 candidate after the stagger, dialed %v", addr)
+	}
+	// the IPv4 candidate connected, the IPv6 one is still connecting when the wait for it runs out
+	<-settling.settling
+	select {
+	case r := <-done:
+		t.Fatalf("Returned before the wait for the other candidates, got %v", r.candidates)
+	default:
+	}
+	fake.Advance(DialSettle)
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("Failed to dial: %s", r.err)
+	}
+	defer r.client.Close()
+	if len(r.candidates) != 2 || !errors.Is(r.candidates[0].Err, ErrOtherCandidate) || r.candidates[0].RTT != 0 || r.candidates[1].Err != nil {
+		t.Errorf("Expected the IPv6 candidate to be abandoned, got %v", r.candidates)
+	}
+	// let the abandoned candidate give up
+	fake.Advance(time.Second)
+}
+
+func TestRUDP_DialHappyEyeballsLate(t *testing.T) {
+	t.Parallel()
+	// the IPv6 server only answers once the IPv4 candidate connected, its RTT is still reported
+	fake := clocktest.NewFake(time.Time{})
+	hub := transport.NewHub()
+	hub.SetClock(fake)
+	c6, _ := hub.ListenPacket("[fd00::1]:9000")
+	late := server.RUDPServer{}
+	late.Initialize(c6, nil)
+	defer late.Close()
+	c4, _ := hub.ListenPacket("10.0.0.1:9000")
+	rudpserver := server.RUDPServer{}
+	rudpserver.Initialize(c4, nil)
+	defer rudpserver.Close()
+	serve := func(s *server.RUDPServer) {
+		// handle the connect requests, ReadFromUDP only returns data packets
+		for s.IsConnected() {
+			s.ReadFromUDP(make([]byte, 1024))
+		}
+	}
+	go serve(&rudpserver)
+	dial := PacketDialer(func(network string, addr *net.UDPAddr) (net.PacketConn, error) {
+		if addr.IP.To4() == nil {
+			return hub.ListenPacket("[fd00::2]:0")
+		}
+		return hub.ListenPacket("10.0.0.2:0")
+	})
+	type result struct {
+		client     *client.RUDPClient
+		candidates []Candidate
+		err        error
+	}
+	done := make(chan result)
+	settling := settleClock{fake, make(chan struct{}, 1)}
+	go func() {
+		rudpclient, candidates, err := DialHappyEyeballs("udp", []string{"fd00::1", "10.0.0.1"}, 9000, nil, dial, Clock(settling), ConnectRetry(1, time.Second))
+		done <- result{rudpclient, candidates, err}
+	}()
+
+	// the IPv6 candidate's connect timeout and the stagger
+	fake.BlockUntil(2)
+	fake.Advance(DialStagger)
+	<-settling.settling
+	go serve(&late)
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("Failed to dial: %s", r.err)
+	}
+	defer r.client.Close()
+	if len(r.candidates) != 2 || r.candidates[1].Err != nil {
+		t.Fatalf("Expected the IPv4 candidate to be chosen, got %v", r.candidates)
+	}
+	// the IPv6 connect request waited for the stagger
+	if !errors.Is(r.candidates[0].Err, ErrOtherCandidate) || r.candidates[0].RTT != DialStagger {
+		t.Errorf("Expected the IPv6 candidate to connect late with RTT %v, got RTT %v and error %v", DialStagger, r.candidates[0].RTT, r.candidates[0].Err)
+	}
+}
+
+// settleClock tells when DialHappyEyeballs starts waiting for the other candidates
+type settleClock struct {
+	*clocktest.Fake
+	settling chan struct{}
+}
+
+func (c settleClock) NewTimer(d time.Duration) clock.Timer {
+	t := c.Fake.NewTimer(d)
+	if d == DialSettle {
+		select {
+		case c.settling <- struct{}{}:
+		default:
+		}
+	}
+	return t
+}
+
+func TestRUDP_ListenConfigDualStack(t *testing.T) {
+	t.Parallel()
+	// real sockets, this tests the functions that open them
+	rudpserver, err := ListenConfig{Network: "udp", Addresses: []string{"127.0.0.1:0", "[::1]:0"}}.Listen()
+	if err != nil {
+		t.Skipf("No IPv6 loopback: %s", err)
+	}
+	defer rudpserver.Close()
+	addrs := rudpserver.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf("Expected 2 sockets, got %v", addrs)
+	}
+	// nothing arrives before the deadline
+	rudpserver.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	var netErr net.Error
+	if _, _, _, err := rudpserver.ReadFromUDP(make([]byte, 1024)); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	rudpserver.SetReadDeadline(time.Now().Add(time.Second))
+
+	for i, addr := range addrs {
+		c, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			t.Fatalf("Failed to dial %v: %s", addr, err)
+		}
+		rudpclient := client.RUDPClient{}
+		rudpclient.Initialize(c, addr)
+		defer rudpclient.Close()
+		payload := []byte{uint8(i)}
+		rudpclient.Write(&payload, true)
+		temp := make([]byte, 1024)
+		n, _, from, err := rudpserver.ReadFromUDP(temp)
+		if err != nil || n != 1 || temp[0] != uint8(i) || *from != c.LocalAddr().(*net.UDPAddr).AddrPort() {
+			t.Fatalf("Expected the packet from %v, got %v from %v and error %v", c.LocalAddr(), temp[:n], from, err)
+		}
+		// the answer goes out the socket the client sent to, a connected client only accepts it from there
+		rudpserver.WriteToUDP(&payload, *from, true)
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if n, _, _, err = rudpclient.ReadFromUDP(temp); err != nil || n != 1 {
+			t.Errorf("Expected the answer from %v, got error %v", addr, err)
+		}
+	}
+	if rudpserver.ConnectionCount() != 2 {
+		t.Errorf("Expected both clients in one connection table, got %d", rudpserver.ConnectionCount())
+	}
+}
+
+func TestRUDP_Options(t *testing.T) {
+	t.Parallel()
+	// real sockets, this tests the functions that open them
+	invalid := [][]Option{
+		{ReceiveBuffer(16)},
+		{ReceiveBuffer(1 << 20)},
+		{UnverifiedCapacity(-1)},
+		{SocketBuffers(-1, 0)},
+		{DSCP(64)},
+		{Timeout(0, time.Second)},
+		{ConnectRetry(1, time.Second)}, // clients only
+		{PacketDialer(func(string, *net.UDPAddr) (net.PacketConn, error) { return nil, nil })},
+	}
+	for i, options := range invalid {
+		if server, err := Listen("udp4", "127.0.0.1", 0, options...); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("Expected options %d to be invalid, got %v", i, err)
+			if server != nil {
+				server.Close()
+			}
+		}
+	}
+	if _, err := Dial("udp4", "127.0.0.1", 8000, ConnectRetry(0, time.Second)); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected 0 connect attempts to be invalid, got %v", err)
+	}
+	if _, err := Dial("udp4", "127.0.0.1", 8000, Timeout(time.Second, 0)); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected Timeout to be invalid for clients, got %v", err)
+	}
+
+	// a server that receives larger packets than the default buffer
+	var logs bytes.Buffer
+	rudpserver, err := Listen("udp4", "127.0.0.1", 0, ReceiveBuffer(4096), UnverifiedCapacity(4), SocketBuffers(1<<16, 1<<16), DSCP(46), Logger(log.New(&logs, "", 0)))
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer rudpserver.Close()
+	addr := rudpserver.Addrs()[0]
+	rudpclient, err := Dial("udp4", "127.0.0.1", uint16(addr.Port), ReceiveBuffer(4096), ConnectRetry(2, 100*time.Millisecond), DSCP(46))
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	defer rudpclient.Close()
+	done := make(chan error)
+	go func() {
+		done <- rudpclient.Connect()
+	}()
+	temp := make([]byte, 4096)
+	rudpserver.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	rudpserver.ReadFromUDP(temp)
+	if err := <-done; err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if !strings.Contains(logs.String(), "connected") {
+		t.Errorf("Expected the connection to be logged, got %q", logs.String())
+	}
+	payload := bytes.Repeat([]byte{7}, 2000)
+	rudpclient.Write(&payload, true)
+	rudpserver.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, _, err := rudpserver.ReadFromUDP(temp); err != nil || n != len(payload) {
+		t.Errorf("Expected a %d byte payload, got %d and error %v", len(payload), n, err)
+	}
+}
+
+func TestRUDP_ListenPacket(t *testing.T) {
+	t.Parallel()
+	hub := transport.NewHub()
+	c, _ := hub.ListenPacket("10.0.0.1:9000")
+	if _, err := ListenPacket(c, DSCP(46)); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected socket options to need a UDP socket, got %v", err)
+	}
+	rudpserver, err := ListenPacket(c, ReceiveBuffer(2048))
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer rudpserver.Close()
+	if addrs := rudpserver.Addrs(); len(addrs) != 1 || addrs[0].AddrPort() != c.AddrPort() {
+		t.Errorf("Expected the server on %v, got %v", c.LocalAddr(), addrs)
+	}
+
+	cc, _ := hub.ListenPacket("10.0.0.2:0")
+	if _, err := DialPacket(cc, rudpserver.Addrs()[0], SocketBuffers(1<<16, 0)); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected socket buffers to need a UDP socket, got %v", err)
+	}
+	rudpclient, err := DialPacket(cc, rudpserver.Addrs()[0])
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	defer rudpclient.Close()
+	payload := []byte{1}
+	rudpclient.Write(&payload, false)
+	rudpserver.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, _, err := rudpserver.ReadFromUDP(make([]byte, 2048)); err != nil || n != 1 {
+		t.Errorf("Expected a packet, got error %v", err)
+	}
+}
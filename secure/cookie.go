@@ -0,0 +1,62 @@
+package secure
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net/netip"
+	"time"
+)
+
+/*
+*	Cookie - stateless proof that a client can receive packets at its source address
+*	Cookie Structure  [Timestamp][MAC]
+*		Timestamp - unix time in seconds the cookie was issued (uint32)
+*		MAC - first 16 bytes of HMAC-SHA256(secret, address | timestamp)
+*	The server sends a cookie to any address it doesn't know and only creates state for the address once the
+*	cookie is echoed back, so spoofed source addresses can't make it allocate anything.
+ */
+
+const CookieSize = 4 + 16
+
+type Cookies struct {
+	secret   []byte
+	lifetime time.Duration
+}
+
+// NewCookies creates a cookie generator with a random secret, cookies are accepted for lifetime after they are issued
+func NewCookies(lifetime time.Duration) (*Cookies, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &Cookies{secret: secret, lifetime: lifetime}, nil
+}
+
+// Generate returns a cookie for addr issued at the time now
+func (c *Cookies) Generate(addr netip.AddrPort, now time.Time) []byte {
+	cookie := make([]byte, 4, CookieSize)
+	binary.BigEndian.PutUint32(cookie, uint32(now.Unix()))
+	return append(cookie, c.mac(addr, cookie[:4])...)
+}
+
+// Verify returns true if the cookie was generated for addr and hasn't expired at the time now
+func (c *Cookies) Verify(cookie []byte, addr netip.AddrPort, now time.Time) bool {
+	if len(cookie) != CookieSize {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint32(cookie)), 0)
+	if now.Sub(issued) > c.lifetime || issued.After(now.Add(time.Second)) {
+		return false
+	}
+	return hmac.Equal(cookie[4:], c.mac(addr, cookie[:4]))
+}
+
+func (c *Cookies) mac(addr netip.AddrPort, timestamp []byte) []byte {
+	mac := hmac.New(sha256.New, c.secret)
+	a, _ := addr.MarshalBinary()
+	mac.Write(a)
+	mac.Write(timestamp)
+	return mac.Sum(nil)[:16]
+}
@@ -0,0 +1,57 @@
+package secure
+
+// ReplayWindowSize is how far behind the newest packet number a packet can arrive and still be accepted
+const ReplayWindowSize = 256
+
+// ReplayWindow is a sliding window anti-replay check like IPsec and DTLS use.  It remembers the highest packet
+// number received and which of the ReplayWindowSize packet numbers before it have been received.
+type ReplayWindow struct {
+	highest uint64
+	started bool
+	seen    [ReplayWindowSize / 64]uint64 // ring of received flags indexed by packet number
+}
+
+// Check returns false if the packet number was already received or is too old to tell
+func (w *ReplayWindow) Check(n uint64) bool {
+	if !w.started || n > w.highest {
+		return true
+	}
+	if w.highest-n >= ReplayWindowSize {
+		return false
+	}
+	return !w.has(n)
+}
+
+// Accept records the packet number as received, only call it once the packet has been authenticated
+func (w *ReplayWindow) Accept(n uint64) {
+	if !w.started {
+		w.started = true
+		w.highest = n
+	} else if n > w.highest {
+		// slide the window forward, clearing the flags of the packet numbers it moves over
+		if n-w.highest >= ReplayWindowSize {
+			w.seen = [ReplayWindowSize / 64]uint64{}
+		} else {
+			for i := w.highest + 1; i < n; i++ {
+				w.clear(i)
+			}
+		}
+		w.highest = n
+	}
+	w.set(n)
+}
+
+func (w *ReplayWindow) has(n uint64) bool {
+	i := n % ReplayWindowSize
+	return w.seen[i/64]&(1<<(i%64)) != 0
+}
+
+func (w *ReplayWindow) set(n uint64) {
+	i := n % ReplayWindowSize
+	w.seen[i/64] |= 1 << (i % 64)
+}
+
+func (w *ReplayWindow) clear(n uint64) {
+	i := n % ReplayWindowSize
+	w.seen[i/64] &^= 1 << (i % 64)
+}
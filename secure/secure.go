@@ -0,0 +1,188 @@
+package secure
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+/*
+*	Secure - authenticated encryption of RUDP packets
+*	Key exchange (during Connect)
+*		client -> server: client ephemeral X25519 public key
+*		server -> client: server static public key, server ephemeral public key, sealed confirmation
+*		Both sides compute DH(client ephemeral, server static) and DH(client ephemeral, server ephemeral) and
+*		derive one AES-256-GCM key per direction from them with HKDF-SHA256.  The static key lets the client
+*		pin the server, the ephemeral key gives forward secrecy.
+*	Sealed packet Structure  [Header][Packet number][Ciphertext][Tag]
+*		Header - the RUDP header, authenticated but not encrypted
+*		Packet number - increases by one for every packet sent in this direction (uint64), used as the nonce
+*		Ciphertext - the encrypted payload
+*		Tag - 16 byte authentication tag over the header, packet number and ciphertext
+*	The receiver rejects packet numbers it has already seen with a sliding replay window, so captured packets
+*	(reliable or unreliable) can't be replayed.
+ */
+
+const (
+	KeySize          = 32 // size of an X25519 public key
+	PacketNumberSize = 8
+	TagSize          = 16
+	Overhead         = PacketNumberSize + TagSize // bytes added to every sealed packet
+)
+
+var (
+	ErrAuthentication    = errors.New("packet failed authentication")
+	ErrReplay            = errors.New("packet number has already been received")
+	ErrServerKeyMismatch = errors.New("server public key does not match the pinned key")
+)
+
+type Session struct {
+	send     cipher.AEAD
+	receive  cipher.AEAD
+	next     uint64       // packet number of the next packet sent
+	window   ReplayWindow // packet numbers received
+	replayed uint64       // packets rejected by the replay window
+}
+
+// GenerateKey creates a new X25519 key, use it once for the server's static key and keep it
+func GenerateKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// ParsePublicKey parses a 32 byte X25519 public key, e.g. a pinned server key from a config file
+func ParsePublicKey(key []byte) (*ecdh.PublicKey, error) {
+	return ecdh.X25519().NewPublicKey(key)
+}
+
+// ServerHandshake computes the server's side of the key exchange from the client's ephemeral public key.
+// It returns the session and the server's ephemeral public key to send back to the client.
+func ServerHandshake(static *ecdh.PrivateKey, client_key []byte) (*Session, *ecdh.PublicKey, error) {
+	client_public, err := ParsePublicKey(client_key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephemeral, err := GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	static_secret, err := static.ECDH(client_public)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephemeral_secret, err := ephemeral.ECDH(client_public)
+	if err != nil {
+		return nil, nil, err
+	}
+	c2s, s2c := deriveKeys(static_secret, ephemeral_secret, client_key, static.PublicKey().Bytes(), ephemeral.PublicKey().Bytes())
+	session, err := newSession(s2c, c2s)
+	return session, ephemeral.PublicKey(), err
+}
+
+// ClientHandshake computes the client's side of the key exchange from the server's static and ephemeral public keys
+func ClientHandshake(ephemeral *ecdh.PrivateKey, server_static []byte, server_ephemeral []byte) (*Session, error) {
+	static_public, err := ParsePublicKey(server_static)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral_public, err := ParsePublicKey(server_ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	static_secret, err := ephemeral.ECDH(static_public)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral_secret, err := ephemeral.ECDH(ephemeral_public)
+	if err != nil {
+		return nil, err
+	}
+	c2s, s2c := deriveKeys(static_secret, ephemeral_secret, ephemeral.PublicKey().Bytes(), server_static, server_ephemeral)
+	return newSession(c2s, s2c)
+}
+
+// deriveKeys derives the client to server and server to client keys with HKDF-SHA256, salted with the public keys
+func deriveKeys(static_secret []byte, ephemeral_secret []byte, client_key []byte, server_static []byte, server_ephemeral []byte) ([]byte, []byte) {
+	transcript := sha256.New()
+	transcript.Write(client_key)
+	transcript.Write(server_static)
+	transcript.Write(server_ephemeral)
+	extract := hmac.New(sha256.New, transcript.Sum(nil))
+	extract.Write(static_secret)
+	extract.Write(ephemeral_secret)
+	prk := extract.Sum(nil)
+	expand := func(label string) []byte {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write([]byte(label))
+		mac.Write([]byte{1})
+		return mac.Sum(nil)
+	}
+	return expand("rudp client to server"), expand("rudp server to client")
+}
+
+func newSession(send_key []byte, receive_key []byte) (*Session, error) {
+	send, err := newAEAD(send_key)
+	if err != nil {
+		return nil, err
+	}
+	receive, err := newAEAD(receive_key)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{send: send, receive: receive}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal appends the next packet number and the encrypted payload to the header, the header and packet number
+// are authenticated as additional data
+func (s *Session) Seal(header []byte, payload []byte) []byte {
+	data := binary.BigEndian.AppendUint64(header, s.next)
+	nonce := nonce(s.next)
+	s.next++
+	return s.send.Seal(data, nonce[:], payload, data)
+}
+
+// Open authenticates the header, packet number and ciphertext and appends the decrypted payload to dst.
+// Packets with a packet number that has already been received are rejected with ErrReplay.
+func (s *Session) Open(dst []byte, header []byte, sealed []byte) ([]byte, error) {
+	if len(sealed) < Overhead {
+		return dst, ErrAuthentication
+	}
+	n := binary.BigEndian.Uint64(sealed)
+	if !s.window.Check(n) {
+		s.replayed++
+		return dst, ErrReplay
+	}
+	// the additional data is the header followed by the packet number
+	ad := make([]byte, 0, len(header)+PacketNumberSize)
+	ad = append(append(ad, header...), sealed[:PacketNumberSize]...)
+	nonce := nonce(n)
+	out, err := s.receive.Open(dst, nonce[:], sealed[PacketNumberSize:], ad)
+	if err != nil {
+		return dst, ErrAuthentication
+	}
+	// only authenticated packets move the window, otherwise forged packet numbers could block real packets
+	s.window.Accept(n)
+	return out, nil
+}
+
+// Replayed returns the number of packets rejected because their packet number had already been received
+func (s *Session) Replayed() uint64 {
+	return s.replayed
+}
+
+func nonce(n uint64) (nonce [12]byte) {
+	binary.BigEndian.PutUint64(nonce[4:], n)
+	return nonce
+}
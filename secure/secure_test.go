@@ -0,0 +1,196 @@
+package secure
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRUDP_SecureHandshake(t *testing.T) {
+	static, _ := GenerateKey()
+	ephemeral, _ := GenerateKey()
+
+	server, server_ephemeral, err := ServerHandshake(static, ephemeral.PublicKey().Bytes())
+	if err != nil {
+		t.Fatalf("Server handshake failed: %s", err)
+	}
+	client, err := ClientHandshake(ephemeral, static.PublicKey().Bytes(), server_ephemeral.Bytes())
+	if err != nil {
+		t.Fatalf("Client handshake failed: %s", err)
+	}
+
+	// client to server
+	header := []byte{1, 2, 3}
+	sealed := client.Seal(append([]byte{}, header...), []byte("hello"))
+	if len(sealed) != len(header)+5+Overhead {
+		t.Errorf("Sealed packet has the wrong size: %d", len(sealed))
+	}
+	plain, err := server.Open(nil, sealed[:3], sealed[3:])
+	if err != nil || !bytes.Equal(plain, []byte("hello")) {
+		t.Error("Server failed to open the client's packet")
+	}
+	// server to client
+	sealed = server.Seal([]byte{4}, []byte("world"))
+	plain, err = client.Open(nil, sealed[:1], sealed[1:])
+	if err != nil || !bytes.Equal(plain, []byte("world")) {
+		t.Error("Client failed to open the server's packet")
+	}
+	// keys are per direction, a packet can't be reflected back to its sender
+	if _, err := server.Open(nil, sealed[:1], sealed[1:]); err == nil {
+		t.Error("Server opened its own packet")
+	}
+}
+
+func TestRUDP_SecureTampering(t *testing.T) {
+	static, _ := GenerateKey()
+	ephemeral, _ := GenerateKey()
+	server, server_ephemeral, _ := ServerHandshake(static, ephemeral.PublicKey().Bytes())
+	client, _ := ClientHandshake(ephemeral, static.PublicKey().Bytes(), server_ephemeral.Bytes())
+
+	sealed := client.Seal([]byte{1, 0, 0, 0, 5}, []byte("payload"))
+	// the header is authenticated
+	tampered := append([]byte{}, sealed...)
+	tampered[4] = 6
+	if _, err := server.Open(nil, tampered[:5], tampered[5:]); err != ErrAuthentication {
+		t.Error("Tampered header was not detected")
+	}
+	// the payload is authenticated
+	tampered = append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := server.Open(nil, tampered[:5], tampered[5:]); err != ErrAuthentication {
+		t.Error("Tampered payload was not detected")
+	}
+	if _, err := server.Open(nil, sealed[:5], sealed[5:10]); err != ErrAuthentication {
+		t.Error("Short packet was not rejected")
+	}
+
+	// a client that used a different server key derives different keys
+	other, _ := GenerateKey()
+	wrong, _ := ClientHandshake(ephemeral, other.PublicKey().Bytes(), server_ephemeral.Bytes())
+	if _, err := wrong.Open(nil, sealed[:5], sealed[5:]); err != ErrAuthentication {
+		t.Error("Keys derived with the wrong server key opened a packet")
+	}
+}
+
+func TestRUDP_SecureCookies(t *testing.T) {
+	cookies, _ := NewCookies(10 * time.Second)
+	now := time.Unix(5000, 0)
+	addr := netip.MustParseAddrPort("1.2.3.4:5000")
+
+	cookie := cookies.Generate(addr, now)
+	if len(cookie) != CookieSize {
+		t.Errorf("Cookie has the wrong size: %d", len(cookie))
+	}
+	if !cookies.Verify(cookie, addr, now.Add(5*time.Second)) {
+		t.Error("Valid cookie was rejected")
+	}
+	if cookies.Verify(cookie, addr, now.Add(11*time.Second)) {
+		t.Error("Expired cookie was accepted")
+	}
+	if cookies.Verify(cookie, netip.MustParseAddrPort("1.2.3.4:5001"), now) {
+		t.Error("Cookie was accepted from another address")
+	}
+	forged := append([]byte{}, cookie...)
+	forged[3]++
+	if cookies.Verify(forged, addr, now) {
+		t.Error("Cookie with a changed timestamp was accepted")
+	}
+	other, _ := NewCookies(10 * time.Second)
+	if other.Verify(cookie, addr, now) {
+		t.Error("Cookie from another server was accepted")
+	}
+}
+
+func TestRUDP_SecureResumeProof(t *testing.T) {
+	ticket, _ := NewTicket()
+	key := []byte{1, 2, 3}
+	proof := ResumeProof(ticket, key)
+	if len(proof) != ProofSize || !VerifyResume(ticket, key, proof) {
+		t.Fatal("Valid proof was rejected")
+	}
+	if VerifyResume(ticket, []byte{1, 2, 4}, proof) {
+		t.Error("Proof was accepted for another key")
+	}
+	other, _ := NewTicket()
+	if VerifyResume(other, key, proof) {
+		t.Error("Proof was accepted for another ticket")
+	}
+	if VerifyResume(nil, key, ResumeProof(nil, key)) {
+		t.Error("Proof was accepted without a ticket")
+	}
+}
+
+func TestRUDP_SecureReplay(t *testing.T) {
+	static, _ := GenerateKey()
+	ephemeral, _ := GenerateKey()
+	server, server_ephemeral, _ := ServerHandshake(static, ephemeral.PublicKey().Bytes())
+	client, _ := ClientHandshake(ephemeral, static.PublicKey().Bytes(), server_ephemeral.Bytes())
+
+	first := client.Seal([]byte{0}, []byte{1})
+	second := client.Seal([]byte{0}, []byte{2})
+	// packets can arrive out of order
+	if _, err := server.Open(nil, second[:1], second[1:]); err != nil {
+		t.Error("Failed to open the second packet")
+	}
+	if _, err := server.Open(nil, first[:1], first[1:]); err != nil {
+		t.Error("Failed to open the first packet after the second")
+	}
+	// but only once
+	if _, err := server.Open(nil, first[:1], first[1:]); err != ErrReplay {
+		t.Error("Replayed packet was accepted")
+	}
+	if _, err := server.Open(nil, second[:1], second[1:]); err != ErrReplay {
+		t.Error("Replayed packet was accepted")
+	}
+	if server.Replayed() != 2 {
+		t.Errorf("Expected 2 replayed packets, received %d", server.Replayed())
+	}
+	// a forged packet number must not move the window
+	forged := append([]byte{}, first...)
+	forged[8] = 0xff
+	if _, err := server.Open(nil, forged[:1], forged[1:]); err != ErrAuthentication {
+		t.Error("Forged packet number was accepted")
+	}
+	third := client.Seal([]byte{0}, []byte{3})
+	if _, err := server.Open(nil, third[:1], third[1:]); err != nil {
+		t.Error("Forged packet number blocked a real packet")
+	}
+}
+
+func TestRUDP_SecureReplayWindow(t *testing.T) {
+	var w ReplayWindow
+	for _, n := range []uint64{5, 3, 10, 4} {
+		if !w.Check(n) {
+			t.Errorf("Packet %d was rejected", n)
+		}
+		w.Accept(n)
+	}
+	for _, n := range []uint64{3, 4, 5, 10} {
+		if w.Check(n) {
+			t.Errorf("Packet %d was accepted twice", n)
+		}
+	}
+	if !w.Check(9) || !w.Check(6) {
+		t.Error("Missing packets inside the window were rejected")
+	}
+	// move the window far ahead
+	w.Accept(10 + ReplayWindowSize)
+	if w.Check(10) {
+		t.Error("Packet older than the window was accepted")
+	}
+	if !w.Check(11) {
+		t.Error("Packet inside the moved window was rejected")
+	}
+	// flags are cleared as the window moves over them
+	var v ReplayWindow
+	v.Accept(1)
+	v.Accept(1 + ReplayWindowSize/2)
+	v.Accept(1 + ReplayWindowSize + 2)
+	if !v.Check(1 + ReplayWindowSize) {
+		t.Error("Stale flag rejected a new packet")
+	}
+	if v.Check(1 + ReplayWindowSize/2) {
+		t.Error("Packet inside the window was accepted twice")
+	}
+}
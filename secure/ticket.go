@@ -0,0 +1,41 @@
+package secure
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+)
+
+/*
+*	Resume ticket - lets a client take its connection back after losing it
+*	The server gives the client a random ticket when it connects (sealed on encrypted connections).  To resume the
+*	client sends its connection id and a proof instead of the ticket itself, so an eavesdropper can't use it.
+*		Proof - HMAC-SHA256(ticket, client ephemeral public key), the key is empty on unencrypted connections
+*	The server issues a new ticket every time the client connects or resumes.
+ */
+
+const (
+	TicketSize = 32
+	ProofSize  = sha256.Size
+)
+
+// NewTicket returns a random resume ticket
+func NewTicket() ([]byte, error) {
+	ticket := make([]byte, TicketSize)
+	if _, err := rand.Read(ticket); err != nil {
+		return nil, err
+	}
+	return ticket, nil
+}
+
+// ResumeProof returns the proof that the client holds ticket, bound to the key it sends in the connect request
+func ResumeProof(ticket []byte, key []byte) []byte {
+	mac := hmac.New(sha256.New, ticket)
+	mac.Write(key)
+	return mac.Sum(nil)
+}
+
+// VerifyResume returns true if proof was made with ticket for key
+func VerifyResume(ticket []byte, key []byte, proof []byte) bool {
+	return len(ticket) == TicketSize && hmac.Equal(proof, ResumeProof(ticket, key))
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Limits are the per source limits the server enforces before it parses a packet, zero disables a limit
+type Limits struct {
+	PacketsPerIP      float64       // packets per second from one IP address
+	PacketsPerSubnet  float64       // packets per second from one subnet
+	ConnectsPerIP     float64       // new connections per second from one IP address
+	ConnectsPerSubnet float64       // new connections per second from one subnet
+	Burst             float64       // seconds worth of packets a source can send at once, 1 if zero
+	BanDuration       time.Duration // how long a source that exceeds a limit is banned, zero only drops the packets over the limit
+	SubnetBitsV4      int           // prefix length of an IPv4 subnet, 24 if zero
+	SubnetBitsV6      int           // prefix length of an IPv6 subnet, 64 if zero
+}
+
+// sweepInterval is how often idle rate limit buckets and expired bans are removed
+const sweepInterval = 10 * time.Second
+
+const (
+	allowed = iota
+	banned
+	limited
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket for the time since it was last used and takes one token from it
+func (b *bucket) take(rate float64, burst float64, now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if full := rate * burst; b.tokens > full {
+		b.tokens = full
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// limiter tracks token buckets and bans per source.  Bans are changed at runtime by the operator while the
+// server is reading so the limiter has its own lock.
+type limiter struct {
+	mu       sync.Mutex
+	limits   Limits
+	packets  map[netip.Prefix]*bucket
+	connects map[netip.Prefix]*bucket
+	bans     map[netip.Prefix]time.Time // ban expiry, zero for permanent bans
+	lengths  map[int]int                // number of bans with each prefix length
+	sweep    time.Time
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		packets:  make(map[netip.Prefix]*bucket),
+		connects: make(map[netip.Prefix]*bucket),
+		bans:     make(map[netip.Prefix]time.Time),
+		lengths:  make(map[int]int),
+	}
+}
+
+func (l *limiter) setLimits(limits Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limits.Burst <= 0 {
+		limits.Burst = 1
+	}
+	if limits.SubnetBitsV4 <= 0 {
+		limits.SubnetBitsV4 = 24
+	}
+	if limits.SubnetBitsV6 <= 0 {
+		limits.SubnetBitsV6 = 64
+	}
+	l.limits = limits
+}
+
+// packet returns whether a packet from addr is allowed, banned or over a limit
+func (l *limiter) packet(addr netip.Addr, now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	addr = addr.Unmap()
+	if now.After(l.sweep) {
+		l.cleanup(now)
+	}
+	if l.isBanned(addr, now) {
+		return banned
+	}
+	return l.take(l.packets, addr, l.limits.PacketsPerIP, l.limits.PacketsPerSubnet, now)
+}
+
+// connect returns whether a new connection from addr is allowed or over a limit
+func (l *limiter) connect(addr netip.Addr, now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.take(l.connects, addr.Unmap(), l.limits.ConnectsPerIP, l.limits.ConnectsPerSubnet, now)
+}
+
+// take takes a token from the buckets for the address and its subnet, banning whichever runs out
+func (l *limiter) take(buckets map[netip.Prefix]*bucket, addr netip.Addr, ip_rate float64, subnet_rate float64, now time.Time) int {
+	host := netip.PrefixFrom(addr, addr.BitLen())
+	if ip_rate > 0 && !l.bucket(buckets, host, ip_rate, now).take(ip_rate, l.limits.Burst, now) {
+		l.banFor(host, now)
+		return limited
+	}
+	if subnet_rate > 0 {
+		subnet := l.subnet(addr)
+		if !l.bucket(buckets, subnet, subnet_rate, now).take(subnet_rate, l.limits.Burst, now) {
+			l.banFor(subnet, now)
+			return limited
+		}
+	}
+	return allowed
+}
+
+func (l *limiter) bucket(buckets map[netip.Prefix]*bucket, key netip.Prefix, rate float64, now time.Time) *bucket {
+	b := buckets[key]
+	if b == nil {
+		// new sources start with a full bucket
+		b = &bucket{tokens: rate * l.limits.Burst, last: now}
+		buckets[key] = b
+	}
+	return b
+}
+
+func (l *limiter) subnet(addr netip.Addr) netip.Prefix {
+	bits := l.limits.SubnetBitsV6
+	if addr.Is4() {
+		bits = l.limits.SubnetBitsV4
+	}
+	subnet, _ := addr.Prefix(bits)
+	return subnet
+}
+
+// banFor bans the source for the configured ban duration
+func (l *limiter) banFor(prefix netip.Prefix, now time.Time) {
+	if l.limits.BanDuration > 0 {
+		l.ban(prefix, now.Add(l.limits.BanDuration))
+	}
+}
+
+func (l *limiter) ban(prefix netip.Prefix, expires time.Time) {
+	prefix = prefix.Masked()
+	if _, ok := l.bans[prefix]; !ok {
+		l.lengths[prefix.Bits()]++
+	}
+	l.bans[prefix] = expires
+}
+
+func (l *limiter) unban(prefix netip.Prefix) bool {
+	prefix = prefix.Masked()
+	if _, ok := l.bans[prefix]; !ok {
+		return false
+	}
+	delete(l.bans, prefix)
+	if l.lengths[prefix.Bits()]--; l.lengths[prefix.Bits()] == 0 {
+		delete(l.lengths, prefix.Bits())
+	}
+	return true
+}
+
+// isBanned checks the address against every prefix length that has a ban
+func (l *limiter) isBanned(addr netip.Addr, now time.Time) bool {
+	for bits := range l.lengths {
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if expires, ok := l.bans[prefix]; ok && (expires.IsZero() || now.Before(expires)) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanup removes buckets that haven't been used since the last sweep and bans that have expired
+func (l *limiter) cleanup(now time.Time) {
+	for _, buckets := range []map[netip.Prefix]*bucket{l.packets, l.connects} {
+		for key, b := range buckets {
+			if now.Sub(b.last) > sweepInterval {
+				delete(buckets, key)
+			}
+		}
+	}
+	for prefix, expires := range l.bans {
+		if !expires.IsZero() && !now.Before(expires) {
+			l.unban(prefix)
+		}
+	}
+	l.sweep = now.Add(sweepInterval)
+}
+
+// SetLimits sets the per source packet and connection rate limits, it can be called from any goroutine
+func (conn *RUDPServer) SetLimits(limits Limits) {
+	conn.limiter.setLimits(limits)
+}
+
+// Ban drops every packet from the addresses in prefix for the duration, a duration of zero bans until Unban.
+// Ban a single address with netip.PrefixFrom(addr, addr.BitLen()).  It can be called from any goroutine.
+func (conn *RUDPServer) Ban(prefix netip.Prefix, duration time.Duration) {
+	conn.limiter.mu.Lock()
+	defer conn.limiter.mu.Unlock()
+	var expires time.Time
+	if duration > 0 {
+		expires = conn.now().Add(duration)
+	}
+	conn.limiter.ban(prefix, expires)
+}
+
+// Unban removes a ban added by Ban or by exceeding a limit, it returns false if the prefix wasn't banned.  It can be
+// called from any goroutine.
+func (conn *RUDPServer) Unban(prefix netip.Prefix) bool {
+	conn.limiter.mu.Lock()
+	defer conn.limiter.mu.Unlock()
+	return conn.limiter.unban(prefix)
+}
+
+// Bans returns the banned prefixes and when each ban expires, zero for permanent bans.  It can be called from any
+// goroutine.
+func (conn *RUDPServer) Bans() map[netip.Prefix]time.Time {
+	conn.limiter.mu.Lock()
+	defer conn.limiter.mu.Unlock()
+	now := conn.now()
+	bans := make(map[netip.Prefix]time.Time, len(conn.limiter.bans))
+	for prefix, expires := range conn.limiter.bans {
+		if expires.IsZero() || now.Before(expires) {
+			bans[prefix] = expires
+		}
+	}
+	return bans
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/jomstead/go-rudp/client"
+	"github.com/jomstead/go-rudp/transport"
+)
+
+func TestRUDP_LimiterPacketsPerIP(t *testing.T) {
+	l := newLimiter()
+	l.setLimits(Limits{PacketsPerIP: 10, Burst: 1, BanDuration: 5 * time.Second})
+	now := time.Unix(1000, 0)
+	addr := netip.MustParseAddr("1.2.3.4")
+
+	for i := 0; i < 10; i++ {
+		if l.packet(addr, now) != allowed {
+			t.Fatalf("Packet %d within the burst was dropped", i)
+		}
+	}
+	if l.packet(addr, now) != limited {
+		t.Error("Packet over the limit was allowed")
+	}
+	// the source is now banned even though its bucket refills
+	if l.packet(addr, now.Add(time.Second)) != banned {
+		t.Error("Source over the limit was not banned")
+	}
+	if l.packet(netip.MustParseAddr("1.2.3.5"), now) != allowed {
+		t.Error("Another address was affected by the ban")
+	}
+	if l.packet(addr, now.Add(6*time.Second)) != allowed {
+		t.Error("Ban did not expire")
+	}
+}
+
+func TestRUDP_LimiterSubnet(t *testing.T) {
+	l := newLimiter()
+	l.setLimits(Limits{PacketsPerIP: 100, PacketsPerSubnet: 5, BanDuration: time.Minute})
+	now := time.Unix(1000, 0)
+	// many addresses in the same /24 share the subnet limit
+	for i := 1; i <= 5; i++ {
+		if l.packet(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), now) != allowed {
+			t.Fatalf("Packet %d within the subnet limit was dropped", i)
+		}
+	}
+	if l.packet(netip.MustParseAddr("10.0.0.99"), now) != limited {
+		t.Error("Subnet over the limit was allowed")
+	}
+	if l.packet(netip.MustParseAddr("10.0.1.1"), now) != allowed {
+		t.Error("Another subnet was affected")
+	}
+	if l.packet(netip.MustParseAddr("::ffff:10.0.0.200"), now) != banned {
+		t.Error("IPv4 mapped address escaped the subnet ban")
+	}
+}
+
+func TestRUDP_LimiterConnects(t *testing.T) {
+	l := newLimiter()
+	l.setLimits(Limits{ConnectsPerIP: 1, Burst: 2})
+	now := time.Unix(1000, 0)
+	addr := netip.MustParseAddr("2001:db8::1")
+	l.connect(addr, now)
+	l.connect(addr, now)
+	if l.connect(addr, now) != limited {
+		t.Error("Connection over the limit was allowed")
+	}
+	// no ban duration, the source only has to slow down
+	if l.connect(addr, now.Add(time.Second)) != allowed {
+		t.Error("Connection was not allowed after the bucket refilled")
+	}
+}
+
+func TestRUDP_ServerBans(t *testing.T) {
+	t.Parallel()
+	// setup the server on an in-memory network
+	hub := transport.NewHub()
+	c, _ := hub.ListenPacket("10.0.0.1:9000")
+	s := c.LocalAddr().(*net.UDPAddr)
+	server := RUDPServer{}
+	server.Initialize(c, s)
+	defer server.Close()
+
+	cc, _ := hub.ListenPacket("10.0.0.2:0")
+	client := client.RUDPClient{}
+	client.Initialize(cc, s)
+	defer client.Close()
+
+	prefix := netip.MustParsePrefix("10.0.0.2/32")
+	server.Ban(prefix, 0)
+	if expires, ok := server.Bans()[prefix]; !ok || !expires.IsZero() {
+		t.Error("Permanent ban was not listed")
+	}
+	client.Write(&[]byte{1}, false)
+	go func() {
+		// give the server time to read and drop the first packet
+		time.Sleep(50 * time.Millisecond)
+		if !server.Unban(prefix) || server.Unban(prefix) {
+			t.Error("Unban did not remove the ban exactly once")
+		}
+		client.Write(&[]byte{2}, false)
+	}()
+
+	// the first packet was dropped while banned
+	temp := make([]byte, 1024)
+	n, _, _, err := server.ReadFromUDP(temp)
+	if err != nil || n != 1 || temp[0] != 2 {
+		t.Error("Expected only the packet sent after the unban")
+	}
+	if server.Counters().Banned != 1 {
+		t.Errorf("Expected 1 banned packet, received %d", server.Counters().Banned)
+	}
+	if len(server.Bans()) != 0 {
+		t.Error("Bans were not empty after the unban")
+	}
+}
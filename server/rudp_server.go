@@ -1,20 +1,99 @@
 package server
 
 import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
+	"log"
 	"net"
 	"net/netip"
+	"sync/atomic"
+	"time"
 
+	"github.com/jomstead/go-rudp/clock"
+	"github.com/jomstead/go-rudp/compress"
 	"github.com/jomstead/go-rudp/packet"
+	"github.com/jomstead/go-rudp/secure"
+	"github.com/jomstead/go-rudp/stats"
+	"github.com/jomstead/go-rudp/token"
 )
 
+// RUDPServer is not safe for concurrent use: call its methods from the goroutine that calls ReadFromUDP, unless
+// their documentation says they can be called from any goroutine
 type RUDPServer struct {
-	conn        *net.UDPConn
-	address     *net.UDPAddr //host:port
-	isConnected bool
-	connections map[netip.AddrPort]*rUDPConnection
-	temp        []byte
+	conn             net.PacketConn
+	address          *net.UDPAddr //host:port
+	isConnected      atomic.Bool  // the server is running, read from any goroutine
+	connections      map[netip.AddrPort]*rUDPConnection
+	temp             []byte
+	codecs           []compress.Codec // codecs the server accepts, in order of preference
+	scratch          []byte           // buffer for compressing and decompressing payloads
+	raw_bytes        uint64           // payload bytes passed to WriteToUDP
+	sent_bytes       uint64           // payload bytes sent after compression
+	key              *ecdh.PrivateKey // static key for the key exchange, nil if encryption is disabled
+	plain            []byte           // buffer for decrypting payloads
+	token_key        []byte           // key shared with the matchmaker, nil if connect tokens are not required
+	replay           *token.ReplayCache
+	cookies          *secure.Cookies // nil if clients don't have to answer a challenge before connecting
+	limiter          *limiter
+	counters         Counters
+	max_peers        int                                          // maximum number of connections, 0 for no limit
+	queue_size       int                                          // maximum number of clients waiting for a free connection
+	queue            []waiter                                     // clients waiting for a free connection, oldest first
+	report_malformed bool                                         // return malformed packets from ReadFromUDP as errors instead of dropping them
+	checksums        bool                                         // agree to checksummed packets when clients ask for them
+	ids              map[uint64]*rUDPConnection                   // connections by the id assigned when the client connected
+	on_migrate       func(from netip.AddrPort, to netip.AddrPort) // called when a client's address changes
+	timeout          time.Duration                                // clients silent for longer are disconnected, 0 never disconnects them
+	grace            time.Duration                                // how much longer a silent client's state is kept so it can resume
+	expired          time.Time                                    // when silent clients were last looked for
+	sockets          []*socket                                    // bound sockets, conn is the first
+	from             *socket                                      // socket the packet being processed arrived on
+	received         chan datagram                                // packets from the socket readers, nil with a single socket
+	free             chan []byte                                  // buffers for the socket readers
+	deadline         time.Time                                    // read deadline with several sockets
+	closed           chan struct{}                                // closed by Close to stop the socket readers
+	unverified_cap   int                                          // initial capacity of each client's unverified list
+	logger           *log.Logger                                  // logs connection events, nil logs nothing
+	clock            clock.Clock                                  // time source, clock.Real if nil
+	total            *stats.Recorder                              // statistics of all connections, see TotalStats
+	observer         Observer                                     // told about connections and packets, nil for none
+}
+
+// ErrUnknownConnection is returned by WriteToUDP for an address without a connection, e.g. a client that
+// disconnected, timed out or moved to another address
+var ErrUnknownConnection = errors.New("no connection for the address")
+
+type waiter struct {
+	addr netip.AddrPort
+	last time.Time // when the client last asked to connect
+}
+
+const (
+	CookieLifetime     = 10 * time.Second       // how long a client has to echo the cookie from a challenge
+	QueueTimeout       = 10 * time.Second       // how long a queued client keeps its place without asking to connect again
+	PathInterval       = 100 * time.Millisecond // how often a client's new address is challenged while it is unanswered
+	ExpireInterval     = 100 * time.Millisecond // how often ReadFromUDP looks for clients that have been silent too long
+	ReceiveBufferSize  = 1024                   // default size of the receive buffer, larger packets are cut off
+	UnverifiedCapacity = 16                     // default initial capacity of each client's list of unverified reliable packets
+)
+
+// Counters counts packets the server dropped
+type Counters struct {
+	InvalidTokens   uint64 // connect requests with a token that failed to decrypt or was for another server
+	ExpiredTokens   uint64 // connect requests with an expired token
+	ReplayedTokens  uint64 // connect requests with a token already used by another address
+	Challenges      uint64 // connect requests answered with a cookie challenge
+	InvalidCookies  uint64 // connect requests with a cookie that was forged, expired or issued to another address
+	ReplayedPackets uint64 // encrypted packets with a packet number that was already received
+	Banned          uint64 // packets from a banned source
+	RateLimited     uint64 // packets and connections over a rate limit
+	ServerFull      uint64 // connection attempts rejected because the server was full
+	Malformed       uint64 // packets with an invalid header or payload
+	Corrupted       uint64 // packets with a checksum that didn't match
+	FailedResumes   uint64 // resume requests for a connection that is gone or with a wrong proof
 }
 
 type rUDPConnection struct {
@@ -24,111 +103,1001 @@ type rUDPConnection struct {
 	remote_seq  uint32
 	remote_acks packet.Ack
 	unverified  []uint32 // keeps a list of unverified sequence numbers
+	newest_ack  uint32   // newest sequence number the client acknowledged, ^uint32(0) before the first ack
 	server      *RUDPServer
+	codec       compress.Codec  // codec agreed with the client, nil for no compression
+	raw_bytes   uint64          // payload bytes passed to WriteToUDP for this client
+	sent_bytes  uint64          // payload bytes sent to this client after compression
+	session     *secure.Session // keys for encrypting packets, nil until an encrypted connect succeeds
+	token       *token.Token    // connect token presented by the client, nil if tokens are not required
+	request     []byte          // body of the client's last connect request
+	accept      []byte          // accept sent for the client's connect request, resent if the request is repeated before any data
+	checksum    bool            // packets carry a checksum, agreed with the client when it connected
+	corrupted   uint64          // packets from the client dropped because their checksum didn't match
+	ack_repeats int             // number of packets that still carry the acknowledgements, see packet.AckRepeats
+	id          uint64          // connection id assigned when the client connected, 0 if it never connected
+	path_addr   netip.AddrPort  // new address the client sent from, the server follows it once it answers the challenge
+	path_token  uint64          // challenge sent to path_addr
+	path_sent   time.Time       // when the challenge was last sent
+	last        time.Time       // when the last authentic packet was received from the client
+	ticket      []byte          // resume ticket given to the client, nil without a grace period
+	socket      *socket         // socket the client's packets arrive on, the server answers from it
+	stats       *stats.Recorder // statistics of the connection, see Stats
+	pending     *rUDPConnection // new connection from the client's address waiting to replace this one, see replace
+	replaces    *rUDPConnection // connected client this pending connection replaces once a data packet proves it
 }
 
-func (conn *RUDPServer) Initialize(c *net.UDPConn, s *net.UDPAddr) {
-	conn.isConnected = true // is the server running
-	conn.address = s        // address for the server (this machine)
-	conn.conn = c           // connection for the server
-	conn.temp = make([]byte, 1024)
+// Initialize sets the server up on c, a UDP socket or any net.PacketConn with IP:port addresses (see package
+// transport).  s is the server's address that connect tokens must allow, the local address of c if it is nil.
+func (conn *RUDPServer) Initialize(c net.PacketConn, s *net.UDPAddr) {
+	conn.isConnected.Store(true) // is the server running
+	conn.conn = c                // connection for the server
+	conn.sockets = []*socket{newSocket(c, s)}
+	conn.address = conn.sockets[0].address // address for the server (this machine)
+	conn.from = conn.sockets[0]
+	conn.closed = make(chan struct{})
+	conn.temp = make([]byte, ReceiveBufferSize)
+	conn.unverified_cap = UnverifiedCapacity
 	conn.connections = make(map[netip.AddrPort]*rUDPConnection)
+	conn.ids = make(map[uint64]*rUDPConnection)
+	conn.limiter = newLimiter()
+	conn.limiter.setLimits(Limits{})
+	conn.total = &stats.Recorder{}
+}
+
+// SetBufferSizes sets the size of the receive buffer, the largest packet the server can receive including its
+// header, and the initial capacity of each new client's list of unverified reliable packets.  Call it before
+// the first ReadFromUDP.
+func (conn *RUDPServer) SetBufferSizes(receive int, unverified int) {
+	conn.temp = make([]byte, receive)
+	conn.unverified_cap = unverified
+}
+
+// SetLogger logs connection events (connects, rejects, disconnects, migrations, expiry) to l, nil logs nothing
+func (conn *RUDPServer) SetLogger(l *log.Logger) {
+	conn.logger = l
+}
+
+// logf logs a connection event if a logger is set
+func (conn *RUDPServer) logf(format string, v ...any) {
+	if conn.logger != nil {
+		conn.logger.Printf(format, v...)
+	}
+}
+
+// SetClock sets the time source for timeouts, rate limits, bans, cookies and connect tokens, nil is the system
+// clock.  Read deadlines are in the clock's time, so a fake clock needs a transport that follows it (see
+// transport.Hub.SetClock).
+func (conn *RUDPServer) SetClock(c clock.Clock) {
+	conn.clock = c
+}
+
+// now returns the time of the server's clock
+func (conn *RUDPServer) now() time.Time {
+	return clock.Or(conn.clock).Now()
+}
+
+// SetCodecs sets the compression codecs the server accepts.  When a client connects the server picks the
+// first codec offered by the client that is in this list.
+func (conn *RUDPServer) SetCodecs(codecs ...compress.Codec) {
+	conn.codecs = codecs
+}
+
+// SetKey enables encryption with the server's static X25519 key (see secure.GenerateKey).  Clients must
+// Connect with encryption enabled, unencrypted packets are rejected.  Clients can pin the key returned by
+// PublicKey to make sure they are talking to this server.
+func (conn *RUDPServer) SetKey(key *ecdh.PrivateKey) {
+	conn.key = key
+}
+
+// SetTokenKey requires clients to present a connect token generated with the key (see token.Generate) when
+// they connect.  Packets from clients that have not connected with a valid token are rejected before any state
+// is created for them.
+func (conn *RUDPServer) SetTokenKey(key []byte) {
+	conn.token_key = key
+	conn.replay = token.NewReplayCache()
+}
+
+// EnableCookies makes clients answer a stateless cookie challenge before the server creates any state for
+// them, so packets from spoofed source addresses can't exhaust the server's memory.  Clients must Connect.
+func (conn *RUDPServer) EnableCookies() error {
+	cookies, err := secure.NewCookies(CookieLifetime)
+	if err != nil {
+		return err
+	}
+	conn.cookies = cookies
+	return nil
+}
+
+// EnableChecksums lets clients ask for a CRC32C on every packet so corrupted packets are dropped.  Checksums are
+// only used on unencrypted connections, encryption already authenticates every packet.
+func (conn *RUDPServer) EnableChecksums() {
+	conn.checksums = true
+}
+
+// CorruptedPackets returns the number of packets from the client at addr dropped because their checksum didn't match
+func (conn *RUDPServer) CorruptedPackets(addr netip.AddrPort) uint64 {
+	client := conn.connections[addr]
+	if client == nil {
+		return 0
+	}
+	return client.corrupted
+}
+
+// SetMaxConnections limits the number of connected clients, 0 for no limit.  When the server is full new clients
+// are rejected with a server full error.  With a queueSize above 0 up to that many rejected clients are told
+// their place in the queue, and get the next free connections in order as long as they keep asking to connect.
+func (conn *RUDPServer) SetMaxConnections(max int, queueSize int) {
+	conn.max_peers = max
+	conn.queue_size = queueSize
+}
+
+// MaxConnections returns the maximum number of connections, 0 if there is no limit
+func (conn *RUDPServer) MaxConnections() int {
+	return conn.max_peers
+}
+
+// ConnectionCount returns the number of connected clients, including silent clients within their grace period.
+// Clients past their grace period aren't counted even if ReadFromUDP hasn't removed them yet.
+func (conn *RUDPServer) ConnectionCount() int {
+	if conn.timeout <= 0 {
+		return len(conn.connections)
+	}
+	now, count := conn.now(), 0
+	for _, client := range conn.connections {
+		if now.Sub(client.last) <= conn.timeout+conn.grace {
+			count++
+		}
+	}
+	return count
+}
+
+// QueueLength returns the number of clients waiting for a free connection, leaving out clients that stopped asking
+// to connect even if ReadFromUDP hasn't removed them yet
+func (conn *RUDPServer) QueueLength() int {
+	now, count := conn.now(), 0
+	for _, w := range conn.queue {
+		if now.Sub(w.last) < QueueTimeout {
+			count++
+		}
+	}
+	return count
+}
+
+// Disconnect removes the client at addr, freeing its connection for the next client
+func (conn *RUDPServer) Disconnect(addr netip.AddrPort) {
+	if client := conn.connections[addr]; client != nil {
+		delete(conn.ids, client.id)
+		if client.pending != nil {
+			delete(conn.ids, client.pending.id)
+		}
+		if conn.observer != nil {
+			conn.observer.Disconnected(client.stats)
+		}
+	}
+	delete(conn.connections, addr)
+}
+
+// SetTimeout disconnects clients that send nothing for timeout, 0 never disconnects them (the default).  With a
+// grace period clients of an encrypted server (see SetKey) get a resume ticket when they connect, and a silent
+// client's state (sequence numbers,
+// acknowledgements, unverified reliable packets, codec) is kept for the grace period after the timeout so it can
+// resume where it left off from any address, see client.Reconnect.  Clients should send something, e.g. a
+// keepalive, more often than the timeout.
+func (conn *RUDPServer) SetTimeout(timeout time.Duration, grace time.Duration) {
+	conn.timeout = timeout
+	conn.grace = grace
+}
+
+// expireConnections disconnects clients that have been silent for longer than the timeout and grace period
+func (conn *RUDPServer) expireConnections(now time.Time) {
+	if conn.timeout <= 0 || now.Sub(conn.expired) < ExpireInterval {
+		return
+	}
+	conn.expired = now
+	for addr, client := range conn.connections {
+		if now.Sub(client.last) > conn.timeout+conn.grace {
+			conn.logf("rudp: %v timed out", addr)
+			conn.Disconnect(addr)
+		}
+	}
+}
+
+// resume returns the connection the request resumes, nil if it is gone, the proof is wrong or the server isn't
+// encrypted
+func (conn *RUDPServer) resume(request packet.Connect) *rUDPConnection {
+	if conn.key == nil || len(request.Resume) != packet.ConnectionIDSize+secure.ProofSize {
+		return nil
+	}
+	client := conn.ids[binary.BigEndian.Uint64(request.Resume)]
+	if client == nil || !secure.VerifyResume(client.ticket, request.Key, request.Resume[packet.ConnectionIDSize:]) {
+		return nil
+	}
+	return client
+}
+
+// Observer is told about the server's connections and packets, e.g. to export them as metrics (see package
+// metrics).  Its methods are called from the goroutines that call ReadFromUDP and WriteToUDP and must not block.
+type Observer interface {
+	Connected(addr netip.AddrPort, stats *stats.Recorder) // a client connected or moved to addr, stats are its live statistics
+	Disconnected(stats *stats.Recorder)                   // the client with these statistics disconnected or timed out
+	Packet(size int, sent bool)                           // a packet of size bytes was sent or received
+	RTT(rtt time.Duration)                                // an acknowledgement measured the round trip time
+}
+
+// SetObserver sets the observer of the server's connections and packets, nil for none
+func (conn *RUDPServer) SetObserver(o Observer) {
+	conn.observer = o
+}
+
+// OnMigrate sets a function called when a connected client's address changes, e.g. because its NAT mapping changed
+// or it switched networks.  The client is known by the new address from then on.  Only encrypted clients migrate,
+// see SetKey.
+func (conn *RUDPServer) OnMigrate(f func(from netip.AddrPort, to netip.AddrPort)) {
+	conn.on_migrate = f
+}
+
+// admit returns true if there is a free connection for addr, otherwise it returns the client's place in the
+// queue, 0 if it isn't queued
+func (conn *RUDPServer) admit(addr netip.AddrPort, now time.Time) (bool, int) {
+	if conn.max_peers <= 0 {
+		return true, 0
+	}
+	conn.expireQueue(now)
+	free := conn.max_peers - len(conn.connections)
+	i := -1
+	for j, w := range conn.queue {
+		if w.addr == addr {
+			i = j
+			break
+		}
+	}
+	// free connections go to queued clients first
+	if (i >= 0 && i < free) || (i < 0 && len(conn.queue) < free) {
+		if i >= 0 {
+			conn.queue = append(conn.queue[:i], conn.queue[i+1:]...)
+		}
+		return true, 0
+	}
+	if i < 0 {
+		if len(conn.queue) >= conn.queue_size {
+			return false, 0
+		}
+		conn.queue = append(conn.queue, waiter{addr: addr})
+		i = len(conn.queue) - 1
+	}
+	conn.queue[i].last = now
+	return false, i + 1
+}
+
+// expireQueue removes queued clients that have stopped asking to connect
+func (conn *RUDPServer) expireQueue(now time.Time) {
+	waiting := conn.queue[:0]
+	for _, w := range conn.queue {
+		if now.Sub(w.last) < QueueTimeout {
+			waiting = append(waiting, w)
+		}
+	}
+	conn.queue = waiting
+}
+
+// Token returns the connect token the client at addr presented
+func (conn *RUDPServer) Token(addr netip.AddrPort) (token.Token, bool) {
+	client := conn.connections[addr]
+	if client == nil || client.token == nil {
+		return token.Token{}, false
+	}
+	return *client.token, true
+}
+
+// Counters returns the number of packets the server dropped for each reason.  Call it from the goroutine that calls
+// ReadFromUDP, TotalStats can be called from any goroutine.
+func (conn *RUDPServer) Counters() Counters {
+	return conn.counters
+}
 
+// PublicKey returns the server's static public key, nil if encryption is disabled
+func (conn *RUDPServer) PublicKey() *ecdh.PublicKey {
+	if conn.key == nil {
+		return nil
+	}
+	return conn.key.PublicKey()
+}
+
+// CompressionRatio returns the size of the payloads sent to all clients after compression compared to
+// before, 1 when nothing has been compressed
+func (conn *RUDPServer) CompressionRatio() float64 {
+	if conn.raw_bytes == 0 {
+		return 1
+	}
+	return float64(conn.sent_bytes) / float64(conn.raw_bytes)
 }
 
-/* WriteToUDP acts like Write but sends the packet to an UDPAddr */
+// WriteToUDP acts like Write but sends the packet to an UDPAddr, it returns ErrUnknownConnection if no client is
+// connected from addr
 func (conn *RUDPServer) WriteToUDP(payload *[]byte, addr netip.AddrPort, reliable bool) (int, uint32, error) {
-	// TODO: Get the next sequence number FOR THAT CONNECTION (UDPAddr)
 	client := conn.connections[addr]
+	if client == nil {
+		return 0, 0, ErrUnknownConnection
+	}
 
-	var data []byte
 	var seq uint32
-	index := 0
+	body, compressed := client.compress(*payload)
+	// include the last received sequence number and the sequence history from the remote source until it has
+	// been repeated enough times
+	header := packet.Header{Type: packet.TypeData}
+	if client.ack_repeats > 0 {
+		header.Flags = packet.FlagAck
+		header.Ack, header.AckBits = client.remote_seq, client.remote_acks.Data
+		client.ack_repeats--
+	}
 	if reliable {
-		data = make([]byte, 13, len(*payload)+13)
-		data[0] = 1
+		header.Flags |= packet.FlagReliable
 		// increase sequence number for reliable packets
 		client.seq += 1
 		seq = client.seq
-		binary.BigEndian.PutUint32(data[1:], client.seq)
-		index = 5
-	} else {
-		data = make([]byte, 9, len(*payload)+9)
-		data[0] = 0
-		index = 1
-	}
-	// include the last received sequence number and the sequence history from the remote source
-	binary.BigEndian.PutUint32(data[index:], client.remote_seq)
-	binary.BigEndian.PutUint32(data[index+4:], client.remote_acks.Data)
-	index += 8
-	data = append(data, *payload...)
+		header.Seq = client.seq
+	}
+	if compressed {
+		header.Flags |= packet.FlagCompressed
+	}
+	data, index := client.packet(header, body)
 	if reliable {
 		// keep a list of unverified sequence numbers
 		client.unverified = append(client.unverified, seq)
 	}
 
-	n, err := conn.conn.WriteToUDPAddrPort(data, addr)
-	return n - index, seq, err
+	n, err := client.socket.writeTo(data, addr)
+	if err != nil {
+		return n - index, seq, err
+	}
+	now := conn.now()
+	client.stats.Sent(len(data), reliable, seq, now)
+	conn.total.Sent(len(data), reliable, seq, now)
+	if conn.observer != nil {
+		conn.observer.Packet(len(data), true)
+	}
+	// report the number of payload bytes the user gave us, not the compressed or encrypted size
+	return len(*payload), seq, err
+}
+
+// Acknowledge sends the acknowledgements to the client at addr in an ack packet without a payload, for when the
+// client sends reliable packets and the server has nothing to send back.  Data packets carry the acknowledgements
+// in the next packet.AckRepeats packets after a reliable packet arrives, an ack packet counts as one of them.  It
+// sends nothing when there is nothing left to acknowledge.
+func (conn *RUDPServer) Acknowledge(addr netip.AddrPort) error {
+	client := conn.connections[addr]
+	if client == nil {
+		return ErrUnknownConnection
+	}
+	if client.ack_repeats == 0 {
+		return nil
+	}
+	client.ack_repeats--
+	header := packet.Header{Type: packet.TypeAck, Flags: packet.FlagAck, Ack: client.remote_seq, AckBits: client.remote_acks.Data}
+	data, _ := client.packet(header, nil)
+	if _, err := client.socket.writeTo(data, addr); err != nil {
+		return err
+	}
+	now := conn.now()
+	client.stats.Sent(len(data), false, 0, now)
+	conn.total.Sent(len(data), false, 0, now)
+	if conn.observer != nil {
+		conn.observer.Packet(len(data), true)
+	}
+	return nil
+}
+
+// packet returns the packet with header and body, sealed and checksummed as agreed with the client, and the size
+// of its header
+func (client *rUDPConnection) packet(header packet.Header, body []byte) ([]byte, int) {
+	if client.session != nil {
+		header.Flags |= packet.FlagEncrypted
+	}
+	if client.checksum {
+		header.Flags |= packet.FlagChecksum
+	}
+	data := header.Append(make([]byte, 0, packet.MaxHeaderSize+len(body)+secure.Overhead+packet.ChecksumSize))
+	index := len(data)
+	if client.session != nil {
+		data = client.session.Seal(data, body)
+	} else {
+		data = append(data, body...)
+	}
+	if client.checksum {
+		data = packet.AppendChecksum(data)
+	}
+	return data, index
+}
+
+// compress returns the payload compressed with the codec agreed with the client, or the payload unchanged
+// if compression would not make it smaller
+func (client *rUDPConnection) compress(payload []byte) ([]byte, bool) {
+	conn := client.server
+	size := len(payload)
+	if client.codec != nil {
+		compressed, err := client.codec.Compress(conn.scratch[:0], payload)
+		conn.scratch = compressed
+		if err == nil && len(compressed) < len(payload) {
+			payload = compressed
+		}
+	}
+	client.raw_bytes += uint64(size)
+	client.sent_bytes += uint64(len(payload))
+	conn.raw_bytes += uint64(size)
+	conn.sent_bytes += uint64(len(payload))
+	return payload, len(payload) < size
 }
 
+// Close closes the server's sockets, ending a blocked ReadFromUDP.  It can be called from any goroutine.
 func (conn *RUDPServer) Close() {
-	if conn.conn != nil {
-		conn.conn.Close()
+	for _, sock := range conn.sockets {
+		sock.conn.Close()
+	}
+	if conn.isConnected.Swap(false) && conn.closed != nil {
+		close(conn.closed)
 	}
-	conn.isConnected = false
 }
 
-func (conn RUDPServer) IsConnected() bool {
-	return conn.isConnected
+// IsConnected reports whether the server is running, it can be called from any goroutine
+func (conn *RUDPServer) IsConnected() bool {
+	return conn.isConnected.Load()
 }
 
+// ReadFromUDP reads the payload of the next data packet from any client into buffer.  Ack packets have no payload,
+// they are returned with n = 0 and the reliable packets they verified.
 func (conn *RUDPServer) ReadFromUDP(buffer []byte) (n int, verified []uint32, addr *netip.AddrPort, err error) {
 	// use a temp buffer to read a packet from that client
 	if buffer == nil {
 		return 0, []uint32{}, nil, errors.New("buffer not initialized")
 	}
-	n, client_addr, err := conn.conn.ReadFromUDPAddrPort(conn.temp)
-	addr = &client_addr
-	if err != nil {
-		return n, []uint32{}, addr, err
+	for {
+		n, client_addr, err := conn.read()
+		addr = &client_addr
+		if err != nil {
+			return n, []uint32{}, addr, err
+		}
+		now := conn.now()
+		conn.expireConnections(now)
+		// drop packets from banned or flooding sources before doing any work for them
+		switch conn.limiter.packet(addr.Addr(), now) {
+		case banned:
+			conn.counters.Banned++
+			continue
+		case limited:
+			conn.counters.RateLimited++
+			continue
+		}
+		header, err := packet.ParseHeader(conn.temp[:n])
+		reliable := err == nil && header.Reliable()
+		conn.total.Received(n, reliable, now)
+		if conn.observer != nil {
+			conn.observer.Packet(n, false)
+		}
+		if err != nil {
+			if errors.Is(err, packet.ErrBadVersion) {
+				conn.rejectVersion(*addr, conn.temp[:n])
+			}
+			if conn.malformedPacket(nil) {
+				continue
+			}
+			return 0, []uint32{}, addr, err
+		}
+		client := conn.connections[*addr]
+		if header.HasConnectionID() {
+			// clients that connected are found by their id, their address may have changed.  Only encrypted clients
+			// can move: unencrypted packets show the id to anyone on the path, who could answer the path challenge.
+			client = conn.ids[header.ConnID]
+			if client != nil && client.session == nil && client.addr != *addr {
+				client = nil
+			}
+		}
+		if header.Control() {
+			// control packets are handled here and never returned to the user
+			if client != nil {
+				client.stats.Received(n, false, now)
+			}
+			conn.processControl(client, *addr, header, conn.temp[:n])
+			continue
+		}
+		if client == nil {
+			if header.HasConnectionID() {
+				return 0, []uint32{}, addr, errors.New("received a packet for an unknown connection id")
+			}
+			if conn.key != nil || conn.token_key != nil || conn.cookies != nil {
+				// clients have to connect first
+				return 0, []uint32{}, addr, errors.New("received a packet from a client that has not connected")
+			}
+			// create a new rUDPConnection for each new addr
+			if client = conn.newConnection(*addr, nil); client == nil {
+				continue
+			}
+		}
+		client.stats.Received(n, reliable, now)
+		if (header.Compressed() && client.codec == nil) || header.Checksummed() != client.checksum {
+			if conn.malformedPacket(client) {
+				continue
+			}
+			return 0, []uint32{}, addr, packet.ErrBadFlag
+		}
+		data := conn.temp[:n]
+		if header.Checksummed() {
+			// drop corrupted packets before they can touch the ack state
+			if data, err = packet.VerifyChecksum(data); err != nil {
+				conn.counters.Corrupted++
+				client.corrupted++
+				client.stats.Malformed()
+				conn.total.Malformed()
+				if !conn.report_malformed {
+					continue
+				}
+				return 0, []uint32{}, addr, err
+			}
+		}
+		payload, err := client.open(data, header)
+		if err != nil {
+			return 0, []uint32{}, addr, err
+		}
+		client.last = now
+		if client.replaces != nil {
+			conn.replace(client)
+		}
+		// the client got its accept, a connect request from now on starts a new connection
+		client.accept, client.request = nil, nil
+		if client.addr != *addr {
+			conn.validatePath(client, *addr, n)
+		} else {
+			client.socket = conn.from
+		}
+		// report the client by the address the server sends to
+		current := client.addr
+		addr = &current
+		if header.Type == packet.TypeAck {
+			// acks have no payload, only report the packets they verified
+			return 0, client.acknowledge(header.Ack, header.AckBits), addr, nil
+		}
+		if header.Reliable() && packet.IsDuplicate(header.Seq, client.remote_seq, client.remote_acks) {
+			// received before, it is still delivered
+			client.stats.Duplicate()
+			conn.total.Duplicate()
+		}
+		n, err = client.decompress(buffer, header, payload)
+		if err != nil {
+			if conn.malformedPacket(client) {
+				continue
+			}
+			return 0, []uint32{}, addr, err
+		}
+		// only acknowledge reliable packets once the payload has been delivered
+		if header.Reliable() {
+			client.remote_seq = packet.UpdateAcknowledgements(header.Seq, client.remote_seq, &client.remote_acks)
+			// repeat the acknowledgement in the next packets, a duplicate means the remote missed it
+			client.ack_repeats = packet.AckRepeats
+		}
+		verified = []uint32{}
+		if header.HasAck() {
+			verified = client.acknowledge(header.Ack, header.AckBits)
+		}
+		return n, verified, addr, nil
+	}
+}
+
+// ReportMalformed makes ReadFromUDP return an error for malformed packets (a packet.ParseHeader error, packet.ErrBadChecksum
+// or a decompression error) instead of dropping them
+func (conn *RUDPServer) ReportMalformed(report bool) {
+	conn.report_malformed = report
+}
+
+// malformedPacket counts a malformed packet from client, nil if it has no connection, and returns true if it should
+// be dropped silently
+func (conn *RUDPServer) malformedPacket(client *rUDPConnection) bool {
+	conn.counters.Malformed++
+	conn.total.Malformed()
+	if client != nil {
+		client.stats.Malformed()
+	}
+	return !conn.report_malformed
+}
+
+// newConnection creates the state for a new client, it returns nil if the client's source is over the connection
+// rate limit or the server is full.  A connection for the address of a connected client, replaces, is pending
+// until a data packet proves it, see replace.
+func (conn *RUDPServer) newConnection(addr netip.AddrPort, replaces *rUDPConnection) *rUDPConnection {
+	now := conn.now()
+	if conn.limiter.connect(addr.Addr(), now) != allowed {
+		conn.counters.RateLimited++
+		return nil
+	}
+	if replaces != nil {
+		if replaces.pending != nil {
+			delete(conn.ids, replaces.pending.id)
+		}
+		replaces.pending = conn.connection(addr, now)
+		replaces.pending.replaces = replaces
+		return replaces.pending
+	}
+	if ok, position := conn.admit(addr, now); !ok {
+		conn.counters.ServerFull++
+		conn.logf("rudp: rejected %v, the server is full (queue position %d)", addr, position)
+		reject := packet.Header{Type: packet.TypeReject}.Append(nil)
+		reject = append(reject, packet.RejectServerFull)
+		reject = binary.BigEndian.AppendUint16(reject, uint16(position))
+		conn.reply(reject, addr)
+		return nil
+	}
+	client := conn.connection(addr, now)
+	conn.connections[addr] = client
+	if conn.observer != nil {
+		conn.observer.Connected(addr, client.stats)
+	}
+	return client
+}
+
+// connection returns the initial state of a connection to addr
+func (conn *RUDPServer) connection(addr netip.AddrPort, now time.Time) *rUDPConnection {
+	return &rUDPConnection{
+		isConnected: true,
+		last:        now,
+		seq:         ^uint32(0),
+		remote_seq:  ^uint32(0), // remote seq number
+		newest_ack:  ^uint32(0),
+		server:      conn,
+		unverified:  make([]uint32, 0, conn.unverified_cap), // queue of unverified seuquence numbers
+		remote_acks: packet.Ack{Data: 0},
+		addr:        addr,
+		socket:      conn.from,
+		stats:       &stats.Recorder{},
+	}
+}
+
+// replace makes the pending connection client the connection of its address, a data packet proved it
+func (conn *RUDPServer) replace(client *rUDPConnection) {
+	old := client.replaces
+	client.replaces, old.pending = nil, nil
+	conn.logf("rudp: %x replaced %x at %v", client.id, old.id, client.addr)
+	if conn.connections[old.addr] == old {
+		conn.Disconnect(old.addr)
+	}
+	// anything else still known by the address is stale
+	conn.Disconnect(client.addr)
+	conn.connections[client.addr] = client
+	if conn.observer != nil {
+		conn.observer.Connected(client.addr, client.stats)
+	}
+}
+
+// rejectVersion answers a connect request from a client using another protocol version.  The protocol id and
+// version come first in every version so the client can tell why it was rejected.
+func (conn *RUDPServer) rejectVersion(addr netip.AddrPort, data []byte) {
+	// only answer requests larger than the reject so we can't be used to amplify a reflection attack
+	if len(data) < packet.MinConnectSize || packet.Type(data[3]) != packet.TypeConnect {
+		return
+	}
+	conn.logf("rudp: rejected %v, it uses protocol version %d", addr, data[2])
+	reject := packet.Header{Type: packet.TypeReject}.Append(nil)
+	conn.reply(append(reject, packet.RejectBadVersion), addr)
+}
+
+// processControl handles the control packet in data from addr, client is nil if addr has no connection yet
+func (conn *RUDPServer) processControl(client *rUDPConnection, addr netip.AddrPort, header packet.Header, data []byte) {
+	switch header.Type {
+	case packet.TypeDisconnect:
+		// the packet has to be sealed with the client's keys on encrypted connections so it can't be spoofed
+		if client != nil {
+			if _, err := client.open(data, header); err == nil {
+				conn.logf("rudp: %v disconnected", client.addr)
+				conn.Disconnect(client.addr)
+			}
+		}
+	case packet.TypeKeepalive:
+		if client != nil {
+			if _, err := client.open(data, header); err == nil {
+				client.last = conn.now()
+				if client.addr != addr {
+					conn.validatePath(client, addr, len(data))
+				} else {
+					// answer so the client knows we are still here, never larger than the request
+					client.socket = conn.from
+					conn.reply(client.control(packet.TypeKeepalive), addr)
+				}
+			}
+		}
+	case packet.TypePathResponse:
+		if client == nil || client.path_addr != addr {
+			return
+		}
+		body, err := client.open(data, header)
+		if err == nil && len(body) == 8 && binary.BigEndian.Uint64(body) == client.path_token {
+			conn.migrate(client, addr)
+		}
+	case packet.TypeConnect:
+		request, err := packet.ParseConnect(data[header.Size:])
+		if err != nil {
+			return
+		}
+		now := conn.now()
+		if conn.cookies != nil && !conn.cookies.Verify(request.Cookie, addr, now) {
+			if len(request.Cookie) > 0 {
+				conn.counters.InvalidCookies++
+			}
+			// never send more than we received so we can't be used to amplify a reflection attack
+			challenge := append(packet.Header{Type: packet.TypeChallenge}.Append(nil), conn.cookies.Generate(addr, now)...)
+			if len(challenge) <= len(data) {
+				conn.reply(challenge, addr)
+				conn.counters.Challenges++
+			}
+			return
+		}
+		if client != nil && client.pending != nil && bytes.Equal(data[header.Size:], client.pending.request) {
+			// the request is for the connection waiting to replace the client's
+			client = client.pending
+		}
+		if client != nil && client.accept != nil && bytes.Equal(data[header.Size:], client.request) {
+			// the client resent its connect request (or it was replayed), answer with the same keys.  Never send
+			// more than we received so we can't be used to amplify a reflection attack.
+			if len(client.accept) <= len(data) {
+				client.stats.Resent()
+				conn.total.Resent()
+				conn.reply(client.accept, addr)
+			}
+			return
+		}
+		if conn.key != nil && len(request.Key) != secure.KeySize {
+			conn.logf("rudp: rejected %v, encryption is required", addr)
+			reject := packet.Header{Type: packet.TypeReject}.Append(nil)
+			conn.reply(append(reject, packet.RejectEncryptionRequired), addr)
+			return
+		}
+		if len(request.Resume) > 0 {
+			// the ticket proves who the client is, it doesn't need another connect token
+			resumed := conn.resume(request)
+			if resumed == nil {
+				conn.counters.FailedResumes++
+				conn.logf("rudp: rejected %v, the connection it tried to resume is gone or the proof is wrong", addr)
+				reject := packet.Header{Type: packet.TypeReject}.Append(nil)
+				conn.reply(append(reject, packet.RejectResume), addr)
+				return
+			}
+			if resumed.addr != addr {
+				conn.migrate(resumed, addr)
+			}
+			client = resumed
+		} else {
+			var t *token.Token
+			if conn.token_key != nil {
+				if t = conn.checkToken(request.Token, addr); t == nil {
+					return
+				}
+			}
+			// a client that started over, e.g. it restarted, gets a new connection.  The request may also be spoofed
+			// or replayed, so the old connection is kept until a data packet proves the new one.
+			if client = conn.newConnection(addr, client); client == nil {
+				return
+			}
+			// the request that created the connection counts towards it
+			client.stats.Received(len(data), false, now)
+			client.token = t
+		}
+		client.last = now
+		client.socket = conn.from
+		// pick the first codec offered by the client that the server also supports
+		client.codec = nil
+		for _, id := range request.Codecs {
+			if client.codec = compress.Find(conn.codecs, id); client.codec != nil {
+				break
+			}
+		}
+		// checksums are redundant on encrypted connections
+		client.checksum = conn.checksums && conn.key == nil && request.Options&packet.OptionChecksum != 0
+		codec, options := compress.None, uint8(0)
+		if client.codec != nil {
+			codec = client.codec.ID()
+		}
+		if client.checksum {
+			options |= packet.OptionChecksum
+		}
+		if client.id == 0 {
+			client.id = conn.newID()
+			conn.ids[client.id] = client
+		}
+		accept := append(packet.Header{Type: packet.TypeAccept}.Append(nil), codec, options)
+		accept = binary.BigEndian.AppendUint64(accept, client.id)
+		// a new ticket every time, the old one has been used
+		client.ticket = nil
+		if conn.grace > 0 && conn.key != nil {
+			// only encrypted connections can resume: an unencrypted accept shows the ticket to anyone watching and a
+			// replayed resume request would hand the connection to whoever sent it.  Encrypted, the replay gets no keys.
+			if client.ticket, err = secure.NewTicket(); err != nil {
+				return
+			}
+		}
+		client.session = nil
+		if conn.key != nil {
+			session, ephemeral, err := secure.ServerHandshake(conn.key, request.Key)
+			if err != nil {
+				return
+			}
+			// seal the accept so the client knows we hold the static key, and the ticket so only the client has it
+			accept = append(accept, conn.key.PublicKey().Bytes()...)
+			accept = append(accept, ephemeral.Bytes()...)
+			accept = session.Seal(accept, client.ticket)
+			client.session = session
+		}
+		client.accept = accept
+		client.request = append([]byte{}, data[header.Size:]...)
+		conn.logf("rudp: %v connected as %x (resumed %v)", client.addr, client.id, len(request.Resume) > 0)
+		// clients pad their requests to fit the accept (see packet.MinEncryptedConnectSize), never send more than
+		// we received so we can't be used to amplify a reflection attack
+		if len(accept) <= len(data) {
+			conn.reply(accept, client.addr)
+		}
+	}
+}
+
+// newID returns a random connection id that isn't in use, 0 is never used
+func (conn *RUDPServer) newID() uint64 {
+	b := make([]byte, 8)
+	for {
+		rand.Read(b)
+		if id := binary.BigEndian.Uint64(b); id != 0 && conn.ids[id] == nil {
+			return id
+		}
+	}
+}
+
+// validatePath challenges the new address an authentic packet from client came from.  The server keeps sending
+// to the old address until the client answers from the new one, so a copied packet can't redirect its traffic.
+func (conn *RUDPServer) validatePath(client *rUDPConnection, addr netip.AddrPort, size int) {
+	now := conn.now()
+	if client.path_addr == addr && now.Sub(client.path_sent) < PathInterval {
+		return
+	}
+	if client.path_addr != addr {
+		b := make([]byte, 8)
+		rand.Read(b)
+		client.path_addr = addr
+		client.path_token = binary.BigEndian.Uint64(b)
+	}
+	challenge := packet.Header{Type: packet.TypePathChallenge}.Append(nil)
+	challenge = binary.BigEndian.AppendUint64(challenge, client.path_token)
+	// never send more than we received so we can't be used to amplify a reflection attack
+	if len(challenge) <= size {
+		conn.reply(challenge, addr)
+		client.path_sent = now
+	}
+}
+
+// migrate moves client to the address that answered its path challenge
+func (conn *RUDPServer) migrate(client *rUDPConnection, addr netip.AddrPort) {
+	from := client.addr
+	conn.logf("rudp: %x moved from %v to %v", client.id, from, addr)
+	// anything still known by the new address is stale, the client proved it receives there
+	conn.Disconnect(addr)
+	delete(conn.connections, from)
+	conn.connections[addr] = client
+	client.addr = addr
+	client.socket = conn.from
+	client.path_addr = netip.AddrPort{}
+	if conn.observer != nil {
+		conn.observer.Connected(addr, client.stats)
+	}
+	if conn.on_migrate != nil {
+		conn.on_migrate(from, addr)
+	}
+}
+
+// checkToken returns the decrypted connect token if it is valid for this server and hasn't been used by another address
+func (conn *RUDPServer) checkToken(data []byte, addr netip.AddrPort) *token.Token {
+	now := conn.now()
+	t, err := token.Open(conn.token_key, data, now)
+	switch {
+	case err == token.ErrExpired:
+		conn.counters.ExpiredTokens++
+	case err != nil || !t.Allows(conn.from.address.AddrPort()):
+		conn.counters.InvalidTokens++
+	case !conn.replay.Use(data, t, addr, now):
+		conn.counters.ReplayedTokens++
+	default:
+		return &t
+	}
+	return nil
+}
+
+// control returns a packet of type t with body, sealed if the connection is encrypted
+func (client *rUDPConnection) control(t packet.Type, body ...byte) []byte {
+	header := packet.Header{Type: t}
+	if client.session == nil {
+		return append(header.Append(nil), body...)
+	}
+	header.Flags |= packet.FlagEncrypted
+	return client.session.Seal(header.Append(nil), body)
+}
+
+// open authenticates the header and decrypts the payload of the packet in data if the connection is encrypted
+func (client *rUDPConnection) open(data []byte, h packet.Header) ([]byte, error) {
+	conn := client.server
+	header, payload := data[:h.Size], data[h.Size:]
+	encrypted := h.Encrypted()
+	if client.session == nil {
+		if encrypted || conn.key != nil {
+			return nil, errors.New("received a packet from a client without an encrypted session")
+		}
+		return payload, nil
+	}
+	if !encrypted {
+		return nil, errors.New("received an unencrypted packet on an encrypted connection")
+	}
+	plain, err := client.session.Open(conn.plain[:0], header, payload)
+	conn.plain = plain
+	if err == secure.ErrReplay {
+		conn.counters.ReplayedPackets++
 	}
-	// create a new rUDPConnection for each new addr
-	var client *rUDPConnection
-	client = conn.connections[*addr]
+	return plain, err
+}
+
+// ReplayedPackets returns the number of packets from the client at addr rejected because their packet number
+// had already been received
+func (conn *RUDPServer) ReplayedPackets(addr netip.AddrPort) uint64 {
+	client := conn.connections[addr]
+	if client == nil || client.session == nil {
+		return 0
+	}
+	return client.session.Replayed()
+}
+
+// Stats returns the statistics of the client at addr, false if it isn't connected.  Call it from the goroutine
+// that calls ReadFromUDP, TotalStats can be called from any goroutine.
+func (conn *RUDPServer) Stats(addr netip.AddrPort) (stats.Stats, bool) {
+	client := conn.connections[addr]
 	if client == nil {
-		client = &rUDPConnection{
-			isConnected: true,
-			seq:         ^uint32(0),
-			remote_seq:  ^uint32(0), // remote seq number
-			server:      conn,
-			unverified:  make([]uint32, 0, 16), // queue of unverified seuquence numbers
-			remote_acks: packet.Ack{Data: 0},
-			addr:        *addr,
-		}
-		conn.connections[*addr] = client
-	}
-
-	if n > 5 && conn.temp[0] == 0 {
-		// unreliable packet
-		ack := binary.BigEndian.Uint32(conn.temp[1:5])
-		ack_bitfield := binary.BigEndian.Uint32(conn.temp[5:9])
-		verified = client.processAck(ack, ack_bitfield)
-		copy(buffer, conn.temp[9:n])
-		return n - 9, verified, addr, err
-	}
-	if n > 8 && conn.temp[0] == 1 {
-		// reliable packet
-		seq := binary.BigEndian.Uint32(conn.temp[1:5])
-		client.remote_seq = packet.UpdateAcknowledgements(seq, client.remote_seq, &client.remote_acks)
-		ack := binary.BigEndian.Uint32(conn.temp[5:9])
-		ack_bitfield := binary.BigEndian.Uint32(conn.temp[9:13])
-		verified = client.processAck(ack, ack_bitfield)
-		copy(buffer, conn.temp[13:n])
-
-		return n - 13, verified, addr, err
-	}
-	// Not sure what this is....
-	return n, []uint32{}, addr, errors.New("unexpected RUDP header data")
+		return stats.Stats{}, false
+	}
+	return client.stats.Stats(conn.now()), true
+}
+
+// TotalStats returns the statistics of all connections since the server started, including packets from
+// addresses without a connection.  The RTT is smoothed over the acknowledgements from all clients.  It can be
+// called from any goroutine.
+func (conn *RUDPServer) TotalStats() stats.Stats {
+	return conn.total.Stats(conn.now())
+}
+
+// acknowledge processes the acknowledgements from the client and returns the reliable packets they verified.  It
+// counts the packets that fell out of the ack window as lost, they stay unverified.
+func (client *rUDPConnection) acknowledge(seq uint32, bitwise uint32) []uint32 {
+	conn := client.server
+	verified := client.processAck(seq, bitwise)
+	now := conn.now()
+	for _, v := range verified {
+		rtt := client.stats.Acked(v, now)
+		conn.total.AddAck(rtt)
+		if rtt > 0 && conn.observer != nil {
+			conn.observer.RTT(rtt)
+		}
+	}
+	for i := packet.LeftWindow(client.unverified, client.newest_ack, seq); i > 0; i-- {
+		client.stats.Lost()
+		conn.total.Lost()
+	}
+	if client.newest_ack == ^uint32(0) || int32(seq-client.newest_ack) > 0 {
+		client.newest_ack = seq
+	}
+	return verified
+}
+
+// decompress copies the payload into buffer, decompressing it if the packet was compressed
+func (client *rUDPConnection) decompress(buffer []byte, header packet.Header, payload []byte) (int, error) {
+	conn := client.server
+	if header.Compressed() {
+		decompressed, err := client.codec.Decompress(conn.scratch[:0], payload)
+		conn.scratch = decompressed
+		if err != nil {
+			return 0, err
+		}
+		payload = decompressed
+	}
+	copy(buffer, payload)
+	return len(payload), nil
 }
 
 // ProcessAck takes the acknowledgements from the remote resource and removes packets from the local
@@ -1,12 +1,59 @@
 package server
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"net"
+	"net/netip"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/jomstead/go-rudp/client"
+	"github.com/jomstead/go-rudp/clock/clocktest"
+	"github.com/jomstead/go-rudp/packet"
+	"github.com/jomstead/go-rudp/secure"
+	"github.com/jomstead/go-rudp/token"
+	"github.com/jomstead/go-rudp/transport"
 )
 
+// reader calls ReadFromUDP in a goroutine, which answers connect requests while the test connects clients
+type reader struct {
+	server *RUDPServer
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// serve starts reading from the server's first socket
+func serve(server *RUDPServer) *reader {
+	r := &reader{server: server, stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(r.done)
+		temp := make([]byte, 1024)
+		for {
+			select {
+			case <-r.stop:
+				return
+			default:
+			}
+			if _, _, _, err := server.ReadFromUDP(temp); err != nil && !server.IsConnected() {
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// pause stops reading and waits for the reader, the test can look at the server's state until it calls serve
+// again.  The read deadline is in the system clock's time.
+func (r *reader) pause() {
+	close(r.stop)
+	r.server.conn.SetReadDeadline(time.Now())
+	<-r.done
+	r.server.conn.SetReadDeadline(time.Time{})
+}
+
 func TestRUDP_ServerReliablePacketsRemovedFromQueue(t *testing.T) {
 	packets := []uint32{0, 1, 2, 3}
 
@@ -20,16 +67,15 @@ func TestRUDP_ServerReliablePacketsRemovedFromQueue(t *testing.T) {
 }
 
 func TestRUDP_ServerReliablePacketsVerifiedTest(t *testing.T) {
-	// setup the server
-	address := "127.0.0.1:8000"
-	s, _ := net.ResolveUDPAddr("udp4", address)
-	c, _ := net.ListenUDP("udp4", s)
+	t.Parallel()
+	// setup the server and client on an in-memory transport
+	c, cc := transport.Pipe()
+	s := c.LocalAddr().(*net.UDPAddr)
 	server := RUDPServer{}
 	server.Initialize(c, s)
 	defer server.Close()
 
 	// setup the client
-	cc, _ := net.DialUDP("udp4", nil, s)
 	client := client.RUDPClient{}
 	client.Initialize(cc, s)
 
@@ -60,10 +106,10 @@ func TestRUDP_ServerReliablePacketsVerifiedTest(t *testing.T) {
 }
 
 func TestRUDP_ServerPacketTest(t *testing.T) {
-	// setup the server
-	address := "127.0.0.1:8000"
-	s, _ := net.ResolveUDPAddr("udp4", address)
-	c, _ := net.ListenUDP("udp4", s)
+	t.Parallel()
+	// setup the server and client on an in-memory transport
+	c, cc := transport.Pipe()
+	s := c.LocalAddr().(*net.UDPAddr)
 	server := RUDPServer{}
 	server.Initialize(c, s)
 	defer server.Close()
@@ -73,7 +119,6 @@ func TestRUDP_ServerPacketTest(t *testing.T) {
 	}
 
 	// setup the client
-	cc, _ := net.DialUDP("udp4", nil, s)
 	client := client.RUDPClient{}
 	client.Initialize(cc, s)
 
@@ -121,12 +166,14 @@ func TestRUDP_ServerPacketTest(t *testing.T) {
 		t.Error("client ReadFromUDP reports wrong packet size received")
 	}
 
-	// send a packet with an invalid byte[0]
-	cc.Write([]byte{2, 0, 0, 0, 0, 0, 0, 0, 1})
+	// send a packet with an invalid flag
+	server.ReportMalformed(true)
+	cc.WriteTo(packet.Header{Type: packet.TypeData, Flags: 1 << 7}.Append(nil), s)
 	temp = make([]byte, 1024)
 	_, _, _, err = server.ReadFromUDP(temp)
-	if err == nil {
-		t.Error("Didn't throw error for invalid packet header byte[0]")
+	server.ReportMalformed(false)
+	if !errors.Is(err, packet.ErrBadFlag) {
+		t.Error("Didn't throw error for invalid packet header flag")
 	}
 
 	// send a reliable packet
@@ -146,3 +193,1245 @@ func TestRUDP_ServerPacketTest(t *testing.T) {
 		t.Error("Read from UDP into a nil []byte?")
 	}
 }
+
+func TestRUDP_ServerEncryption(t *testing.T) {
+	t.Parallel()
+	// setup the server on an in-memory network
+	hub := transport.NewHub()
+	c, _ := hub.ListenPacket("10.0.0.1:9000")
+	s := c.LocalAddr().(*net.UDPAddr)
+	server := RUDPServer{}
+	server.Initialize(c, s)
+	defer server.Close()
+	key, _ := secure.GenerateKey()
+	server.SetKey(key)
+
+	// the server handles connect requests inside ReadFromUDP
+	received := make(chan []byte, 4)
+	go func() {
+		for {
+			temp := make([]byte, 1024)
+			n, _, addr, err := server.ReadFromUDP(temp)
+			if err != nil {
+				if !server.IsConnected() {
+					return
+				}
+				received <- nil
+				continue
+			}
+			received <- temp[:n]
+			// echo back
+			payload := temp[:n]
+			server.WriteToUDP(&payload, *addr, true)
+		}
+	}()
+
+	// a client without encryption is rejected
+	cc, _ := hub.ListenPacket("10.0.0.2:0")
+	plain := client.RUDPClient{}
+	plain.Initialize(cc, s)
+	defer plain.Close()
+	if err := plain.Connect(); err != client.ErrEncryptionRequired {
+		t.Errorf("Expected encryption required, received %v", err)
+	}
+	plain.Write(&[]byte{1}, false)
+	if <-received != nil {
+		t.Error("Server accepted an unencrypted packet")
+	}
+
+	// a client pinning a different key refuses the server
+	other, _ := secure.GenerateKey()
+	cc, _ = hub.ListenPacket("10.0.0.2:0")
+	wrong := client.RUDPClient{}
+	wrong.Initialize(cc, s)
+	defer wrong.Close()
+	wrong.EnableEncryption(other.PublicKey())
+	if err := wrong.Connect(); err != secure.ErrServerKeyMismatch {
+		t.Errorf("Expected server key mismatch, received %v", err)
+	}
+
+	// a client pinning the right key connects and exchanges encrypted packets
+	cc, _ = hub.ListenPacket("10.0.0.2:0")
+	pinned := client.RUDPClient{}
+	pinned.Initialize(cc, s)
+	defer pinned.Close()
+	pinned.EnableEncryption(server.PublicKey())
+	if err := pinned.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if !pinned.ServerKey().Equal(server.PublicKey()) {
+		t.Error("Client did not record the server key")
+	}
+	payload := []byte("secret")
+	n, _, err := pinned.Write(&payload, true)
+	if err != nil || n != len(payload) {
+		t.Error("Failed to write an encrypted packet")
+	}
+	if !bytes.Equal(<-received, payload) {
+		t.Error("Server did not decrypt the payload")
+	}
+	temp := make([]byte, 1024)
+	n, verified, _, err := pinned.ReadFromUDP(temp)
+	if err != nil || !bytes.Equal(temp[:n], payload) {
+		t.Error("Client did not decrypt the echo")
+	}
+	if len(verified) != 1 {
+		t.Error("Encrypted packets did not carry acknowledgements")
+	}
+}
+
+func TestRUDP_ServerAcceptSize(t *testing.T) {
+	t.Parallel()
+	// an endpoint plays the client so we can send connect requests by hand
+	c, cc := transport.Pipe()
+	s := c.LocalAddr().(*net.UDPAddr)
+	server := RUDPServer{}
+	server.Initialize(c, s)
+	server.SetTimeout(time.Minute, time.Minute)
+	defer server.Close()
+	key, _ := secure.GenerateKey()
+	server.SetKey(key)
+	r := serve(&server)
+	defer r.pause()
+
+	ephemeral, _ := secure.GenerateKey()
+	request := packet.Connect{Key: ephemeral.PublicKey().Bytes()}.Marshal()
+	// the encrypted accept with its ticket is larger than an unpadded request, the server doesn't answer it
+	unpadded := request[:packet.ControlHeaderSize+1+1+secure.KeySize+2+1+1+1]
+	temp := make([]byte, 1024)
+	cc.WriteTo(unpadded, s)
+	cc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := cc.ReadFrom(temp); err == nil {
+		t.Errorf("The server answered a %d byte request with %d bytes", len(unpadded), n)
+	}
+	// padded requests are answered, and so are their resends, never with more than the request
+	cc.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 2; i++ {
+		cc.WriteTo(request, s)
+		n, _, err := cc.ReadFrom(temp)
+		if err != nil || packet.Type(temp[3]) != packet.TypeAccept {
+			t.Fatalf("Expected an accept for request %d, got %v and error %v", i, temp[:n], err)
+		}
+		if n > len(request) {
+			t.Errorf("The %d byte accept is larger than the %d byte request", n, len(request))
+		}
+	}
+}
+
+func TestRUDP_ServerConnectTokens(t *testing.T) {
+	t.Parallel()
+	// setup the server on an in-memory network
+	hub := transport.NewHub()
+	c, _ := hub.ListenPacket("10.0.0.1:9000")
+	s := c.LocalAddr().(*net.UDPAddr)
+	server := RUDPServer{}
+	server.Initialize(c, s)
+	defer server.Close()
+	key, _ := token.GenerateKey()
+	server.SetTokenKey(key)
+	r := serve(&server)
+
+	connect := func(data []byte) (*client.RUDPClient, error) {
+		cc, _ := hub.ListenPacket("10.0.0.2:0")
+		c := client.RUDPClient{}
+		c.Initialize(cc, s)
+		c.SetConnectToken(data)
+		return &c, c.Connect()
+	}
+
+	// expired and invalid tokens are dropped and counted
+	expired, _ := token.Generate(key, token.Token{ClientID: 1, Addresses: []netip.AddrPort{s.AddrPort()}, Expires: time.Now().Add(-time.Second)})
+	c1, err := connect(expired)
+	defer c1.Close()
+	if err != client.ErrConnectTimeout {
+		t.Error("Connected with an expired token")
+	}
+	wrong_server, _ := token.Generate(key, token.Token{ClientID: 1, Addresses: []netip.AddrPort{netip.MustParseAddrPort("10.0.0.1:1")}, Expires: time.Now().Add(time.Minute)})
+	c2, err := connect(wrong_server)
+	defer c2.Close()
+	if err != client.ErrConnectTimeout {
+		t.Error("Connected with a token for another server")
+	}
+	r.pause()
+	if len(server.connections) != 0 {
+		t.Error("Server created state for a client with an invalid token")
+	}
+	r = serve(&server)
+
+	// a valid token connects
+	valid, _ := token.Generate(key, token.Token{ClientID: 7, Addresses: []netip.AddrPort{s.AddrPort()}, Expires: time.Now().Add(time.Minute), UserData: []byte{1}})
+	c3, err := connect(valid)
+	defer c3.Close()
+	if err != nil {
+		t.Fatalf("Failed to connect with a valid token: %s", err)
+	}
+
+	// the same token from another address is a replay
+	c4, err := connect(valid)
+	defer c4.Close()
+	if err != client.ErrConnectTimeout {
+		t.Error("Connected with a replayed token")
+	}
+
+	r.pause()
+	counters := server.Counters()
+	if counters.ExpiredTokens == 0 || counters.InvalidTokens == 0 || counters.ReplayedTokens == 0 {
+		t.Errorf("Dropped tokens were not counted: %+v", counters)
+	}
+	if len(server.connections) != 1 {
+		t.Errorf("Expected 1 connection, found %d", len(server.connections))
+	}
+	for addr := range server.connections {
+		tok, ok := server.Token(addr)
+		if !ok || tok.ClientID != 7 || tok.UserData[0] != 1 {
+			t.Error("Server did not keep the client's token")
+		}
+	}
+}
+
+func TestRUDP_ServerCookieChallenge(t *testing.T) {
+	t.Parallel()
+	// setup the server on an in-memory network
+	hub := transport.NewHub()
+	c, _ := hub.ListenPacket("10.0.0.1:9000")
+	s := c.LocalAddr().(*net.UDPAddr)
+	server := RUDPServer{}
+	server.Initialize(c, s)
+	defer server.Close()
+	server.EnableCookies()
+
+	// a spoofed connect request only gets a challenge, no state
+	cc, _ := hub.ListenPacket("10.0.0.2:0")
+	defer cc.Close()
+	request := packet.Connect{}.Marshal()
+	cc.WriteTo(request, s)
+	r := serve(&server)
+	challenge := make([]byte, 1024)
+	cc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := cc.ReadFrom(challenge)
+	if h, _ := packet.ParseHeader(challenge[:n]); err != nil || h.Type != packet.TypeChallenge {
+		t.Fatal("Expected a challenge")
+	}
+	if n > len(request) {
+		t.Errorf("Challenge (%d bytes) is larger than the request (%d bytes)", n, len(request))
+	}
+
+	// a forged cookie gets another challenge
+	forged := packet.Connect{Cookie: make([]byte, secure.CookieSize)}.Marshal()
+	cc.WriteTo(forged, s)
+	n, _, _ = cc.ReadFrom(challenge)
+	if h, _ := packet.ParseHeader(challenge[:n]); h.Type != packet.TypeChallenge {
+		t.Error("Expected a challenge for a forged cookie")
+	}
+
+	// data from an address that hasn't connected is rejected
+	cc.WriteTo(append(packet.Header{Type: packet.TypeData}.Append(nil), 1), s)
+
+	// the client answers the challenge inside Connect
+	cc2, _ := hub.ListenPacket("10.0.0.2:0")
+	client := client.RUDPClient{}
+	client.Initialize(cc2, s)
+	defer client.Close()
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	r.pause()
+	counters := server.Counters()
+	if counters.Challenges != 3 || counters.InvalidCookies != 1 {
+		t.Errorf("Unexpected counters: %+v", counters)
+	}
+	if len(server.connections) != 1 {
+		t.Errorf("Expected 1 connection, found %d", len(server.connections))
+	}
+}
+
+func TestRUDP_ServerFull(t *testing.T) {
+	t.Parallel()
+	// setup the server on an in-memory network
+	hub := transport.NewHub()
+	c, _ := hub.ListenPacket("10.0.0.1:9000")
+	s := c.LocalAddr().(*net.UDPAddr)
+	server := RUDPServer{}
+	server.Initialize(c, s)
+	defer server.Close()
+	server.SetMaxConnections(1, 2)
+	if server.MaxConnections() != 1 {
+		t.Error("MaxConnections returned the wrong value")
+	}
+
+	clients := make([]*client.RUDPClient, 4)
+	sockets := make([]*transport.Endpoint, 4)
+	for i := range clients {
+		sockets[i], _ = hub.ListenPacket("10.0.0.2:0")
+		clients[i] = &client.RUDPClient{}
+		clients[i].Initialize(sockets[i], s)
+		defer clients[i].Close()
+	}
+	temp := make([]byte, 1024)
+	read := func() {
+		server.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		server.ReadFromUDP(temp)
+	}
+
+	// the first client gets the only connection
+	clients[0].Write(&[]byte{1}, false)
+	read()
+	if server.ConnectionCount() != 1 {
+		t.Fatalf("Expected 1 connection, found %d", server.ConnectionCount())
+	}
+
+	// the next two are queued in order and the last is rejected without a place
+	for i := 1; i < 4; i++ {
+		clients[i].Write(&[]byte{1}, false)
+		read()
+		_, _, _, err := clients[i].ReadFromUDP(temp)
+		var full *client.ServerFullError
+		if !errors.As(err, &full) || !errors.Is(err, client.ErrServerFull) {
+			t.Fatalf("Client %d expected server full, received %v", i, err)
+		}
+		expected := i
+		if i == 3 {
+			expected = 0
+		}
+		if full.Position != expected {
+			t.Errorf("Client %d expected queue position %d, received %d", i, expected, full.Position)
+		}
+	}
+	if server.QueueLength() != 2 || server.Counters().ServerFull != 3 {
+		t.Error("Expected 2 queued clients and 3 rejections")
+	}
+
+	// a free connection goes to the front of the queue, not to whoever asks first
+	server.Disconnect(sockets[0].AddrPort())
+	clients[2].Write(&[]byte{1}, false)
+	read()
+	if server.ConnectionCount() != 0 {
+		t.Error("Second in the queue took the free connection")
+	}
+	clients[1].Write(&[]byte{1}, false)
+	read()
+	if server.ConnectionCount() != 1 || server.QueueLength() != 1 {
+		t.Error("Front of the queue did not get the free connection")
+	}
+}
+
+func TestRUDP_ServerDropsMalformed(t *testing.T) {
+	t.Parallel()
+	// setup the server on an in-memory network
+	hub := transport.NewHub()
+	c, _ := hub.ListenPacket("10.0.0.1:9000")
+	s := c.LocalAddr().(*net.UDPAddr)
+	server := RUDPServer{}
+	server.Initialize(c, s)
+	defer server.Close()
+
+	cc, _ := hub.ListenPacket("10.0.0.2:0")
+	defer cc.Close()
+	reliable := packet.Header{Type: packet.TypeData, Flags: packet.FlagReliable}.Append(nil)
+	malformed := [][]byte{
+		{},
+		{0, 0, 0},
+		reliable[:len(reliable)-1],
+		packet.Header{Type: packet.TypeData, Flags: 1 << 7}.Append(nil),
+		packet.Header{Type: packet.TypeConnect, Flags: packet.FlagReliable}.Append(nil),
+		{0x52, 0x55, packet.Version + 1, uint8(packet.TypeData), 0},
+		append(packet.Header{Type: packet.TypeData, Flags: packet.FlagCompressed}.Append(nil), 1),
+	}
+	for _, data := range malformed {
+		cc.WriteTo(data, s)
+	}
+	// a valid packet after the malformed ones is the first thing returned
+	cc.WriteTo(append(packet.Header{Type: packet.TypeData}.Append(nil), 42), s)
+	temp := make([]byte, 1024)
+	server.conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, _, err := server.ReadFromUDP(temp)
+	if err != nil || n != 1 || temp[0] != 42 {
+		t.Fatalf("Expected the valid packet, got %d bytes and error %v", n, err)
+	}
+	if server.Counters().Malformed != uint64(len(malformed)) {
+		t.Errorf("Expected %d malformed packets, counted %d", len(malformed), server.Counters().Malformed)
+	}
+}
+
+func TestRUDP_ServerVersionAndDisconnect(t *testing.T) {
+	t.Parallel()
+	// setup the server on an in-memory network
+	hub := transport.NewHub()
+	c, _ := hub.ListenPacket("10.0.0.1:9000")
+	s := c.LocalAddr().(*net.UDPAddr)
+	server := RUDPServer{}
+	server.Initialize(c, s)
+	defer server.Close()
+	r := serve(&server)
+
+	// a connect request from another protocol version is rejected with a reason
+	cc, _ := hub.ListenPacket("10.0.0.2:0")
+	defer cc.Close()
+	request := packet.Connect{}.Marshal()
+	request[2] = packet.Version + 1
+	cc.WriteTo(request, s)
+	reject := make([]byte, 1024)
+	cc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := cc.ReadFrom(reject)
+	if h, _ := packet.ParseHeader(reject[:n]); err != nil || h.Type != packet.TypeReject || reject[n-1] != packet.RejectBadVersion {
+		t.Fatal("Expected a bad version reject")
+	}
+
+	// closing a connected client frees its connection
+	cc2, _ := hub.ListenPacket("10.0.0.2:0")
+	client := client.RUDPClient{}
+	client.Initialize(cc2, s)
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	r.pause()
+	if server.ConnectionCount() != 1 {
+		t.Fatalf("Expected 1 connection, found %d", server.ConnectionCount())
+	}
+	r = serve(&server)
+	client.Close()
+	time.Sleep(50 * time.Millisecond)
+	r.pause()
+	if server.ConnectionCount() != 0 {
+		t.Errorf("Expected the disconnect to free the connection, found %d connections", server.ConnectionCount())
+	}
+	// the application may still hold the address
+	if _, _, err := server.WriteToUDP(&[]byte{1}, cc2.AddrPort(), true); !errors.Is(err, ErrUnknownConnection) {
+		t.Errorf("Expected ErrUnknownConnection writing to a disconnected client, got %v", err)
+	}
+}
+
+func TestRUDP_ServerChecksums(t *testing.T) {
+	t.Parallel()
+	// setup the server on an in-memory network
+	hub := transport.NewHub()
+	c, _ := hub.ListenPacket("10.0.0.1:9000")
+	s := c.LocalAddr().(*net.UDPAddr)
+	server := RUDPServer{}
+	server.Initialize(c, s)
+	defer server.Close()
+	server.EnableChecksums()
+
+	cc, _ := hub.ListenPacket("10.0.0.2:0")
+	client := client.RUDPClient{}
+	client.Initialize(cc, s)
+	defer client.Close()
+	client.EnableChecksums()
+	done := make(chan error)
+	go func() {
+		done <- client.Connect()
+	}()
+	// handle the connect request, ReadFromUDP only returns data packets
+	temp := make([]byte, 1024)
+	server.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	server.ReadFromUDP(temp)
+	if err := <-done; err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	server.conn.SetReadDeadline(time.Now().Add(time.Second))
+	addr := cc.AddrPort()
+	if !server.connections[addr].checksum {
+		t.Fatal("Checksums were not agreed")
+	}
+
+	// a corrupted packet is dropped and counted, the next packet is delivered
+	corrupted := packet.AppendChecksum(append(packet.Header{Type: packet.TypeData, Flags: packet.FlagChecksum}.Append(nil), 1))
+	corrupted[packet.ControlHeaderSize] ^= 0x10
+	cc.WriteTo(corrupted, s)
+	client.Write(&[]byte{7}, true)
+	n, _, _, err := server.ReadFromUDP(temp)
+	if err != nil || n != 1 || temp[0] != 7 {
+		t.Fatalf("Expected the valid packet, got %d bytes and error %v", n, err)
+	}
+	if server.Counters().Corrupted != 1 || server.CorruptedPackets(addr) != 1 {
+		t.Error("Corrupted packet was not counted")
+	}
+
+	// packets without a checksum are refused once checksums are agreed
+	server.ReportMalformed(true)
+	cc.WriteTo(append(packet.Header{Type: packet.TypeData}.Append(nil), 1), s)
+	if _, _, _, err := server.ReadFromUDP(temp); !errors.Is(err, packet.ErrBadFlag) {
+		t.Errorf("Expected a packet without a checksum to be refused, received %v", err)
+	}
+
+	// the client checks the server's packets too
+	server.WriteToUDP(&[]byte{9}, addr, false)
+	cc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, _, err = client.ReadFromUDP(temp)
+	if err != nil || n != 1 || temp[0] != 9 {
+		t.Errorf("Client failed to read a checksummed packet: %d bytes, error %v", n, err)
+	}
+}
+
+func TestRUDP_ServerMigration(t *testing.T) {
+	t.Parallel()
+	// setup the server on an in-memory network
+	hub := transport.NewHub()
+	c, _ := hub.ListenPacket("10.0.0.1:9000")
+	s := c.LocalAddr().(*net.UDPAddr)
+	server := RUDPServer{}
+	server.Initialize(c, s)
+	defer server.Close()
+	key, _ := secure.GenerateKey()
+	server.SetKey(key)
+	type migration struct {
+		from, to netip.AddrPort
+	}
+	migrations := make(chan migration, 1)
+	server.OnMigrate(func(from netip.AddrPort, to netip.AddrPort) {
+		migrations <- migration{from, to}
+	})
+
+	cc, _ := hub.ListenPacket("10.0.0.2:0")
+	client := client.RUDPClient{}
+	client.Initialize(cc, s)
+	client.EnableEncryption(key.PublicKey())
+	defer client.Close()
+	done := make(chan error)
+	go func() {
+		done <- client.Connect()
+	}()
+	// handle the connect request, ReadFromUDP only returns data packets
+	temp := make([]byte, 1024)
+	server.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	server.ReadFromUDP(temp)
+	if err := <-done; err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	server.conn.SetReadDeadline(time.Now().Add(time.Second))
+	old := cc.AddrPort()
+	id := server.connections[old].id
+
+	// a packet with the client's id from another address that isn't sealed with its keys is not challenged
+	attacker, _ := hub.ListenPacket("10.0.0.2:0")
+	defer attacker.Close()
+	attacker.WriteTo(append(packet.Header{Type: packet.TypeData, Flags: packet.FlagConnection | packet.FlagEncrypted, ConnID: id}.Append(nil), make([]byte, secure.Overhead)...), s)
+	if _, _, _, err := server.ReadFromUDP(temp); err == nil {
+		t.Fatal("Expected the forged packet to fail authentication")
+	}
+	challenge := make([]byte, 1024)
+	attacker.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, _, err := attacker.ReadFrom(challenge); err == nil {
+		t.Fatalf("The forged packet was answered with %v", challenge[:n])
+	}
+	// answering a challenge it never got doesn't move the connection either
+	wrong := packet.Header{Type: packet.TypePathResponse, Flags: packet.FlagConnection | packet.FlagEncrypted, ConnID: id}.Append(nil)
+	attacker.WriteTo(append(wrong, make([]byte, 8+secure.Overhead)...), s)
+	client.Write(&[]byte{2}, false)
+	if _, _, addr, _ := server.ReadFromUDP(temp); *addr != old || server.connections[old] == nil {
+		t.Fatal("The connection moved without a valid path response")
+	}
+
+	// the client switches sockets, the server follows once it answers the challenge
+	cc2, _ := hub.ListenPacket("10.0.0.2:0")
+	client.Migrate(cc2)
+	moved := cc2.AddrPort()
+	client.Write(&[]byte{3}, false)
+	answered := make(chan struct{})
+	go func() {
+		// answers the path challenge
+		defer close(answered)
+		cc2.SetReadDeadline(time.Now().Add(time.Second))
+		client.ReadFromUDP(make([]byte, 1024))
+	}()
+	if _, _, addr, err := server.ReadFromUDP(temp); err != nil || *addr != old {
+		t.Fatalf("Expected the packet to be reported from the old address until the path is validated, got %v", addr)
+	}
+	// handles the path response
+	r := serve(&server)
+	defer r.pause()
+	defer func() { <-answered }()
+	select {
+	case m := <-migrations:
+		if m.from != old || m.to != moved {
+			t.Errorf("Migrated from %v to %v, expected %v to %v", m.from, m.to, old, moved)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The server did not follow the client")
+	}
+}
+
+func TestRUDP_ServerMigrationUnencrypted(t *testing.T) {
+	t.Parallel()
+	hub := transport.NewHub()
+	c, _ := hub.ListenPacket("10.0.0.1:9000")
+	s := c.LocalAddr().(*net.UDPAddr)
+	server := RUDPServer{}
+	server.Initialize(c, s)
+	defer server.Close()
+	r := serve(&server)
+	cc, _ := hub.ListenPacket("10.0.0.2:0")
+	client := client.RUDPClient{}
+	client.Initialize(cc, s)
+	defer client.Close()
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	r.pause()
+	old := cc.AddrPort()
+	id := server.connections[old].id
+
+	// anyone on the path sees the id of an unencrypted client, packets with it from another address are not the
+	// client's and are never challenged
+	attacker, _ := hub.ListenPacket("10.0.0.3:0")
+	defer attacker.Close()
+	attacker.WriteTo(append(packet.Header{Type: packet.TypeData, Flags: packet.FlagConnection, ConnID: id}.Append(nil), 1), s)
+	server.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, addr, err := server.ReadFromUDP(make([]byte, 1024)); err == nil {
+		t.Errorf("The copied packet was delivered from %v: %d bytes", addr, n)
+	}
+	attacker.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := attacker.ReadFrom(make([]byte, 1024)); err == nil {
+		t.Error("The copied packet was answered")
+	}
+	if server.connections[old] == nil || server.connections[old].path_addr.IsValid() {
+		t.Error("The connection was challenged from another address")
+	}
+}
+
+func TestRUDP_ServerResume(t *testing.T) {
+	t.Parallel()
+	// setup the server on an in-memory network
+	hub := transport.NewHub()
+	c, _ := hub.ListenPacket("10.0.0.1:9000")
+	s := c.LocalAddr().(*net.UDPAddr)
+	server := RUDPServer{}
+	server.Initialize(c, s)
+	server.SetTimeout(200*time.Millisecond, 300*time.Millisecond)
+	key, _ := secure.GenerateKey()
+	server.SetKey(key)
+	defer server.Close()
+	migrations := make(chan netip.AddrPort, 1)
+	server.OnMigrate(func(from netip.AddrPort, to netip.AddrPort) {
+		migrations <- to
+	})
+
+	errNoTicket, errResumeFailed := client.ErrNoTicket, client.ErrResumeFailed
+	cc, _ := hub.ListenPacket("10.0.0.2:0")
+	client := client.RUDPClient{}
+	client.Initialize(cc, s)
+	client.EnableEncryption(server.PublicKey())
+	client.SetDialer(func() (net.PacketConn, error) {
+		return hub.ListenPacket("10.0.0.3:0")
+	})
+	defer client.Close()
+	temp := make([]byte, 1024)
+	// handle the connect request, ReadFromUDP only returns data packets
+	handshake := func(f func() error) error {
+		done := make(chan error)
+		go func() {
+			done <- f()
+		}()
+		server.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		server.ReadFromUDP(temp)
+		server.conn.SetReadDeadline(time.Now().Add(time.Second))
+		return <-done
+	}
+	if err := handshake(client.Resume); !errors.Is(err, errNoTicket) {
+		t.Errorf("Expected ErrNoTicket before connecting, got %v", err)
+	}
+	if err := handshake(client.Connect); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	client.Write(&[]byte{1}, true)
+	if _, _, _, err := server.ReadFromUDP(temp); err != nil {
+		t.Fatalf("Failed to read the first packet: %s", err)
+	}
+	old := cc.AddrPort()
+	ticket := append([]byte{}, server.connections[old].ticket...)
+
+	// the client loses its socket and resumes from a new one
+	if err := handshake(client.Reconnect); err != nil {
+		t.Fatalf("Failed to resume: %s", err)
+	}
+	var moved netip.AddrPort
+	select {
+	case moved = <-migrations:
+		if moved == old || server.connections[moved] == nil {
+			t.Fatalf("Expected the connection to move to the new address, got %v", moved)
+		}
+		if bytes.Equal(server.connections[moved].ticket, ticket) {
+			t.Error("Expected a new ticket after resuming")
+		}
+	default:
+		t.Fatal("The server did not move the resumed connection")
+	}
+	_, seq, _ := client.Write(&[]byte{2}, true)
+	if seq != 1 {
+		t.Errorf("Expected the sequence to continue at 1, got %d", seq)
+	}
+	if n, _, _, err := server.ReadFromUDP(temp); err != nil || n != 1 || temp[0] != 2 {
+		t.Errorf("Failed to read after resuming: %v", err)
+	}
+
+	// a resume request with a wrong proof is rejected
+	fake, _ := hub.ListenPacket("10.0.0.2:0")
+	defer fake.Close()
+	request := packet.Connect{Key: make([]byte, secure.KeySize), Resume: make([]byte, packet.ConnectionIDSize+secure.ProofSize)}
+	binary.BigEndian.PutUint64(request.Resume, server.connections[moved].id)
+	fake.WriteTo(request.Marshal(), s)
+	server.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	server.ReadFromUDP(temp)
+	fake.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := fake.ReadFrom(temp)
+	if err != nil || n != packet.ControlHeaderSize+1 || temp[packet.ControlHeaderSize] != packet.RejectResume {
+		t.Errorf("Expected a resume rejection, got %v and error %v", temp[:n], err)
+	}
+	if server.Counters().FailedResumes != 1 {
+		t.Errorf("Expected 1 failed resume, got %d", server.Counters().FailedResumes)
+	}
+
+	// the connection is gone after the timeout and grace period
+	time.Sleep(600 * time.Millisecond)
+	if server.ConnectionCount() != 0 {
+		t.Errorf("Expected the connection to expire, %d left", server.ConnectionCount())
+	}
+	if err := handshake(client.Resume); !errors.Is(err, errResumeFailed) {
+		t.Errorf("Expected ErrResumeFailed after the grace period, got %v", err)
+	}
+}
+
+func TestRUDP_ServerResumeUnencrypted(t *testing.T) {
+	t.Parallel()
+	c, cc := transport.Pipe()
+	server := RUDPServer{}
+	server.Initialize(c, nil)
+	server.SetTimeout(time.Second, time.Second)
+	defer server.Close()
+	r := serve(&server)
+	rc := client.RUDPClient{}
+	rc.Initialize(cc, c.LocalAddr().(*net.UDPAddr))
+	defer rc.Close()
+	if err := rc.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	// the ticket would travel in the clear, the server gives none
+	if err := rc.Resume(); !errors.Is(err, client.ErrNoTicket) {
+		t.Errorf("Expected ErrNoTicket from an unencrypted server, got %v", err)
+	}
+	r.pause()
+	for _, connection := range server.connections {
+		if connection.ticket != nil {
+			t.Error("Unencrypted server kept a ticket")
+		}
+	}
+}
+
+func TestRUDP_ServerConnectAgain(t *testing.T) {
+	t.Parallel()
+	c, cc := transport.Pipe()
+	server := RUDPServer{}
+	server.Initialize(c, nil)
+	defer server.Close()
+	s := c.LocalAddr().(*net.UDPAddr)
+	r := serve(&server)
+	first := client.RUDPClient{}
+	first.Initialize(cc, s)
+	if err := first.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	r.pause()
+	temp := make([]byte, 1024)
+	server.conn.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 3; i++ {
+		first.Write(&[]byte{1}, true)
+		if _, _, _, err := server.ReadFromUDP(temp); err != nil {
+			t.Fatalf("Failed to read packet %d: %s", i, err)
+		}
+	}
+	addr := cc.AddrPort()
+	server.WriteToUDP(&[]byte{1}, addr, true)
+
+	// the client restarts on the same address without disconnecting and numbers its packets from 0 again
+	r = serve(&server)
+	second := client.RUDPClient{}
+	second.Initialize(cc, s)
+	defer second.Close()
+	if err := second.Connect(); err != nil {
+		t.Fatalf("Failed to connect again: %s", err)
+	}
+	r.pause()
+	server.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, seq, _ := second.Write(&[]byte{2}, true); seq != 0 {
+		t.Errorf("Expected the new connection to start at sequence 0, got %d", seq)
+	}
+	if n, _, _, err := server.ReadFromUDP(temp); err != nil || n != 1 || temp[0] != 2 {
+		t.Fatalf("Expected the reliable packet after connecting again, got %d bytes and error %v", n, err)
+	}
+	if _, seq, _ := server.WriteToUDP(&[]byte{3}, addr, true); seq != 0 {
+		t.Errorf("Expected the server to start over at sequence 0, got %d", seq)
+	}
+	if len(server.connections[addr].unverified) != 1 {
+		t.Errorf("Expected only the new reliable packet to wait for an ack, got %v", server.connections[addr].unverified)
+	}
+}
+
+func TestRUDP_ServerConnectSpoofed(t *testing.T) {
+	t.Parallel()
+	c, cc := transport.Pipe()
+	server := RUDPServer{}
+	server.Initialize(c, nil)
+	defer server.Close()
+	s := c.LocalAddr().(*net.UDPAddr)
+	r := serve(&server)
+	first := client.RUDPClient{}
+	first.Initialize(cc, s)
+	defer first.Close()
+	if err := first.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	r.pause()
+	temp := make([]byte, 1024)
+	server.conn.SetReadDeadline(time.Now().Add(time.Second))
+	first.Write(&[]byte{1}, true)
+	if _, _, _, err := server.ReadFromUDP(temp); err != nil {
+		t.Fatalf("Failed to read the first packet: %s", err)
+	}
+	addr := cc.AddrPort()
+	live := server.connections[addr]
+	server.WriteToUDP(&[]byte{1}, addr, true)
+
+	// a connect request from the client's address that the client didn't send, spoofed or replayed
+	spoofed := append(packet.Header{Type: packet.TypeConnect}.Append(nil), packet.Connect{}.Marshal()...)
+	cc.WriteTo(spoofed, s)
+	first.Write(&[]byte{2}, true)
+	if n, _, _, err := server.ReadFromUDP(temp); err != nil || n != 1 || temp[0] != 2 {
+		t.Fatalf("Expected the client's packet on its old connection, got %d bytes and error %v", n, err)
+	}
+	// the connection carries on where it was
+	if _, seq, _ := server.WriteToUDP(&[]byte{3}, addr, true); seq != 1 {
+		t.Errorf("Expected the server to carry on at sequence 1, got %d", seq)
+	}
+	if server.connections[addr] != live || server.ids[live.id] != live {
+		t.Error("The spoofed request replaced the connection")
+	}
+}
+
+func TestRUDP_ServerReconnectTransport(t *testing.T) {
+	t.Parallel()
+	hub := transport.NewHub()
+	c, _ := hub.ListenPacket("10.0.0.1:9000")
+	server := RUDPServer{}
+	server.Initialize(c, nil)
+	server.SetTimeout(time.Second, time.Second)
+	key, _ := secure.GenerateKey()
+	server.SetKey(key)
+	defer server.Close()
+	migrations := make(chan netip.AddrPort, 2)
+	server.OnMigrate(func(from netip.AddrPort, to netip.AddrPort) {
+		migrations <- to
+	})
+	r := serve(&server)
+	defer r.pause()
+
+	cc, _ := hub.ListenPacket("10.0.0.2:0")
+	rc := client.RUDPClient{}
+	rc.Initialize(cc, c.LocalAddr().(*net.UDPAddr))
+	rc.EnableEncryption(key.PublicKey())
+	defer rc.Close()
+	if err := rc.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+
+	// without a dialer the client resumes on its endpoint
+	if err := rc.Reconnect(); err != nil {
+		t.Fatalf("Failed to resume on the same endpoint: %s", err)
+	}
+	select {
+	case to := <-migrations:
+		t.Errorf("Moved to %v without a new socket", to)
+	default:
+	}
+
+	// a dialer moves it to a new endpoint on the same hub
+	var moved netip.AddrPort
+	rc.SetDialer(func() (net.PacketConn, error) {
+		e, err := hub.ListenPacket("10.0.0.3:0")
+		if err == nil {
+			moved = e.AddrPort()
+		}
+		return e, err
+	})
+	if err := rc.Reconnect(); err != nil {
+		t.Fatalf("Failed to resume from a new endpoint: %s", err)
+	}
+	select {
+	case to := <-migrations:
+		if to != moved {
+			t.Errorf("Moved to %v, expected %v", to, moved)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The server did not follow the client to its new endpoint")
+	}
+}
+
+func TestRUDP_ServerReconnectingClient(t *testing.T) {
+	t.Parallel()
+	// setup the server on an in-memory network, it is restarted later on the same address
+	hub := transport.NewHub()
+	c, _ := hub.ListenPacket("10.0.0.1:9000")
+	s := c.LocalAddr().(*net.UDPAddr)
+	received := make(chan []byte, 16)
+	var gate sync.Mutex
+	// only encrypted connections can resume, the restarted server keeps its key
+	key, _ := secure.GenerateKey()
+	serve := func(c net.PacketConn) *RUDPServer {
+		server := &RUDPServer{}
+		server.Initialize(c, s)
+		server.SetTimeout(time.Second, 5*time.Second)
+		server.SetKey(key)
+		go func() {
+			for server.IsConnected() {
+				buffer := make([]byte, 1024)
+				server.conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+				n, _, _, err := server.ReadFromUDP(buffer)
+				if err == nil && n > 0 {
+					received <- buffer[:n]
+				}
+				// held by the test to make the server go silent
+				gate.Lock()
+				gate.Unlock()
+			}
+		}()
+		return server
+	}
+	server := serve(c)
+
+	cc, _ := hub.ListenPacket("10.0.0.2:0")
+	rc := client.RUDPClient{}
+	rc.Initialize(cc, s)
+	rc.EnableEncryption(key.PublicKey())
+	reconnecting := client.NewReconnectingClient(&rc)
+	defer reconnecting.Close()
+	reconnecting.SetTimeout(50*time.Millisecond, 300*time.Millisecond)
+	reconnecting.SetBackoff(20*time.Millisecond, 100*time.Millisecond, 50)
+	reconnecting.BufferReliable(2)
+	events := make(chan client.Event, 64)
+	reconnecting.OnState(func(e client.Event) {
+		events <- e
+	})
+	flushed := make(chan uint32, 4)
+	reconnecting.OnFlush(func(payload []byte, seq uint32) {
+		flushed <- seq
+	})
+	expect := func(state client.State, resumed bool) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case e := <-events:
+				if e.State != state {
+					continue
+				}
+				if e.Resumed != resumed {
+					t.Errorf("Expected resumed %v, got %v", resumed, e.Resumed)
+				}
+				return
+			case <-timeout:
+				t.Fatalf("Expected the client to be %s, it is %s", state, reconnecting.State())
+			}
+		}
+	}
+	if err := reconnecting.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	expect(client.StateConnected, false)
+	go func() {
+		temp := make([]byte, 1024)
+		for {
+			if _, _, _, err := reconnecting.ReadFromUDP(temp); err != nil && reconnecting.State() != client.StateConnected {
+				return
+			}
+		}
+	}()
+	if _, seq, err := reconnecting.Write(&[]byte{1}, true); err != nil || seq != 0 {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	<-received
+
+	// the server goes silent, the client resumes its connection once it answers again
+	gate.Lock()
+	expect(client.StateReconnecting, false)
+	gate.Unlock()
+	expect(client.StateConnected, true)
+	if _, seq, err := reconnecting.Write(&[]byte{2}, true); err != nil || seq != 1 {
+		t.Errorf("Expected the sequence to continue at 1, got %d and error %v", seq, err)
+	}
+	<-received
+
+	// the server restarts without the connection, the client connects anew and sends what was buffered
+	server.Close()
+	expect(client.StateReconnecting, false)
+	if _, _, err := reconnecting.Write(&[]byte{3}, true); !errors.Is(err, client.ErrBuffered) {
+		t.Errorf("Expected the payload to be buffered, got %v", err)
+	}
+	reconnecting.Write(&[]byte{4}, true)
+	if _, _, err := reconnecting.Write(&[]byte{5}, true); !errors.Is(err, client.ErrNotConnected) {
+		t.Errorf("Expected the buffer to be full, got %v", err)
+	}
+	if _, _, err := reconnecting.Write(&[]byte{6}, false); !errors.Is(err, client.ErrNotConnected) {
+		t.Errorf("Expected unreliable packets to be refused, got %v", err)
+	}
+	c, err := hub.ListenPacket("10.0.0.1:9000")
+	if err != nil {
+		t.Fatalf("Failed to restart the server: %s", err)
+	}
+	server = serve(c)
+	defer server.Close()
+	expect(client.StateConnected, false)
+	for i, want := range []byte{3, 4} {
+		if seq := <-flushed; seq != uint32(i) {
+			t.Errorf("Expected buffered packet %d to be sent with sequence %d, got %d", want, i, seq)
+		}
+		if payload := <-received; payload[0] != want {
+			t.Errorf("Expected buffered payload %d, got %v", want, payload)
+		}
+	}
+}
+
+// packetConn hides the *net.UDPConn so the server and client only see a net.PacketConn
+type packetConn struct {
+	net.PacketConn
+}
+
+func TestRUDP_ServerPacketConn(t *testing.T) {
+	t.Parallel()
+	// real sockets, this checks the addresses a *net.UDPConn reports through the plain net.PacketConn methods
+	c, _ := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	s := c.LocalAddr().(*net.UDPAddr)
+	server := RUDPServer{}
+	server.Initialize(packetConn{c}, nil)
+	defer server.Close()
+	if server.address.Port != s.Port {
+		t.Errorf("Expected the server address to default to %v, got %v", s, server.address)
+	}
+
+	// an unconnected socket, e.g. one shared with a STUN client
+	cc, _ := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	client := client.RUDPClient{}
+	client.Initialize(packetConn{cc}, s)
+	defer client.Close()
+	done := make(chan error)
+	go func() {
+		done <- client.Connect()
+	}()
+	temp := make([]byte, 1024)
+	server.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	server.ReadFromUDP(temp)
+	if err := <-done; err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	server.conn.SetReadDeadline(time.Now().Add(time.Second))
+	client.Write(&[]byte{1}, true)
+	n, _, addr, err := server.ReadFromUDP(temp)
+	if err != nil || n != 1 || *addr != cc.LocalAddr().(*net.UDPAddr).AddrPort() {
+		t.Fatalf("Expected the packet from %v, got %v and error %v", cc.LocalAddr(), addr, err)
+	}
+
+	// packets from anyone but the server are ignored
+	stranger, _ := net.DialUDP("udp4", nil, cc.LocalAddr().(*net.UDPAddr))
+	defer stranger.Close()
+	stranger.Write(packet.Header{Type: packet.TypeData}.Append([]byte{}))
+	server.WriteToUDP(&[]byte{2}, *addr, true)
+	cc.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, from, err := client.ReadFromUDP(temp); err != nil || n != 1 || temp[0] != 2 || from.Port != s.Port {
+		t.Errorf("Expected the packet from the server, got %v from %v and error %v", temp[:n], from, err)
+	}
+}
+
+func TestRUDP_ServerTimeoutClock(t *testing.T) {
+	t.Parallel()
+	fake := clocktest.NewFake(time.Time{})
+	hub := transport.NewHub()
+	hub.SetClock(fake)
+	c, _ := hub.ListenPacket("10.0.0.1:9000")
+	server := RUDPServer{}
+	server.Initialize(c, nil)
+	server.SetClock(fake)
+	server.SetTimeout(time.Second, 0)
+	defer server.Close()
+
+	cc, _ := hub.ListenPacket("10.0.0.2:0")
+	client := client.RUDPClient{}
+	client.Initialize(cc, c.LocalAddr().(*net.UDPAddr))
+	client.SetClock(fake)
+	defer client.Close()
+	connected := make(chan error)
+	go func() {
+		err := client.Connect()
+		client.Write(&[]byte{1}, false)
+		connected <- err
+	}()
+	if _, _, _, err := server.ReadFromUDP(make([]byte, 1024)); err != nil {
+		t.Fatalf("Failed to read the first packet: %s", err)
+	}
+	if err := <-connected; err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+
+	// the client is only timed out once the clock passes the timeout, no matter how long the test takes
+	fake.Advance(900 * time.Millisecond)
+	if n := server.ConnectionCount(); n != 1 {
+		t.Errorf("%d connections before the timeout, expected 1", n)
+	}
+	fake.Advance(200 * time.Millisecond)
+	if n := server.ConnectionCount(); n != 0 {
+		t.Errorf("%d connections after the timeout, expected 0", n)
+	}
+}
+
+func TestRUDP_ServerStats(t *testing.T) {
+	t.Parallel()
+	fake := clocktest.NewFake(time.Time{})
+	hub := transport.NewHub()
+	hub.SetClock(fake)
+	c, _ := hub.ListenPacket("10.0.0.1:9000")
+	server := RUDPServer{}
+	server.Initialize(c, nil)
+	server.SetClock(fake)
+	defer server.Close()
+
+	cc, _ := hub.ListenPacket("10.0.0.2:0")
+	client := client.RUDPClient{}
+	client.Initialize(cc, c.LocalAddr().(*net.UDPAddr))
+	client.SetClock(fake)
+	defer client.Close()
+	connected := make(chan error)
+	go func() {
+		err := client.Connect()
+		client.Write(&[]byte{1}, false)
+		connected <- err
+	}()
+	temp := make([]byte, 1024)
+	_, _, addr, err := server.ReadFromUDP(temp)
+	if err != nil {
+		t.Fatalf("Failed to read the first packet: %s", err)
+	}
+	if err := <-connected; err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if _, ok := server.Stats(netip.MustParseAddrPort("10.0.0.3:1")); ok {
+		t.Error("Stats for an unknown address")
+	}
+
+	// three reliable packets acknowledged 40ms later
+	for i := 0; i < 3; i++ {
+		server.WriteToUDP(&[]byte{2}, *addr, true)
+	}
+	fake.Advance(40 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if _, _, _, err := client.ReadFromUDP(temp); err != nil {
+			t.Fatalf("Failed to read reliable packet %d: %s", i, err)
+		}
+	}
+	client.Write(&[]byte{3}, false)
+	_, verified, _, err := server.ReadFromUDP(temp)
+	if err != nil || len(verified) != 3 {
+		t.Fatalf("Expected the 3 reliable packets to be verified, got %v, %v", verified, err)
+	}
+
+	stats, ok := server.Stats(*addr)
+	if !ok {
+		t.Fatal("No stats for the client")
+	}
+	if stats.ReliableSent != 3 || stats.Acked != 3 || stats.Lost != 0 || stats.RTT != 40*time.Millisecond {
+		t.Errorf("Stats returned %+v", stats)
+	}
+	// the connect request and two unreliable packets
+	if stats.UnreliableReceived != 3 || stats.UnreliableSent != 1 {
+		t.Errorf("received %d and sent %d unreliable packets, expected 3 and the accept", stats.UnreliableReceived, stats.UnreliableSent)
+	}
+	total := server.TotalStats()
+	if total.Acked != 3 || total.RTT != 40*time.Millisecond || total.UnreliableBytesReceived != stats.UnreliableBytesReceived {
+		t.Errorf("TotalStats returned %+v", total)
+	}
+	if client := client.Stats(); client.ReliableReceived != 3 || client.UnreliableSent != 3 {
+		t.Errorf("client Stats returned %+v", client)
+	}
+
+	fake.Advance(time.Second)
+	if rate := server.TotalStats().SendRate; rate <= 0 {
+		t.Errorf("send rate %v after sending", rate)
+	}
+}
+
+func TestRUDP_ServerDuplicatesAndLost(t *testing.T) {
+	t.Parallel()
+	// an endpoint plays the client so we can repeat packets and acknowledge by hand
+	c, cc := transport.Pipe()
+	s := c.LocalAddr().(*net.UDPAddr)
+	server := RUDPServer{}
+	server.Initialize(c, s)
+	defer server.Close()
+	temp := make([]byte, 1024)
+
+	// a reliable packet that arrives twice is delivered twice and counted as a duplicate
+	reliable := append(packet.Header{Type: packet.TypeData, Flags: packet.FlagReliable, Seq: 0}.Append(nil), 1)
+	for i := 0; i < 2; i++ {
+		cc.WriteTo(reliable, s)
+		if n, _, _, err := server.ReadFromUDP(temp); err != nil || n != 1 || temp[0] != 1 {
+			t.Fatalf("Expected the reliable payload, got %v and error %v", temp[:n], err)
+		}
+	}
+	addr := cc.AddrPort()
+	if stats, _ := server.Stats(addr); stats.Duplicates != 1 {
+		t.Errorf("%d duplicates counted, expected 1", stats.Duplicates)
+	}
+
+	// the client only acknowledges the last of 40 packets, the first 7 fell out of the ack window
+	for i := 0; i < 40; i++ {
+		server.WriteToUDP(&[]byte{3}, addr, true)
+	}
+	ack := packet.Header{Type: packet.TypeAck, Flags: packet.FlagAck, Ack: 39}.Append(nil)
+	for i := 0; i < 2; i++ {
+		cc.WriteTo(ack, s)
+		n, verified, _, err := server.ReadFromUDP(temp)
+		if err != nil || n != 0 || (i == 0 && (len(verified) != 1 || verified[0] != 39)) {
+			t.Fatalf("Expected the ack to verify 39, got %v and error %v", verified, err)
+		}
+	}
+	// they are counted once, the repeated ack doesn't count them again
+	if stats, _ := server.Stats(addr); stats.Lost != 7 || stats.Acked != 1 {
+		t.Errorf("%d packets counted lost and %d acked, expected 7 and 1", stats.Lost, stats.Acked)
+	}
+}
+
+func TestRUDP_ServerAcknowledge(t *testing.T) {
+	t.Parallel()
+	c, cc := transport.Pipe()
+	s := c.LocalAddr().(*net.UDPAddr)
+	server := RUDPServer{}
+	server.Initialize(c, s)
+	defer server.Close()
+	key, _ := secure.GenerateKey()
+	server.SetKey(key)
+	r := serve(&server)
+	client := client.RUDPClient{}
+	client.Initialize(cc, s)
+	client.EnableEncryption(key.PublicKey())
+	defer client.Close()
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	r.pause()
+
+	// the client sends a reliable packet and the server has nothing to send back but the ack
+	temp := make([]byte, 1024)
+	server.conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, seq, _ := client.Write(&[]byte{1}, true)
+	_, _, addr, err := server.ReadFromUDP(temp)
+	if err != nil {
+		t.Fatalf("Failed to read the reliable packet: %s", err)
+	}
+	if err := server.Acknowledge(*addr); err != nil {
+		t.Fatalf("Acknowledge failed: %s", err)
+	}
+	cc.SetReadDeadline(time.Now().Add(time.Second))
+	n, verified, _, err := client.ReadFromUDP(temp)
+	if err != nil || n != 0 || len(verified) != 1 || verified[0] != seq {
+		t.Errorf("Expected the ack packet to verify %d, got %d bytes, %v and error %v", seq, n, verified, err)
+	}
+	if err := server.Acknowledge(netip.MustParseAddrPort("10.0.0.9:1")); err != ErrUnknownConnection {
+		t.Errorf("Expected ErrUnknownConnection, got %v", err)
+	}
+}
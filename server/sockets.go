@@ -0,0 +1,167 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/jomstead/go-rudp/clock"
+	"github.com/jomstead/go-rudp/transport"
+)
+
+// socket is one of the server's bound sockets
+type socket struct {
+	conn    net.PacketConn
+	udp     *net.UDPConn // conn if it is a UDP socket, read and written without allocating addresses
+	address *net.UDPAddr // address the socket was bound to, connect tokens must allow it
+}
+
+// newSocket wraps c, s is the address connect tokens must allow, the local address of c if it is nil
+func newSocket(c net.PacketConn, s *net.UDPAddr) *socket {
+	sock := &socket{conn: c, address: s}
+	sock.udp, _ = c.(*net.UDPConn)
+	if s == nil {
+		local, _ := transport.AddrPort(c.LocalAddr())
+		sock.address = net.UDPAddrFromAddrPort(local)
+	}
+	return sock
+}
+
+// readFrom reads the next packet, packets from addresses without an IP and port can't be answered and are dropped
+func (sock *socket) readFrom(b []byte) (int, netip.AddrPort, error) {
+	if sock.udp != nil {
+		return sock.udp.ReadFromUDPAddrPort(b)
+	}
+	for {
+		n, from, err := sock.conn.ReadFrom(b)
+		if err != nil {
+			return n, netip.AddrPort{}, err
+		}
+		if addr, ok := transport.AddrPort(from); ok {
+			return n, addr, nil
+		}
+	}
+}
+
+// writeTo sends b to addr
+func (sock *socket) writeTo(b []byte, addr netip.AddrPort) (int, error) {
+	if sock.udp != nil {
+		return sock.udp.WriteToUDPAddrPort(b, addr)
+	}
+	return sock.conn.WriteTo(b, net.UDPAddrFromAddrPort(addr))
+}
+
+// datagram is a packet read by a socket's reader
+type datagram struct {
+	data   []byte
+	addr   netip.AddrPort
+	socket *socket
+	err    error
+}
+
+// readerBuffers is the number of packets read ahead of ReadFromUDP when the server has several sockets
+const readerBuffers = 64
+
+// AddSocket adds another bound socket to the server, e.g. an IPv6 socket next to the IPv4 socket passed to
+// Initialize.  Packets from all sockets share one connection table and one ReadFromUDP, and each client is
+// answered from the socket its packets arrive on.  See Initialize for s.
+func (conn *RUDPServer) AddSocket(c net.PacketConn, s *net.UDPAddr) {
+	sock := newSocket(c, s)
+	conn.sockets = append(conn.sockets, sock)
+	if conn.received != nil {
+		go conn.readSocket(sock)
+	}
+}
+
+// Addrs returns the local addresses of the server's sockets
+func (conn *RUDPServer) Addrs() []*net.UDPAddr {
+	addrs := make([]*net.UDPAddr, 0, len(conn.sockets))
+	for _, sock := range conn.sockets {
+		local, _ := transport.AddrPort(sock.conn.LocalAddr())
+		addrs = append(addrs, net.UDPAddrFromAddrPort(local))
+	}
+	return addrs
+}
+
+// SetReadDeadline sets the deadline for ReadFromUDP on all sockets, the zero time means no deadline
+func (conn *RUDPServer) SetReadDeadline(t time.Time) error {
+	conn.deadline = t
+	if len(conn.sockets) == 1 {
+		return conn.conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+// read reads the next packet from any socket into conn.temp and remembers the socket it arrived on in conn.from
+func (conn *RUDPServer) read() (int, netip.AddrPort, error) {
+	if len(conn.sockets) == 1 {
+		conn.from = conn.sockets[0]
+		return conn.from.readFrom(conn.temp)
+	}
+	if conn.received == nil {
+		// one reader per socket, started on the first read
+		conn.received = make(chan datagram)
+		conn.free = make(chan []byte, readerBuffers)
+		for i := 0; i < readerBuffers; i++ {
+			conn.free <- make([]byte, len(conn.temp))
+		}
+		for _, sock := range conn.sockets {
+			go conn.readSocket(sock)
+		}
+	}
+	var timeout <-chan time.Time
+	if !conn.deadline.IsZero() {
+		timer := clock.Or(conn.clock).NewTimer(conn.deadline.Sub(conn.now()))
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+	select {
+	case d := <-conn.received:
+		n := copy(conn.temp, d.data)
+		conn.free <- d.data[:cap(d.data)]
+		conn.from = d.socket
+		return n, d.addr, d.err
+	case <-timeout:
+		return 0, netip.AddrPort{}, os.ErrDeadlineExceeded
+	case <-conn.closed:
+		return 0, netip.AddrPort{}, net.ErrClosed
+	}
+}
+
+// readSocket passes the packets read from sock to read until the socket is closed
+func (conn *RUDPServer) readSocket(sock *socket) {
+	for {
+		var buffer []byte
+		select {
+		case buffer = <-conn.free:
+		case <-conn.closed:
+			return
+		}
+		n, addr, err := sock.readFrom(buffer)
+		select {
+		case conn.received <- datagram{buffer[:n], addr, sock, err}:
+		case <-conn.closed:
+			return
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+	}
+}
+
+// reply sends data to addr from the socket the packet being processed arrived on
+func (conn *RUDPServer) reply(data []byte, addr netip.AddrPort) {
+	if _, err := conn.from.writeTo(data, addr); err != nil {
+		return
+	}
+	now := conn.now()
+	conn.total.Sent(len(data), false, 0, now)
+	if conn.observer != nil {
+		conn.observer.Packet(len(data), true)
+	}
+	if client := conn.connections[addr]; client != nil {
+		client.stats.Sent(len(data), false, 0, now)
+	}
+}
@@ -0,0 +1,230 @@
+package snapshot
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+/*
+*	Snapshot buffer - jitter buffer and interpolation helper for world state snapshots
+*	Payload Structure  [Tick][Timestamp][Data]
+*		Tick - server tick the snapshot was taken on (uint32)
+*		Timestamp - server time in milliseconds when the snapshot was taken (int64)
+*		Data - User provided world state
+*
+*	Snapshots are held for a playout delay that adapts to the measured jitter so that there is
+*	(almost) always a snapshot on either side of the render time to interpolate between.
+ */
+
+const HeaderSize = 12
+
+var ErrShortPayload = errors.New("snapshot payload is shorter than the snapshot header")
+
+type Snapshot struct {
+	Tick      uint32 // server tick the snapshot was taken on
+	Timestamp int64  // server time in milliseconds when the snapshot was taken
+	Data      []byte // world state
+}
+
+// Marshal prepends the snapshot header to the data so it can be sent with WriteToUDP
+func Marshal(tick uint32, timestamp int64, data []byte) []byte {
+	payload := make([]byte, HeaderSize, HeaderSize+len(data))
+	binary.BigEndian.PutUint32(payload[0:], tick)
+	binary.BigEndian.PutUint64(payload[4:], uint64(timestamp))
+	return append(payload, data...)
+}
+
+// Unmarshal reads a snapshot from a payload received with ReadFromUDP, the data is copied
+// so the read buffer can be reused
+func Unmarshal(payload []byte) (Snapshot, error) {
+	if len(payload) < HeaderSize {
+		return Snapshot{}, ErrShortPayload
+	}
+	data := make([]byte, len(payload)-HeaderSize)
+	copy(data, payload[HeaderSize:])
+	return Snapshot{
+		Tick:      binary.BigEndian.Uint32(payload[0:4]),
+		Timestamp: int64(binary.BigEndian.Uint64(payload[4:12])),
+		Data:      data,
+	}, nil
+}
+
+type Buffer struct {
+	snapshots    []Snapshot // buffered snapshots sorted by tick, snapshots[0] is the last one rendered from
+	capacity     int
+	min_delay    float64 // playout delay bounds in milliseconds
+	max_delay    float64
+	delay        float64 // current playout delay in milliseconds
+	jitter       float64 // interarrival jitter estimate in milliseconds (RFC 3550)
+	interval     float64 // smoothed time between snapshots in milliseconds
+	offset       float64 // estimated server time - local time in milliseconds
+	last_transit int64   // transit time (received - timestamp) of the last snapshot
+	last_stamp   int64   // timestamp of the last snapshot
+	has_arrival  bool
+	rendering    bool   // true once Sample has returned a snapshot pair
+	late         uint64 // snapshots that arrived after their render time had passed
+	missing      uint64 // ticks that never arrived before the render time passed them
+}
+
+// NewBuffer creates a snapshot buffer holding at most capacity snapshots. The playout delay
+// starts at minDelay and adapts to the measured jitter but never exceeds maxDelay
+func NewBuffer(capacity int, minDelay time.Duration, maxDelay time.Duration) *Buffer {
+	if capacity < 2 {
+		capacity = 2
+	}
+	if maxDelay < minDelay {
+		maxDelay = minDelay
+	}
+	return &Buffer{
+		snapshots: make([]Snapshot, 0, capacity),
+		capacity:  capacity,
+		min_delay: float64(minDelay.Milliseconds()),
+		max_delay: float64(maxDelay.Milliseconds()),
+		delay:     float64(minDelay.Milliseconds()),
+	}
+}
+
+// Add buffers a snapshot payload received at the local time now. Snapshots that arrive
+// after the render time has moved past them are counted as late and dropped.
+func (b *Buffer) Add(payload []byte, now time.Time) error {
+	s, err := Unmarshal(payload)
+	if err != nil {
+		return err
+	}
+	b.Insert(s, now)
+	return nil
+}
+
+// Insert buffers an already unmarshaled snapshot received at the local time now
+func (b *Buffer) Insert(s Snapshot, now time.Time) {
+	received := now.UnixMilli()
+	b.updateTiming(s.Timestamp, received)
+
+	if b.rendering && len(b.snapshots) > 0 && s.Tick <= b.snapshots[0].Tick {
+		// we have already rendered past this tick
+		if s.Tick != b.snapshots[0].Tick {
+			b.late++
+		}
+		return
+	}
+	i := sort.Search(len(b.snapshots), func(i int) bool { return b.snapshots[i].Tick >= s.Tick })
+	if i < len(b.snapshots) && b.snapshots[i].Tick == s.Tick {
+		// duplicate
+		return
+	}
+	b.snapshots = append(b.snapshots, Snapshot{})
+	copy(b.snapshots[i+1:], b.snapshots[i:])
+	b.snapshots[i] = s
+	if len(b.snapshots) > b.capacity {
+		// the buffer is full, drop the oldest snapshot
+		b.snapshots = append(b.snapshots[:0], b.snapshots[1:]...)
+	}
+}
+
+// updateTiming updates the jitter, snapshot interval and clock offset estimates and adapts
+// the playout delay to them
+func (b *Buffer) updateTiming(timestamp int64, received int64) {
+	transit := received - timestamp
+	if !b.has_arrival {
+		b.has_arrival = true
+		b.offset = float64(-transit)
+	} else {
+		d := math.Abs(float64(transit - b.last_transit))
+		b.jitter += (d - b.jitter) / 16
+		if timestamp > b.last_stamp {
+			gap := float64(timestamp - b.last_stamp)
+			if b.interval == 0 {
+				b.interval = gap
+			} else {
+				b.interval += (gap - b.interval) / 16
+			}
+		}
+		// the fastest snapshot gives the best estimate of the clock offset, drift slowly
+		// towards slower samples in case the path has become longer
+		if float64(-transit) > b.offset {
+			b.offset = float64(-transit)
+		} else {
+			b.offset += (float64(-transit) - b.offset) / 256
+		}
+	}
+	b.last_transit = transit
+	if timestamp > b.last_stamp {
+		b.last_stamp = timestamp
+	}
+
+	// hold enough to cover one snapshot interval plus the jitter
+	target := b.interval + 4*b.jitter
+	target = math.Max(b.min_delay, math.Min(b.max_delay, target))
+	b.delay += (target - b.delay) / 8
+}
+
+// Sample returns the two snapshots to interpolate between at the local time now and how
+// far (0-1) the render time is between them. ok is false until there are enough snapshots
+// buffered to interpolate.
+func (b *Buffer) Sample(now time.Time) (from Snapshot, to Snapshot, alpha float64, ok bool) {
+	if len(b.snapshots) < 2 {
+		return Snapshot{}, Snapshot{}, 0, false
+	}
+	render := b.RenderTime(now)
+	if !b.rendering && render < float64(b.snapshots[0].Timestamp) {
+		// still filling the buffer
+		return Snapshot{}, Snapshot{}, 0, false
+	}
+	b.rendering = true
+
+	// find the last snapshot at or before the render time, keeping at least two
+	i := 0
+	for i+2 < len(b.snapshots) && float64(b.snapshots[i+1].Timestamp) <= render {
+		i++
+	}
+	b.passed(i)
+
+	from, to = b.snapshots[0], b.snapshots[1]
+	span := float64(to.Timestamp - from.Timestamp)
+	if span > 0 {
+		alpha = (render - float64(from.Timestamp)) / span
+	}
+	alpha = math.Max(0, math.Min(1, alpha))
+	return from, to, alpha, true
+}
+
+// passed drops the first count snapshots, counting any ticks missing between them
+func (b *Buffer) passed(count int) {
+	for j := 0; j < count && j+1 < len(b.snapshots); j++ {
+		b.missing += uint64(b.snapshots[j+1].Tick - b.snapshots[j].Tick - 1)
+	}
+	b.snapshots = append(b.snapshots[:0], b.snapshots[count:]...)
+}
+
+// RenderTime returns the server time in milliseconds that should be rendered at the local time now
+func (b *Buffer) RenderTime(now time.Time) float64 {
+	return float64(now.UnixMilli()) + b.offset - b.delay
+}
+
+// Delay returns the current playout delay
+func (b *Buffer) Delay() time.Duration {
+	return time.Duration(b.delay * float64(time.Millisecond))
+}
+
+// Jitter returns the current interarrival jitter estimate
+func (b *Buffer) Jitter() time.Duration {
+	return time.Duration(b.jitter * float64(time.Millisecond))
+}
+
+// Len returns the number of buffered snapshots
+func (b *Buffer) Len() int {
+	return len(b.snapshots)
+}
+
+// Late returns the number of snapshots that arrived after the render time passed them
+func (b *Buffer) Late() uint64 {
+	return b.late
+}
+
+// Missing returns the number of ticks the render time passed without receiving a snapshot
+func (b *Buffer) Missing() uint64 {
+	return b.missing
+}
@@ -0,0 +1,92 @@
+package snapshot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRUDP_SnapshotMarshal(t *testing.T) {
+	payload := Marshal(7, 1234, []byte{1, 2, 3})
+	s, err := Unmarshal(payload)
+	if err != nil {
+		t.Error("Failed to unmarshal snapshot")
+	}
+	if s.Tick != 7 || s.Timestamp != 1234 || len(s.Data) != 3 {
+		t.Errorf("Unmarshal returned the wrong snapshot: %+v", s)
+	}
+	_, err = Unmarshal([]byte{1, 2, 3})
+	if err != ErrShortPayload {
+		t.Error("Expected short payload error")
+	}
+}
+
+func TestRUDP_SnapshotInterpolation(t *testing.T) {
+	start := time.UnixMilli(10000)
+	b := NewBuffer(32, 100*time.Millisecond, 100*time.Millisecond)
+	// snapshots every 50ms arriving with a constant 20ms latency
+	for tick := uint32(0); tick < 10; tick++ {
+		stamp := int64(tick) * 50
+		b.Add(Marshal(tick, stamp, []byte{uint8(tick)}), start.Add(time.Duration(stamp+20)*time.Millisecond))
+	}
+	// at local time 300ms the server time is 280ms, minus the 100ms delay renders 180ms
+	from, to, alpha, ok := b.Sample(start.Add(300 * time.Millisecond))
+	if !ok {
+		t.Fatal("Expected enough snapshots to interpolate")
+	}
+	if from.Tick != 3 || to.Tick != 4 {
+		t.Errorf("Wrong snapshots returned, expected 3 and 4, received %d and %d", from.Tick, to.Tick)
+	}
+	if alpha < 0.59 || alpha > 0.61 {
+		t.Errorf("Wrong alpha, expected 0.6, received %f", alpha)
+	}
+	if b.Missing() != 0 {
+		t.Errorf("Expected no missing snapshots, received %d", b.Missing())
+	}
+}
+
+func TestRUDP_SnapshotLateAndMissing(t *testing.T) {
+	start := time.UnixMilli(10000)
+	b := NewBuffer(32, 50*time.Millisecond, 50*time.Millisecond)
+	// tick 2 and 3 are missing
+	for _, tick := range []uint32{0, 1, 4, 5, 6} {
+		stamp := int64(tick) * 50
+		b.Add(Marshal(tick, stamp, nil), start.Add(time.Duration(stamp)*time.Millisecond))
+	}
+	from, _, _, ok := b.Sample(start.Add(300 * time.Millisecond))
+	if !ok || from.Tick != 5 {
+		t.Fatalf("Expected to render from tick 5, received %d", from.Tick)
+	}
+	if b.Missing() != 2 {
+		t.Errorf("Expected 2 missing snapshots, received %d", b.Missing())
+	}
+	// tick 3 finally arrives after it has been rendered past
+	b.Add(Marshal(3, 150, nil), start.Add(310*time.Millisecond))
+	if b.Late() != 1 {
+		t.Errorf("Expected 1 late snapshot, received %d", b.Late())
+	}
+}
+
+func TestRUDP_SnapshotAdaptiveDelay(t *testing.T) {
+	start := time.UnixMilli(10000)
+	b := NewBuffer(64, 20*time.Millisecond, 500*time.Millisecond)
+	for tick := uint32(0); tick < 50; tick++ {
+		stamp := int64(tick) * 16
+		b.Add(Marshal(tick, stamp, nil), start.Add(time.Duration(stamp)*time.Millisecond))
+	}
+	steady := b.Delay()
+	// same snapshot rate but arrival times now swing by 40ms
+	for tick := uint32(50); tick < 100; tick++ {
+		stamp := int64(tick) * 16
+		latency := int64(tick%2) * 40
+		b.Add(Marshal(tick, stamp, nil), start.Add(time.Duration(stamp+latency)*time.Millisecond))
+	}
+	if b.Jitter() == 0 {
+		t.Error("Expected jitter to be measured")
+	}
+	if b.Delay() <= steady {
+		t.Errorf("Expected the playout delay to grow with jitter, %s -> %s", steady, b.Delay())
+	}
+	if b.Delay() > 500*time.Millisecond {
+		t.Error("Playout delay exceeded the maximum")
+	}
+}
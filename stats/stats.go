@@ -0,0 +1,210 @@
+// Package stats keeps the statistics of a connection: packets and bytes sent and received, acknowledgements, loss,
+// round trip time and data rates.  Clients and servers record into a Recorder, see client.Stats, server.Stats and
+// server.TotalStats.
+package stats
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	RateInterval = time.Second // send and receive rates are measured over intervals this long
+	lossWeight   = 1.0 / 32    // weight of each acknowledged or lost reliable packet in the loss rate
+	tracked      = 64          // reliable packets whose send time is kept to measure the RTT
+)
+
+// Stats are the statistics of a connection or, for server.TotalStats, of all connections.  Bytes are counted on the
+// wire, including headers, checksums and encryption.  Unreliable packets include acks, keepalives and the other
+// control packets.
+type Stats struct {
+	ReliableSent            uint64        // reliable packets sent
+	UnreliableSent          uint64        // unreliable and control packets sent
+	ReliableBytesSent       uint64        // bytes of the reliable packets sent
+	UnreliableBytesSent     uint64        // bytes of the unreliable and control packets sent
+	ReliableReceived        uint64        // reliable packets received
+	UnreliableReceived      uint64        // unreliable, control and malformed packets received
+	ReliableBytesReceived   uint64        // bytes of the reliable packets received
+	UnreliableBytesReceived uint64        // bytes of the unreliable, control and malformed packets received
+	Resends                 uint64        // connect requests and accepts sent again because the first went unanswered
+	Acked                   uint64        // reliable packets acknowledged by the other side
+	Lost                    uint64        // reliable packets that fell out of the ack window without an acknowledgement
+	Duplicates              uint64        // reliable packets received again
+	Malformed               uint64        // malformed and corrupted packets received
+	RTT                     time.Duration // smoothed round trip time of the acknowledged reliable packets
+	RTTVariance             time.Duration // mean deviation of the round trip time
+	LossRate                float64       // recent fraction of reliable packets lost, between 0 and 1
+	SendRate                float64       // bytes sent per second over the last RateInterval
+	ReceiveRate             float64       // bytes received per second over the last RateInterval
+}
+
+// Recorder collects the statistics of a connection, it is safe to use from several goroutines.  The zero value is
+// ready to use.
+type Recorder struct {
+	mu      sync.Mutex
+	stats   Stats
+	sampled bool // the RTT has been measured
+	sent    [tracked]sent
+	send    meter
+	receive meter
+}
+
+// sent is the send time of a reliable packet
+type sent struct {
+	seq uint32
+	at  time.Time // zero once acknowledged
+}
+
+// meter measures a data rate over intervals of RateInterval
+type meter struct {
+	start time.Time // start of the current interval
+	bytes uint64    // bytes in the current interval
+	rate  float64   // rate of the last complete interval
+}
+
+func (m *meter) add(bytes int, now time.Time) {
+	m.roll(now)
+	m.bytes += uint64(bytes)
+}
+
+// roll ends the current interval if it is over
+func (m *meter) roll(now time.Time) {
+	elapsed := now.Sub(m.start)
+	if m.start.IsZero() {
+		m.start = now
+	} else if elapsed >= RateInterval {
+		m.rate = float64(m.bytes) / elapsed.Seconds()
+		m.start, m.bytes = now, 0
+	}
+}
+
+// Sent records a packet of size bytes sent at now, reliable packets are remembered by seq to measure the RTT when
+// they are acknowledged
+func (r *Recorder) Sent(size int, reliable bool, seq uint32, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reliable {
+		r.stats.ReliableSent++
+		r.stats.ReliableBytesSent += uint64(size)
+		r.sent[seq%tracked] = sent{seq, now}
+	} else {
+		r.stats.UnreliableSent++
+		r.stats.UnreliableBytesSent += uint64(size)
+	}
+	r.send.add(size, now)
+}
+
+// Received records a packet of size bytes received at now
+func (r *Recorder) Received(size int, reliable bool, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reliable {
+		r.stats.ReliableReceived++
+		r.stats.ReliableBytesReceived += uint64(size)
+	} else {
+		r.stats.UnreliableReceived++
+		r.stats.UnreliableBytesReceived += uint64(size)
+	}
+	r.receive.add(size, now)
+}
+
+// Acked records the acknowledgement of the reliable packet seq at now and returns the RTT measured with it, 0 if
+// its send time is no longer known
+func (r *Recorder) Acked(seq uint32, now time.Time) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var rtt time.Duration
+	if s := &r.sent[seq%tracked]; s.seq == seq && !s.at.IsZero() {
+		rtt = now.Sub(s.at)
+		s.at = time.Time{}
+	}
+	r.ack(rtt)
+	return rtt
+}
+
+// AddAck records an acknowledgement with an RTT measured elsewhere, e.g. by the connection it belongs to, 0 for
+// none
+func (r *Recorder) AddAck(rtt time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ack(rtt)
+}
+
+func (r *Recorder) ack(rtt time.Duration) {
+	r.stats.Acked++
+	r.stats.LossRate -= r.stats.LossRate * lossWeight
+	if rtt > 0 {
+		r.sample(rtt)
+	}
+}
+
+// AddRTT adds an RTT measured without an acknowledgement, e.g. during the handshake
+func (r *Recorder) AddRTT(rtt time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sample(rtt)
+}
+
+// sample smooths the RTT like TCP does (RFC 6298)
+func (r *Recorder) sample(rtt time.Duration) {
+	if !r.sampled {
+		r.stats.RTT, r.stats.RTTVariance = rtt, rtt/2
+		r.sampled = true
+		return
+	}
+	deviation := r.stats.RTT - rtt
+	if deviation < 0 {
+		deviation = -deviation
+	}
+	r.stats.RTTVariance = (3*r.stats.RTTVariance + deviation) / 4
+	r.stats.RTT = (7*r.stats.RTT + rtt) / 8
+}
+
+// Lost records a reliable packet that will never be acknowledged
+func (r *Recorder) Lost() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Lost++
+	r.stats.LossRate += (1 - r.stats.LossRate) * lossWeight
+}
+
+// Duplicate records a reliable packet that was received again
+func (r *Recorder) Duplicate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Duplicates++
+}
+
+// Malformed records a malformed or corrupted packet
+func (r *Recorder) Malformed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Malformed++
+}
+
+// Resent records a connect request or accept sent again
+func (r *Recorder) Resent() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Resends++
+}
+
+// Reset starts over, e.g. for a new connection
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats, r.sampled = Stats{}, false
+	r.sent = [tracked]sent{}
+	r.send, r.receive = meter{}, meter{}
+}
+
+// Stats returns the statistics with the rates as of now
+func (r *Recorder) Stats(now time.Time) Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.send.roll(now)
+	r.receive.roll(now)
+	stats := r.stats
+	stats.SendRate, stats.ReceiveRate = r.send.rate, r.receive.rate
+	return stats
+}
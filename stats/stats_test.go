@@ -0,0 +1,57 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRUDP_Recorder(t *testing.T) {
+	start := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+	var r Recorder
+	for seq := uint32(0); seq < 4; seq++ {
+		r.Sent(100, true, seq, start)
+	}
+	r.Sent(50, false, 0, start)
+	r.Received(30, false, start)
+
+	// the first sample sets the RTT, later ones are smoothed
+	if rtt := r.Acked(0, start.Add(80*time.Millisecond)); rtt != 80*time.Millisecond {
+		t.Errorf("Acked measured %v, expected 80ms", rtt)
+	}
+	if rtt := r.Acked(0, start.Add(90*time.Millisecond)); rtt != 0 {
+		t.Errorf("a second ack of the same packet measured %v", rtt)
+	}
+	r.Acked(1, start.Add(40*time.Millisecond))
+	r.Lost()
+	r.Duplicate()
+	r.Malformed()
+	r.Resent()
+
+	stats := r.Stats(start.Add(time.Second))
+	expected := Stats{
+		ReliableSent: 4, UnreliableSent: 1, ReliableBytesSent: 400, UnreliableBytesSent: 50,
+		UnreliableReceived: 1, UnreliableBytesReceived: 30,
+		Resends: 1, Acked: 3, Lost: 1, Duplicates: 1, Malformed: 1,
+		RTT:         75 * time.Millisecond, // 7/8 80ms + 1/8 40ms
+		RTTVariance: 40 * time.Millisecond, // 3/4 40ms + 1/4 40ms
+		SendRate:    450,
+		ReceiveRate: 30,
+	}
+	loss := stats.LossRate
+	stats.LossRate = 0
+	if stats != expected {
+		t.Errorf("Stats returned\n%+v, expected\n%+v", stats, expected)
+	}
+	if loss <= 0 || loss > lossWeight {
+		t.Errorf("loss rate %v after 1 of 4 packets was lost", loss)
+	}
+
+	// nothing sent in the last interval
+	if stats := r.Stats(start.Add(2 * time.Second)); stats.SendRate != 0 || stats.ReceiveRate != 0 {
+		t.Errorf("rates %v and %v while idle", stats.SendRate, stats.ReceiveRate)
+	}
+	r.Reset()
+	if stats := r.Stats(start); stats != (Stats{}) {
+		t.Errorf("Stats after Reset returned %+v", stats)
+	}
+}
@@ -0,0 +1,189 @@
+package token
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"time"
+)
+
+/*
+*	Token - connect tokens for handing a client from the matchmaker to a server
+*	The matchmaker and the servers share a 32 byte key.  The matchmaker generates a token for each client
+*	it sends to a server, the client presents it when it connects and the server only accepts connections
+*	with a valid token.  The client can't read or change the token.
+*	Token Structure  [Nonce][Ciphertext][Tag]
+*		Nonce - random 12 byte nonce, also identifies the token for replay detection
+*		Ciphertext - [client id][expires][address count][addresses...][user data size][user data] encrypted with AES-256-GCM
+*		Tag - 16 byte authentication tag
+ */
+
+const (
+	KeySize        = 32
+	NonceSize      = 12
+	MaxAddresses   = 16
+	MaxUserData    = 256
+	additionalData = "rudp connect token 1"
+)
+
+var (
+	ErrInvalid     = errors.New("connect token is invalid")
+	ErrExpired     = errors.New("connect token has expired")
+	ErrTooLarge    = errors.New("connect token has too many addresses or too much user data")
+	ErrWrongServer = errors.New("connect token is not for this server")
+	ErrInvalidKey  = errors.New("connect token key must be 32 bytes")
+)
+
+type Token struct {
+	ClientID  uint64           // id the matchmaker assigned to the client
+	Addresses []netip.AddrPort // servers the client may connect to
+	Expires   time.Time        // the token is rejected after this time
+	UserData  []byte           // anything else the server needs to know about the client
+}
+
+// GenerateKey creates a new random key to share between the matchmaker and the servers
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+// Generate encrypts the token with the shared key
+func Generate(key []byte, t Token) ([]byte, error) {
+	if len(t.Addresses) > MaxAddresses || len(t.UserData) > MaxUserData {
+		return nil, ErrTooLarge
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, 17, 17+len(t.Addresses)*19+2+len(t.UserData))
+	binary.BigEndian.PutUint64(plain[0:], t.ClientID)
+	binary.BigEndian.PutUint64(plain[8:], uint64(t.Expires.Unix()))
+	plain[16] = uint8(len(t.Addresses))
+	for _, a := range t.Addresses {
+		b, err := a.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		plain = append(plain, uint8(len(b)))
+		plain = append(plain, b...)
+	}
+	plain = binary.BigEndian.AppendUint16(plain, uint16(len(t.UserData)))
+	plain = append(plain, t.UserData...)
+
+	nonce := make([]byte, NonceSize, NonceSize+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, []byte(additionalData)), nil
+}
+
+// Open decrypts the token with the shared key and checks it hasn't expired at the time now
+func Open(key []byte, data []byte, now time.Time) (Token, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return Token{}, err
+	}
+	if len(data) < NonceSize+aead.Overhead() {
+		return Token{}, ErrInvalid
+	}
+	plain, err := aead.Open(nil, data[:NonceSize], data[NonceSize:], []byte(additionalData))
+	if err != nil || len(plain) < 17 {
+		return Token{}, ErrInvalid
+	}
+	t := Token{
+		ClientID: binary.BigEndian.Uint64(plain[0:8]),
+		Expires:  time.Unix(int64(binary.BigEndian.Uint64(plain[8:16])), 0),
+	}
+	count := int(plain[16])
+	plain = plain[17:]
+	for i := 0; i < count; i++ {
+		if len(plain) < 1 || len(plain) < 1+int(plain[0]) {
+			return Token{}, ErrInvalid
+		}
+		var a netip.AddrPort
+		if err := a.UnmarshalBinary(plain[1 : 1+int(plain[0])]); err != nil {
+			return Token{}, ErrInvalid
+		}
+		t.Addresses = append(t.Addresses, a)
+		plain = plain[1+int(plain[0]):]
+	}
+	if len(plain) < 2 || len(plain)-2 != int(binary.BigEndian.Uint16(plain)) {
+		return Token{}, ErrInvalid
+	}
+	t.UserData = plain[2:]
+	if !now.Before(t.Expires) {
+		return t, ErrExpired
+	}
+	return t, nil
+}
+
+// Allows returns true if the token lets the client connect to the server listening on addr.  A server listening
+// on an unspecified address (0.0.0.0 or ::) matches any token address with the same port.
+func (t Token) Allows(addr netip.AddrPort) bool {
+	for _, a := range t.Addresses {
+		if a.Port() != addr.Port() {
+			continue
+		}
+		if addr.Addr().IsUnspecified() || a.Addr().Unmap() == addr.Addr().Unmap() {
+			return true
+		}
+	}
+	return false
+}
+
+// ID returns the part of an encrypted token that identifies it for replay detection
+func ID(data []byte) (id [NonceSize]byte) {
+	copy(id[:], data)
+	return id
+}
+
+type seen struct {
+	addr    netip.AddrPort
+	expires time.Time
+}
+
+// ReplayCache remembers the tokens that have been used so that a token can only be used from one address
+type ReplayCache struct {
+	tokens map[[NonceSize]byte]seen
+	sweep  time.Time
+}
+
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache{tokens: make(map[[NonceSize]byte]seen)}
+}
+
+// Use records that the token was presented by addr and returns false if it was already used by another address.
+// The same address may present the token again, connect requests are resent when they are lost.
+func (c *ReplayCache) Use(data []byte, t Token, addr netip.AddrPort, now time.Time) bool {
+	if now.After(c.sweep) {
+		// forget tokens that have expired, they are rejected anyway
+		for id, s := range c.tokens {
+			if !now.Before(s.expires) {
+				delete(c.tokens, id)
+			}
+		}
+		c.sweep = now.Add(time.Second)
+	}
+	id := ID(data)
+	if s, ok := c.tokens[id]; ok {
+		return s.addr == addr
+	}
+	c.tokens[id] = seen{addr: addr, expires: t.Expires}
+	return true
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
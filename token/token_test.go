@@ -0,0 +1,88 @@
+package token
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRUDP_TokenRoundTrip(t *testing.T) {
+	key, _ := GenerateKey()
+	now := time.Unix(1000, 0)
+	server := netip.MustParseAddrPort("10.0.0.1:8000")
+	data, err := Generate(key, Token{
+		ClientID:  42,
+		Addresses: []netip.AddrPort{server, netip.MustParseAddrPort("[::1]:8000")},
+		Expires:   now.Add(30 * time.Second),
+		UserData:  []byte("team=red"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to generate token: %s", err)
+	}
+	tok, err := Open(key, data, now)
+	if err != nil {
+		t.Fatalf("Failed to open token: %s", err)
+	}
+	if tok.ClientID != 42 || len(tok.Addresses) != 2 || !bytes.Equal(tok.UserData, []byte("team=red")) {
+		t.Errorf("Token did not round trip: %+v", tok)
+	}
+	if !tok.Allows(server) || !tok.Allows(netip.MustParseAddrPort("0.0.0.0:8000")) {
+		t.Error("Token should allow the server it was generated for")
+	}
+	if tok.Allows(netip.MustParseAddrPort("10.0.0.2:8000")) || tok.Allows(netip.MustParseAddrPort("10.0.0.1:8001")) {
+		t.Error("Token allowed another server")
+	}
+}
+
+func TestRUDP_TokenRejected(t *testing.T) {
+	key, _ := GenerateKey()
+	now := time.Unix(1000, 0)
+	data, _ := Generate(key, Token{ClientID: 1, Expires: now.Add(time.Second)})
+
+	if _, err := Open(key, data, now.Add(time.Second)); err != ErrExpired {
+		t.Error("Expected an expired token")
+	}
+	other, _ := GenerateKey()
+	if _, err := Open(other, data, now); err != ErrInvalid {
+		t.Error("Token opened with the wrong key")
+	}
+	data[len(data)-1] ^= 1
+	if _, err := Open(key, data, now); err != ErrInvalid {
+		t.Error("Tampered token was accepted")
+	}
+	if _, err := Open(key, data[:5], now); err != ErrInvalid {
+		t.Error("Short token was accepted")
+	}
+	if _, err := Open(key[:5], data, now); err != ErrInvalidKey {
+		t.Error("Short key was accepted")
+	}
+	if _, err := Generate(key, Token{UserData: make([]byte, MaxUserData+1)}); err != ErrTooLarge {
+		t.Error("Expected too much user data")
+	}
+}
+
+func TestRUDP_TokenReplayCache(t *testing.T) {
+	key, _ := GenerateKey()
+	now := time.Unix(1000, 0)
+	tok := Token{ClientID: 1, Expires: now.Add(10 * time.Second)}
+	data, _ := Generate(key, tok)
+	a := netip.MustParseAddrPort("1.2.3.4:5000")
+	b := netip.MustParseAddrPort("5.6.7.8:5000")
+
+	cache := NewReplayCache()
+	if !cache.Use(data, tok, a, now) {
+		t.Error("First use of a token was rejected")
+	}
+	if !cache.Use(data, tok, a, now) {
+		t.Error("Resent connect request from the same address was rejected")
+	}
+	if cache.Use(data, tok, b, now) {
+		t.Error("Token replayed from another address was accepted")
+	}
+	// expired tokens are forgotten
+	cache.Use(nil, Token{Expires: now}, b, now.Add(20*time.Second))
+	if len(cache.tokens) != 1 {
+		t.Errorf("Expected expired tokens to be removed, %d remain", len(cache.tokens))
+	}
+}
@@ -0,0 +1,117 @@
+package transport
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jomstead/go-rudp/clock"
+)
+
+// datagram is a received packet waiting in an inbox
+type datagram struct {
+	data []byte
+	from net.Addr
+}
+
+// inbox queues received datagrams for ReadFrom and implements read deadlines and closing
+type inbox struct {
+	queue    chan datagram
+	closed   chan struct{}
+	once     sync.Once
+	mu       sync.Mutex
+	read_by  time.Time     // read deadline, zero for none
+	deadline chan struct{} // closed and replaced when the read deadline changes, wakes blocked reads
+	clock    clock.Clock   // time source of the deadlines
+}
+
+func (in *inbox) init(c clock.Clock) {
+	in.clock = c
+	in.queue = make(chan datagram, EndpointQueue)
+	in.closed = make(chan struct{})
+	in.deadline = make(chan struct{})
+}
+
+// push queues d, it is dropped if the queue is full
+func (in *inbox) push(d datagram) {
+	select {
+	case in.queue <- d:
+	default:
+	}
+}
+
+// isClosed reports whether close was called
+func (in *inbox) isClosed() bool {
+	select {
+	case <-in.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// close ends blocked reads, it returns false if the inbox was already closed
+func (in *inbox) close() bool {
+	closed := false
+	in.once.Do(func() {
+		close(in.closed)
+		closed = true
+	})
+	return closed
+}
+
+// read reads the next datagram into b, waiting until one arrives, the read deadline passes or the inbox is closed
+func (in *inbox) read(b []byte) (int, net.Addr, error) {
+	for {
+		in.mu.Lock()
+		deadline, changed, c := in.read_by, in.deadline, in.clock
+		in.mu.Unlock()
+		n, from, done, err := in.wait(b, c, deadline, changed)
+		if done {
+			return n, from, err
+		}
+	}
+}
+
+// wait reads the next datagram like read, done is false if the read deadline changed while waiting
+func (in *inbox) wait(b []byte, c clock.Clock, deadline time.Time, changed chan struct{}) (int, net.Addr, bool, error) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		wait := deadline.Sub(c.Now())
+		if wait <= 0 {
+			return 0, nil, true, os.ErrDeadlineExceeded
+		}
+		timer := c.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+	select {
+	case d := <-in.queue:
+		return copy(b, d.data), d.from, true, nil
+	case <-in.closed:
+		return 0, nil, true, net.ErrClosed
+	case <-timeout:
+		return 0, nil, true, os.ErrDeadlineExceeded
+	case <-changed:
+		return 0, nil, false, nil
+	}
+}
+
+// setClock changes the time source and wakes blocked reads to wait on it
+func (in *inbox) setClock(c clock.Clock) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.clock = c
+	close(in.deadline)
+	in.deadline = make(chan struct{})
+}
+
+func (in *inbox) SetReadDeadline(t time.Time) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.read_by = t
+	close(in.deadline)
+	in.deadline = make(chan struct{})
+	return nil
+}
@@ -0,0 +1,178 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jomstead/go-rudp/clock"
+)
+
+/*
+ * In-memory transport
+ *
+ * A Hub connects endpoints in the same process, datagrams are copied through channels without touching the OS.
+ * Like UDP, packets to an address nobody listens on and packets that arrive while an endpoint's queue is full are
+ * dropped.  Endpoints are net.PacketConns with UDP addresses, so clients and servers run on them unchanged and
+ * tests on separate hubs can run in parallel.
+ */
+
+const (
+	EndpointQueue = 1024  // packets an endpoint holds before dropping new ones, like a socket receive buffer
+	firstPort     = 49152 // first port handed out for port 0, the start of the dynamic port range
+)
+
+var ErrAddressInUse = errors.New("address already in use")
+
+// Hub delivers datagrams between its endpoints
+type Hub struct {
+	mu        sync.Mutex
+	endpoints map[netip.AddrPort]*Endpoint
+	next      uint16      // next port for port 0
+	clock     clock.Clock // time source of the endpoints' deadlines
+}
+
+// NewHub returns an empty hub
+func NewHub() *Hub {
+	return &Hub{endpoints: make(map[netip.AddrPort]*Endpoint), next: firstPort, clock: clock.Real}
+}
+
+// SetClock sets the time source of the endpoints' read and write deadlines, nil is the system clock.  Give clients
+// and servers on the hub the same clock (see package clocktest) to test their timing without sleeping.
+func (h *Hub) SetClock(c clock.Clock) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clock = clock.Or(c)
+	for _, e := range h.endpoints {
+		e.setClock(h.clock)
+	}
+}
+
+// Pipe returns two endpoints on a new hub, at 127.0.0.1 with ports of their own
+func Pipe() (*Endpoint, *Endpoint) {
+	hub := NewHub()
+	a, _ := hub.ListenPacket("127.0.0.1:0")
+	b, _ := hub.ListenPacket("127.0.0.1:0")
+	return a, b
+}
+
+// ListenPacket returns an endpoint at address (ip:port), port 0 picks a free port.  An endpoint at an unspecified
+// address (0.0.0.0 or ::) receives the packets sent to its port on any address.
+func (h *Hub) ListenPacket(address string) (*Endpoint, error) {
+	addr, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if addr.Port() == 0 {
+		for h.endpoints[netip.AddrPortFrom(addr.Addr(), h.next)] != nil {
+			h.next++
+		}
+		addr = netip.AddrPortFrom(addr.Addr(), h.next)
+		if h.next++; h.next == 0 {
+			h.next = firstPort
+		}
+	}
+	if h.endpoints[addr] != nil {
+		return nil, &net.OpError{Op: "listen", Net: "memory", Addr: net.UDPAddrFromAddrPort(addr), Err: ErrAddressInUse}
+	}
+	e := &Endpoint{hub: h, addr: addr}
+	e.init(h.clock)
+	h.endpoints[addr] = e
+	return e, nil
+}
+
+// route returns the endpoint packets to addr are delivered to, nil if there is none
+func (h *Hub) route(addr netip.AddrPort) *Endpoint {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if e := h.endpoints[addr]; e != nil {
+		return e
+	}
+	any := netip.IPv4Unspecified()
+	if addr.Addr().Is6() && !addr.Addr().Is4In6() {
+		any = netip.IPv6Unspecified()
+	}
+	return h.endpoints[netip.AddrPortFrom(any, addr.Port())]
+}
+
+// Endpoint is a net.PacketConn on a Hub
+type Endpoint struct {
+	inbox
+	hub      *Hub
+	addr     netip.AddrPort
+	write_by time.Time // write deadline, zero for none, guarded by inbox.mu
+}
+
+// ReadFrom reads the next datagram, waiting until one arrives, the read deadline passes or the endpoint is closed
+func (e *Endpoint) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, from, err := e.read(b)
+	if err != nil {
+		return n, from, e.error("read", err)
+	}
+	return n, from, nil
+}
+
+// WriteTo sends a copy of b to addr, it never blocks.  Packets to addresses without an endpoint or with a full
+// queue are dropped like UDP packets.
+func (e *Endpoint) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if e.isClosed() {
+		return 0, e.error("write", net.ErrClosed)
+	}
+	e.mu.Lock()
+	deadline, now := e.write_by, e.clock.Now()
+	e.mu.Unlock()
+	if !deadline.IsZero() && !now.Before(deadline) {
+		return 0, e.error("write", os.ErrDeadlineExceeded)
+	}
+	to, ok := AddrPort(addr)
+	if !ok {
+		return 0, e.error("write", errors.New("not an ip:port address"))
+	}
+	if dest := e.hub.route(to); dest != nil {
+		dest.push(datagram{append([]byte(nil), b...), e.LocalAddr()})
+	}
+	return len(b), nil
+}
+
+// Close removes the endpoint from its hub and ends blocked reads
+func (e *Endpoint) Close() error {
+	if !e.close() {
+		return e.error("close", net.ErrClosed)
+	}
+	e.hub.mu.Lock()
+	delete(e.hub.endpoints, e.addr)
+	e.hub.mu.Unlock()
+	return nil
+}
+
+// LocalAddr returns the endpoint's address, a *net.UDPAddr
+func (e *Endpoint) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(e.addr)
+}
+
+// AddrPort returns the endpoint's address
+func (e *Endpoint) AddrPort() netip.AddrPort {
+	return e.addr
+}
+
+func (e *Endpoint) SetDeadline(t time.Time) error {
+	e.SetReadDeadline(t)
+	return e.SetWriteDeadline(t)
+}
+
+func (e *Endpoint) SetWriteDeadline(t time.Time) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.write_by = t
+	return nil
+}
+
+// error wraps err like the net package does for sockets, so net.Error timeouts and net.ErrClosed work as usual
+func (e *Endpoint) error(op string, err error) error {
+	return &net.OpError{Op: op, Net: "memory", Addr: e.LocalAddr(), Err: err}
+}
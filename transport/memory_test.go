@@ -0,0 +1,107 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRUDP_MemoryPipe(t *testing.T) {
+	t.Parallel()
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+	if a.AddrPort() == b.AddrPort() {
+		t.Fatalf("Pipe endpoints share the address %v", a.AddrPort())
+	}
+
+	data := []byte{1, 2, 3}
+	if n, err := a.WriteTo(data, b.LocalAddr()); err != nil || n != 3 {
+		t.Fatalf("WriteTo returned %d, %v", n, err)
+	}
+	data[0] = 9 // the packet is a copy
+	buffer := make([]byte, 16)
+	n, from, err := b.ReadFrom(buffer)
+	if err != nil || !bytes.Equal(buffer[:n], []byte{1, 2, 3}) {
+		t.Fatalf("ReadFrom returned %v, %v", buffer[:n], err)
+	}
+	if from.String() != a.LocalAddr().String() {
+		t.Errorf("packet came from %v, expected %v", from, a.LocalAddr())
+	}
+
+	// packets to nobody are dropped
+	if _, err := a.WriteTo(data, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}); err != nil {
+		t.Errorf("WriteTo an unused address failed: %v", err)
+	}
+}
+
+func TestRUDP_MemoryHub(t *testing.T) {
+	t.Parallel()
+	hub := NewHub()
+	server, err := hub.ListenPacket("0.0.0.0:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if _, err := hub.ListenPacket("0.0.0.0:9000"); !errors.Is(err, ErrAddressInUse) {
+		t.Errorf("listening twice on one address returned %v", err)
+	}
+	client, _ := hub.ListenPacket("10.0.0.2:0")
+	defer client.Close()
+
+	// the unspecified address receives packets for its port on any address
+	client.WriteTo([]byte{1}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 9000})
+	buffer := make([]byte, 16)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := server.ReadFrom(buffer); err != nil || n != 1 {
+		t.Errorf("ReadFrom returned %d, %v", n, err)
+	}
+
+	// deadlines time out like sockets
+	server.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, _, err = server.ReadFrom(buffer)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+
+	// changing the deadline wakes a blocked read
+	server.SetReadDeadline(time.Time{})
+	done := make(chan error)
+	go func() {
+		_, _, err := server.ReadFrom(buffer)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	server.SetReadDeadline(time.Now())
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("expected a timeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read didn't wake up when the deadline changed")
+	}
+
+	// closing ends reads and frees the address
+	server.SetReadDeadline(time.Time{})
+	go func() {
+		_, _, err := server.ReadFrom(buffer)
+		done <- err
+	}()
+	server.Close()
+	if err := <-done; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("read on a closed endpoint returned %v", err)
+	}
+	if _, err := server.WriteTo([]byte{1}, client.LocalAddr()); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write on a closed endpoint returned %v", err)
+	}
+	again, err := hub.ListenPacket("0.0.0.0:9000")
+	if err != nil {
+		t.Fatalf("address not freed by Close: %v", err)
+	}
+	again.Close()
+}
@@ -0,0 +1,367 @@
+package transport
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jomstead/go-rudp/clock"
+)
+
+/*
+ * Network simulator
+ *
+ * A Simulator wraps a net.PacketConn and impairs the packets written to and read from it: random and bursty loss,
+ * latency, jitter, duplication, reordering, a bandwidth limit and corruption.  Every decision comes from a random
+ * number generator seeded by the caller, one per direction, so the same packets sent in the same order are lost,
+ * duplicated and corrupted the same way on every run.  Delays run on the system clock unless SetClock gives the
+ * simulator another one.
+ */
+
+var ErrInvalidConditions = errors.New("invalid network conditions")
+
+// DefaultReorderDelay is how long reordered packets are held back when Conditions.ReorderDelay is 0
+const DefaultReorderDelay = 10 * time.Millisecond
+
+// Conditions describe the impairments of one direction, the zero value passes packets through unchanged.
+// Probabilities are between 0 and 1.
+type Conditions struct {
+	Loss         float64         // probability that a packet is lost
+	Burst        *GilbertElliott // bursty loss on top of Loss, nil for none
+	Latency      time.Duration   // delay added to every packet
+	Jitter       time.Duration   // random delay between 0 and Jitter added to every packet, packets can overtake each other
+	Duplicate    float64         // probability that a packet is delivered twice
+	Reorder      float64         // probability that a packet is held back by ReorderDelay so later packets overtake it
+	ReorderDelay time.Duration   // extra delay of reordered packets, DefaultReorderDelay if 0
+	Corrupt      float64         // probability that one random bit of a packet is flipped
+	Bandwidth    int             // bytes per second, packets queue behind each other, 0 for unlimited
+	QueueDelay   time.Duration   // packets that would queue longer than this for the bandwidth are dropped, 0 for no limit
+}
+
+// GilbertElliott is a two state loss model for bursts: the link switches from the good to the bad state with
+// probability P and back with probability R before every packet, and loses packets with GoodLoss or BadLoss in
+// each state.  The average burst is 1/R packets long.
+type GilbertElliott struct {
+	P        float64
+	R        float64
+	GoodLoss float64
+	BadLoss  float64
+}
+
+// validate returns an error if a probability isn't between 0 and 1 or a duration or the bandwidth is negative
+func (c Conditions) validate() error {
+	probabilities := map[string]float64{"Loss": c.Loss, "Duplicate": c.Duplicate, "Reorder": c.Reorder, "Corrupt": c.Corrupt}
+	if c.Burst != nil {
+		probabilities["Burst.P"] = c.Burst.P
+		probabilities["Burst.R"] = c.Burst.R
+		probabilities["Burst.GoodLoss"] = c.Burst.GoodLoss
+		probabilities["Burst.BadLoss"] = c.Burst.BadLoss
+	}
+	for name, p := range probabilities {
+		if !(p >= 0 && p <= 1) {
+			return fmt.Errorf("%w: %s %v is not between 0 and 1", ErrInvalidConditions, name, p)
+		}
+	}
+	if c.Latency < 0 || c.Jitter < 0 || c.ReorderDelay < 0 || c.QueueDelay < 0 {
+		return fmt.Errorf("%w: negative delay", ErrInvalidConditions)
+	}
+	if c.Bandwidth < 0 {
+		return fmt.Errorf("%w: negative bandwidth %d", ErrInvalidConditions, c.Bandwidth)
+	}
+	return nil
+}
+
+// link is the state of one direction
+type link struct {
+	conditions Conditions
+	random     *rand.Rand
+	bad        bool      // Gilbert-Elliott state
+	free       time.Time // when the packets queued for the bandwidth have been sent
+}
+
+// impair decides the fate of a packet sent at now, it returns the copies to deliver and when to deliver them
+func (l *link) impair(data []byte, now time.Time) ([][]byte, []time.Time) {
+	c := &l.conditions
+	lost := l.random.Float64() < c.Loss
+	if c.Burst != nil {
+		if l.bad {
+			l.bad = l.random.Float64() >= c.Burst.R
+		} else {
+			l.bad = l.random.Float64() < c.Burst.P
+		}
+		loss := c.Burst.GoodLoss
+		if l.bad {
+			loss = c.Burst.BadLoss
+		}
+		lost = l.random.Float64() < loss || lost
+	}
+	if lost {
+		return nil, nil
+	}
+
+	at := now
+	if c.Bandwidth > 0 {
+		if l.free.After(at) {
+			at = l.free
+		}
+		if c.QueueDelay > 0 && at.Sub(now) > c.QueueDelay {
+			return nil, nil
+		}
+		at = at.Add(time.Duration(len(data)) * time.Second / time.Duration(c.Bandwidth))
+		l.free = at
+	}
+	at = at.Add(c.Latency)
+	if c.Jitter > 0 {
+		at = at.Add(time.Duration(l.random.Int63n(int64(c.Jitter) + 1)))
+	}
+	if l.random.Float64() < c.Reorder {
+		if c.ReorderDelay > 0 {
+			at = at.Add(c.ReorderDelay)
+		} else {
+			at = at.Add(DefaultReorderDelay)
+		}
+	}
+
+	packet := append([]byte(nil), data...)
+	if l.random.Float64() < c.Corrupt && len(packet) > 0 {
+		bit := l.random.Intn(len(packet) * 8)
+		packet[bit/8] ^= 1 << (bit % 8)
+	}
+	if l.random.Float64() < c.Duplicate {
+		return [][]byte{packet, append([]byte(nil), packet...)}, []time.Time{at, at}
+	}
+	return [][]byte{packet}, []time.Time{at}
+}
+
+// delayed is a packet waiting for its delivery time
+type delayed struct {
+	at       time.Time
+	order    uint64 // packets due at the same time are delivered in the order they were scheduled
+	data     []byte
+	addr     net.Addr
+	outgoing bool
+}
+
+// delayedHeap orders packets by delivery time
+type delayedHeap []delayed
+
+func (h delayedHeap) Len() int { return len(h) }
+func (h delayedHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].order < h[j].order
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h delayedHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *delayedHeap) Push(x any)   { *h = append(*h, x.(delayed)) }
+func (h *delayedHeap) Pop() any {
+	old := *h
+	d := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return d
+}
+
+// Simulator is a net.PacketConn that impairs the packets of the net.PacketConn it wraps
+type Simulator struct {
+	inbox
+	conn      net.PacketConn
+	connected *net.UDPConn // conn if it is a connected UDP socket, written with Write
+	lock      sync.Mutex   // guards the links and the pending packets
+	send      link
+	receive   link
+	pending   delayedHeap
+	order     uint64
+	wake      chan struct{} // signals the scheduler that the next delivery time changed
+	clock     clock.Clock   // time source of the delays
+}
+
+// Simulate wraps c with send conditions for the packets written to it and receive conditions for the packets read
+// from it.  The seed makes the random decisions repeatable.  Closing the simulator closes c.
+func Simulate(c net.PacketConn, send Conditions, receive Conditions, seed int64) (*Simulator, error) {
+	if err := send.validate(); err != nil {
+		return nil, err
+	}
+	if err := receive.validate(); err != nil {
+		return nil, err
+	}
+	s := &Simulator{conn: c, wake: make(chan struct{}, 1), clock: clock.Real}
+	if udp, ok := c.(*net.UDPConn); ok && udp.RemoteAddr() != nil {
+		s.connected = udp
+	}
+	s.init(s.clock)
+	s.send = link{conditions: send, random: rand.New(rand.NewSource(seed))}
+	s.receive = link{conditions: receive, random: rand.New(rand.NewSource(seed + 1))}
+	go s.readLoop()
+	go s.schedule()
+	return s, nil
+}
+
+// SetConditions changes the conditions of both directions, packets already delayed keep their delivery time
+func (s *Simulator) SetConditions(send Conditions, receive Conditions) error {
+	if err := send.validate(); err != nil {
+		return err
+	}
+	if err := receive.validate(); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.send.conditions = send
+	s.receive.conditions = receive
+	return nil
+}
+
+// SetClock sets the time source of the delays and the read deadline, nil is the system clock.  The deadlines of
+// the wrapped connection still follow its own clock.
+func (s *Simulator) SetClock(c clock.Clock) {
+	s.lock.Lock()
+	s.clock = clock.Or(c)
+	s.lock.Unlock()
+	s.setClock(clock.Or(c))
+	s.signal()
+}
+
+// signal wakes the scheduler to look at the next delivery time again
+func (s *Simulator) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// ReadFrom reads the next packet that made it through the receive conditions
+func (s *Simulator) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, from, err := s.read(b)
+	if err != nil {
+		return n, from, s.error("read", err)
+	}
+	return n, from, nil
+}
+
+// WriteTo passes b through the send conditions, it returns before delayed packets are sent and doesn't report
+// errors sending them
+func (s *Simulator) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if s.isClosed() {
+		return 0, s.error("write", net.ErrClosed)
+	}
+	s.lock.Lock()
+	if s.send.conditions == (Conditions{}) && len(s.pending) == 0 {
+		s.lock.Unlock()
+		return s.write(b, addr)
+	}
+	s.delay(&s.send, b, addr, true)
+	s.lock.Unlock()
+	return len(b), nil
+}
+
+// write sends b on the wrapped connection
+func (s *Simulator) write(b []byte, addr net.Addr) (int, error) {
+	if s.connected != nil {
+		return s.connected.Write(b)
+	}
+	return s.conn.WriteTo(b, addr)
+}
+
+// delay schedules the copies of a packet that make it through l, s.lock must be held
+func (s *Simulator) delay(l *link, b []byte, addr net.Addr, outgoing bool) {
+	packets, times := l.impair(b, s.clock.Now())
+	for i, packet := range packets {
+		s.order++
+		heap.Push(&s.pending, delayed{times[i], s.order, packet, addr, outgoing})
+		if s.pending[0].order == s.order {
+			s.signal()
+		}
+	}
+}
+
+// readLoop reads packets from the wrapped connection and passes them through the receive conditions until it is
+// closed
+func (s *Simulator) readLoop() {
+	buffer := make([]byte, 65536)
+	for {
+		n, from, err := s.conn.ReadFrom(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || s.isClosed() {
+				s.close()
+				return
+			}
+			continue
+		}
+		s.lock.Lock()
+		if s.receive.conditions == (Conditions{}) && len(s.pending) == 0 {
+			s.push(datagram{append([]byte(nil), buffer[:n]...), from})
+		} else {
+			s.delay(&s.receive, buffer[:n], from, false)
+		}
+		s.lock.Unlock()
+	}
+}
+
+// schedule delivers delayed packets when they are due until the simulator is closed
+func (s *Simulator) schedule() {
+	for {
+		s.lock.Lock()
+		var due []delayed
+		now := s.clock.Now()
+		for len(s.pending) > 0 && !s.pending[0].at.After(now) {
+			due = append(due, heap.Pop(&s.pending).(delayed))
+		}
+		var timer clock.Timer
+		if len(s.pending) > 0 {
+			timer = s.clock.NewTimer(s.pending[0].at.Sub(now))
+		}
+		s.lock.Unlock()
+
+		for _, d := range due {
+			if d.outgoing {
+				s.write(d.data, d.addr)
+			} else {
+				s.push(datagram{d.data, d.addr})
+			}
+		}
+		var expired <-chan time.Time
+		if timer != nil {
+			expired = timer.C()
+		}
+		select {
+		case <-expired:
+		case <-s.wake:
+		case <-s.closed:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Close closes the wrapped connection, delayed packets are dropped
+func (s *Simulator) Close() error {
+	s.close()
+	return s.conn.Close()
+}
+
+func (s *Simulator) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Simulator) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *Simulator) SetWriteDeadline(t time.Time) error {
+	return s.conn.SetWriteDeadline(t)
+}
+
+// error wraps err like the net package does for sockets
+func (s *Simulator) error(op string, err error) error {
+	return &net.OpError{Op: op, Net: "simulator", Addr: s.LocalAddr(), Err: err}
+}
@@ -0,0 +1,168 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"os"
+	"testing"
+	"time"
+)
+
+// simulate sends count numbered packets of size bytes from a simulator with the conditions and returns the numbers
+// received in order of arrival
+func simulate(t *testing.T, send Conditions, seed int64, count int, size int) []uint32 {
+	a, b := Pipe()
+	defer b.Close()
+	sim, err := Simulate(a, send, Conditions{}, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	for i := 0; i < count; i++ {
+		packet := make([]byte, size)
+		binary.BigEndian.PutUint32(packet, uint32(i))
+		sim.WriteTo(packet, b.LocalAddr())
+	}
+	var received []uint32
+	buffer := make([]byte, 2048)
+	for {
+		b.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := b.ReadFrom(buffer)
+		if err != nil {
+			return received
+		}
+		if n != size {
+			t.Fatalf("received %d bytes, sent %d", n, size)
+		}
+		received = append(received, binary.BigEndian.Uint32(buffer))
+	}
+}
+
+func TestRUDP_SimulatorLoss(t *testing.T) {
+	t.Parallel()
+	first := simulate(t, Conditions{Loss: 0.3}, 1, 1000, 8)
+	if len(first) < 620 || len(first) > 780 {
+		t.Errorf("%d of 1000 packets arrived with 30%% loss", len(first))
+	}
+	second := simulate(t, Conditions{Loss: 0.3}, 1, 1000, 8)
+	if len(first) != len(second) {
+		t.Fatalf("the same seed lost %d and %d packets", 1000-len(first), 1000-len(second))
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("the same seed lost different packets")
+		}
+	}
+
+	// bursts lose P/(P+R) of the packets in runs averaging 1/R packets
+	burst := simulate(t, Conditions{Burst: &GilbertElliott{P: 0.05, R: 0.25, BadLoss: 1}}, 2, 1000, 8)
+	if len(burst) < 750 || len(burst) > 910 {
+		t.Errorf("%d of 1000 packets arrived with bursty loss", len(burst))
+	}
+	gaps, lost := 0, 1000-len(burst)
+	for i := 1; i < len(burst); i++ {
+		if burst[i] != burst[i-1]+1 {
+			gaps++
+		}
+	}
+	if gaps == 0 || lost/gaps < 2 {
+		t.Errorf("%d packets lost in %d bursts, expected bursts of about 4", lost, gaps)
+	}
+}
+
+func TestRUDP_SimulatorDelay(t *testing.T) {
+	t.Parallel()
+	a, b := Pipe()
+	defer b.Close()
+	sim, _ := Simulate(a, Conditions{Latency: 30 * time.Millisecond, Jitter: 10 * time.Millisecond}, Conditions{}, 1)
+	defer sim.Close()
+	start := time.Now()
+	sim.WriteTo([]byte{1}, b.LocalAddr())
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := b.ReadFrom(make([]byte, 8)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("packet arrived after %v with 30ms latency", elapsed)
+	}
+
+	// 10 packets of 100 bytes take 100ms at 10000 bytes per second
+	start = time.Now()
+	if received := simulate(t, Conditions{Bandwidth: 10000}, 1, 10, 100); len(received) != 10 {
+		t.Errorf("%d of 10 packets arrived", len(received))
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("10 packets of 100 bytes arrived after %v at 10000 bytes per second", elapsed)
+	}
+	// with a queue limit of 50ms the last packets are dropped
+	if received := simulate(t, Conditions{Bandwidth: 10000, QueueDelay: 50 * time.Millisecond}, 1, 10, 100); len(received) != 6 {
+		t.Errorf("%d of 10 packets arrived, expected 6", len(received))
+	}
+}
+
+func TestRUDP_SimulatorReorderDuplicateCorrupt(t *testing.T) {
+	t.Parallel()
+	received := simulate(t, Conditions{Reorder: 0.2, ReorderDelay: 20 * time.Millisecond}, 1, 100, 8)
+	if len(received) != 100 {
+		t.Fatalf("%d of 100 packets arrived", len(received))
+	}
+	reordered := 0
+	for i := 1; i < len(received); i++ {
+		if received[i] < received[i-1] {
+			reordered++
+		}
+	}
+	if reordered == 0 {
+		t.Error("no packets were reordered")
+	}
+
+	if received := simulate(t, Conditions{Duplicate: 1}, 1, 10, 8); len(received) != 20 {
+		t.Errorf("%d packets arrived, 10 sent and duplicated", len(received))
+	}
+
+	a, b := Pipe()
+	defer b.Close()
+	sim, _ := Simulate(a, Conditions{Corrupt: 1}, Conditions{}, 1)
+	defer sim.Close()
+	sent := []byte{1, 2, 3, 4}
+	sim.WriteTo(sent, b.LocalAddr())
+	buffer := make([]byte, 8)
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := b.ReadFrom(buffer)
+	if err != nil || n != 4 {
+		t.Fatalf("ReadFrom returned %d, %v", n, err)
+	}
+	flipped := 0
+	for i := range sent {
+		flipped += bits.OnesCount8(sent[i] ^ buffer[i])
+	}
+	if flipped != 1 {
+		t.Errorf("%d bits flipped, expected 1", flipped)
+	}
+}
+
+func TestRUDP_SimulatorReceive(t *testing.T) {
+	t.Parallel()
+	a, b := Pipe()
+	defer a.Close()
+	sim, _ := Simulate(b, Conditions{}, Conditions{Loss: 1}, 1)
+	defer sim.Close()
+	a.WriteTo([]byte{1}, sim.LocalAddr())
+	sim.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := sim.ReadFrom(make([]byte, 8)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected the packet to be lost, got %v", err)
+	}
+
+	sim.SetConditions(Conditions{}, Conditions{Latency: 20 * time.Millisecond})
+	a.WriteTo([]byte{2}, sim.LocalAddr())
+	sim.SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, 8)
+	if n, from, err := sim.ReadFrom(buffer); err != nil || n != 1 || buffer[0] != 2 || from.String() != a.LocalAddr().String() {
+		t.Errorf("ReadFrom returned %v from %v, %v", buffer[:n], from, err)
+	}
+
+	if _, err := Simulate(b, Conditions{Loss: 2}, Conditions{}, 1); !errors.Is(err, ErrInvalidConditions) {
+		t.Errorf("a loss of 2 returned %v", err)
+	}
+}
@@ -0,0 +1,23 @@
+// Package transport has packet transports RUDP clients and servers can run on besides UDP sockets.  Clients and
+// servers take any net.PacketConn whose addresses are IP:port addresses, see AddrPort.
+package transport
+
+import (
+	"net"
+	"net/netip"
+)
+
+// AddrPort returns the IP address and port of addr, false if it doesn't have one.  It works for *net.UDPAddr,
+// addresses with an AddrPort method and addresses whose String is ip:port.
+func AddrPort(addr net.Addr) (netip.AddrPort, bool) {
+	switch a := addr.(type) {
+	case nil:
+		return netip.AddrPort{}, false
+	case *net.UDPAddr:
+		return a.AddrPort(), a != nil
+	case interface{ AddrPort() netip.AddrPort }:
+		return a.AddrPort(), true
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	return ap, err == nil
+}
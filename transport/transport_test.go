@@ -0,0 +1,33 @@
+package transport
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+type namedAddr string
+
+func (a namedAddr) Network() string { return "test" }
+func (a namedAddr) String() string  { return string(a) }
+
+func TestRUDP_AddrPort(t *testing.T) {
+	want := netip.MustParseAddrPort("127.0.0.1:8000")
+	tests := []struct {
+		addr net.Addr
+		ok   bool
+	}{
+		{net.UDPAddrFromAddrPort(want), true},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1).To4(), Port: 8000}, true},
+		{namedAddr("127.0.0.1:8000"), true},
+		{namedAddr("pipe"), false},
+		{nil, false},
+		{(*net.UDPAddr)(nil), false},
+	}
+	for _, test := range tests {
+		addr, ok := AddrPort(test.addr)
+		if ok != test.ok || (ok && addr != want) {
+			t.Errorf("AddrPort(%v) = %v, %v, expected %v, %v", test.addr, addr, ok, want, test.ok)
+		}
+	}
+}